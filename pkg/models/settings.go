@@ -8,12 +8,23 @@ import (
 )
 
 type PluginSettings struct {
+	ConnectionMode              string                `json:"connectionMode"`
 	Host                        string                `json:"host"`
 	Port                        int                   `json:"port"`
+	Hosts                       []HostSetting         `json:"hosts"`
+	ReplicaSet                  string                `json:"replicaSet"`
+	DirectConnection            bool                  `json:"directConnection"`
+	LoadBalanced                bool                  `json:"loadBalanced"`
 	Database                    string                `json:"database"`
 	AuthMethod                  string                `json:"authType"`
 	Username                    string                `json:"username"`
 	AuthDatabase                string                `json:"authDb"`
+	AuthMechanism               string                `json:"authMechanism"`
+	AuthMechanismProperties     map[string]string     `json:"authMechanismProperties"`
+	KerberosServiceName         string                `json:"kerberosServiceName"`
+	KerberosServiceRealm        string                `json:"kerberosServiceRealm"`
+	KerberosCanonicalizeHost    bool                  `json:"kerberosCanonicalizeHost"`
+	KerberosKeytabPath          string                `json:"kerberosKeytabPath"`
 	ConnectionStringScheme      string                `json:"connectionStringScheme"`
 	ConnectionOptions           string                `json:"connectionOptions"`
 	TlsOption                   string                `json:"tlsOption"`
@@ -22,12 +33,42 @@ type PluginSettings struct {
 	TlsInsecure                 bool                  `json:"tlsInsecure"`
 	TlsAllowInvalidHostnames    bool                  `json:"tlsAllowInvalidHostnames"`
 	TlsAllowInvalidCertificates bool                  `json:"tlsAllowInvalidCertificates"`
+	SshTunnelEnabled            bool                  `json:"sshTunnelEnabled"`
+	SshHost                     string                `json:"sshHost"`
+	SshPort                     int                   `json:"sshPort"`
+	SshUser                     string                `json:"sshUser"`
+	SshHostKey                  string                `json:"sshHostKey"`
+	SshKnownHostsPath           string                `json:"sshKnownHostsPath"`
+	QueryCacheEnabled           bool                  `json:"queryCacheEnabled"`
+	QueryCacheTTL               int                   `json:"queryCacheTTL"`
+	QueryCacheAlignment         int                   `json:"queryCacheAlignment"`
+	QueryCacheMaxSizeMB         int                   `json:"queryCacheMaxSizeMB"`
 	Secrets                     *SecretPluginSettings `json:"-"`
 }
 
+// HostSetting is a seed of the host list. The port is optional
+type HostSetting struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
 type SecretPluginSettings struct {
 	Password          string `json:"password"`
 	ClientKeyPassword string `json:"clientKeyPassword"`
+	// Full connection string, including the credentials
+	ConnectionString string `json:"connectionString"`
+	// MONGODB-AWS credentials, the environment is used when empty
+	AwsAccessKeyId     string `json:"awsAccessKeyId"`
+	AwsSecretAccessKey string `json:"awsSecretAccessKey"`
+	AwsSessionToken    string `json:"awsSessionToken"`
+	// PEM certificates, used instead of the certificate paths
+	CaCert     string `json:"caCert"`
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+	// SSH tunnel credentials, the private key is tried before the password
+	SshPrivateKey           string `json:"sshPrivateKey"`
+	SshPrivateKeyPassphrase string `json:"sshPrivateKeyPassphrase"`
+	SshPassword             string `json:"sshPassword"`
 }
 
 func LoadPluginSettings(source backend.DataSourceInstanceSettings) (*PluginSettings, error) {
@@ -46,5 +87,18 @@ func loadSecretPluginSettings(source map[string]string) *SecretPluginSettings {
 	return &SecretPluginSettings{
 		Password:          source["password"],
 		ClientKeyPassword: source["clientKeyPassword"],
+		ConnectionString:  source["connectionString"],
+
+		AwsAccessKeyId:     source["awsAccessKeyId"],
+		AwsSecretAccessKey: source["awsSecretAccessKey"],
+		AwsSessionToken:    source["awsSessionToken"],
+
+		CaCert:     source["caCert"],
+		ClientCert: source["clientCert"],
+		ClientKey:  source["clientKey"],
+
+		SshPrivateKey:           source["sshPrivateKey"],
+		SshPrivateKeyPassphrase: source["sshPrivateKeyPassphrase"],
+		SshPassword:             source["sshPassword"],
 	}
 }
@@ -0,0 +1,264 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// Pipeline stage marking where ad-hoc filters are inserted, e.g. {"$__adhocFilters": {}}
+	adhocFiltersStage = "$__adhocFilters"
+	// Max number of values returned by the tag values endpoint
+	adhocMaxTagValues = 1000
+)
+
+var objectIdPattern = regexp.MustCompile(`^[0-9a-fA-F]{24}$`)
+
+// adhocFilter is a Grafana ad-hoc filter
+type adhocFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// applyAdhocFilters turns the filters into a $match stage placed at the placeholder stage,
+// or at the start of the pipeline if there is none
+func applyAdhocFilters(pipeline []bson.D, filters []adhocFilter) ([]bson.D, error) {
+	var match bson.D
+	if len(filters) > 0 {
+		conditions := make(bson.A, 0, len(filters))
+		for _, f := range filters {
+			c, err := adhocCondition(f)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, c)
+		}
+
+		match = bson.D{{Key: "$match", Value: bson.D{{Key: "$and", Value: conditions}}}}
+	}
+
+	result := make([]bson.D, 0, len(pipeline)+1)
+	placed := false
+	for _, stage := range pipeline {
+		if isAdhocPlaceholder(stage) {
+			if match != nil && !placed {
+				result = append(result, match)
+			}
+			placed = true
+			continue
+		}
+
+		result = append(result, stage)
+	}
+
+	if !placed && match != nil {
+		result = append([]bson.D{match}, result...)
+	}
+
+	return result, nil
+}
+
+func isAdhocPlaceholder(stage bson.D) bool {
+	return len(stage) == 1 && stage[0].Key == adhocFiltersStage
+}
+
+func adhocCondition(f adhocFilter) (bson.D, error) {
+	if f.Key == "" {
+		return nil, fmt.Errorf("ad-hoc filter has no key")
+	}
+
+	var cond any
+	switch f.Operator {
+	case "=":
+		cond = bson.D{{Key: "$in", Value: adhocValues(f.Value)}}
+	case "!=":
+		cond = bson.D{{Key: "$nin", Value: adhocValues(f.Value)}}
+	case "=~":
+		cond = bson.D{{Key: "$regex", Value: f.Value}}
+	case "!~":
+		cond = bson.D{{Key: "$not", Value: primitive.Regex{Pattern: f.Value}}}
+	case "<":
+		cond = bson.D{{Key: "$lt", Value: adhocOrderedValue(f.Value)}}
+	case ">":
+		cond = bson.D{{Key: "$gt", Value: adhocOrderedValue(f.Value)}}
+	default:
+		return nil, fmt.Errorf("unsupported ad-hoc filter operator %s", f.Operator)
+	}
+
+	return bson.D{{Key: f.Key, Value: cond}}, nil
+}
+
+// adhocValues lists the BSON values a filter value may stand for. Grafana sends all values
+// as strings, so the string is always included next to its typed interpretations
+func adhocValues(v string) bson.A {
+	values := bson.A{v}
+
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+		values = append(values, i)
+	} else if f, err := strconv.ParseFloat(v, 64); err == nil {
+		values = append(values, f)
+	}
+
+	if v == "true" || v == "false" {
+		values = append(values, v == "true")
+	}
+
+	if objectIdPattern.MatchString(v) {
+		if oid, err := primitive.ObjectIDFromHex(v); err == nil {
+			values = append(values, oid)
+		}
+	}
+
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		values = append(values, t)
+	}
+
+	return values
+}
+
+// adhocOrderedValue interprets the value of a < or > filter as a number, a date or a string
+func adhocOrderedValue(v string) any {
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return f
+	}
+
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t
+	}
+
+	return v
+}
+
+// tagKeysHandler lists the scalar fields of a collection as ad-hoc filter keys
+func (d *Datasource) tagKeysHandler(rw http.ResponseWriter, req *http.Request) {
+	collection := req.URL.Query().Get("collection")
+	if collection == "" {
+		http.Error(rw, "collection is required", http.StatusBadRequest)
+		return
+	}
+
+	schema, err := d.sampleSchema(req.Context(), collection, schemaDefaultSampleSize)
+	if err != nil {
+		backend.Logger.Error("Failed to infer collection schema", "collection", collection, "error", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]variableQueryEntry, 0, len(schema.Fields))
+	for _, f := range schema.Fields {
+		// Documents and arrays can't be compared with a single value
+		if f.Types[bson.TypeEmbeddedDocument.String()]+f.Types[bson.TypeArray.String()] == f.Count {
+			continue
+		}
+
+		keys = append(keys, variableQueryEntry{Value: f.Path, Text: f.Path})
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(keys)
+}
+
+// tagValuesHandler lists the distinct values of a field, limited to the time range if the
+// collection has a time field
+func (d *Datasource) tagValuesHandler(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	params := req.URL.Query()
+
+	collection := params.Get("collection")
+	key := params.Get("key")
+	if collection == "" || key == "" {
+		http.Error(rw, "collection and key are required", http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.D{}
+
+	timeField := params.Get("timeField")
+	if timeField == "" {
+		// Time series collections have a known time field
+		specs, err := d.client.Database(d.database).ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collection}})
+		if err == nil && len(specs) == 1 {
+			if info, err := newCollectionInfo(specs[0]); err == nil && info.TimeSeries != nil {
+				timeField = info.TimeSeries.TimeField
+			}
+		}
+	}
+
+	if timeField != "" {
+		timeRange := bson.D{}
+		for _, bound := range []struct{ param, op string }{{"from", "$gte"}, {"to", "$lte"}} {
+			if v := params.Get(bound.param); v != "" {
+				ms, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					http.Error(rw, fmt.Sprintf("invalid %s", bound.param), http.StatusBadRequest)
+					return
+				}
+				timeRange = append(timeRange, bson.E{Key: bound.op, Value: time.UnixMilli(ms)})
+			}
+		}
+
+		if len(timeRange) > 0 {
+			filter = append(filter, bson.E{Key: timeField, Value: timeRange})
+		}
+	}
+
+	values, err := d.client.Database(d.database).Collection(collection).Distinct(ctx, key, filter, options.Distinct().SetMaxTime(10*time.Second))
+	if err != nil {
+		backend.Logger.Error("Failed to get distinct values", "collection", collection, "key", key, "error", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries := tagValues(values)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(entries)
+}
+
+// tagValues converts distinct values to sorted entries, the text being what ad-hoc filters send back
+func tagValues(values []any) []variableQueryEntry {
+	entries := make([]variableQueryEntry, 0, len(values))
+	for _, v := range values {
+		var text string
+		switch v := v.(type) {
+		case nil:
+			continue
+		case string:
+			text = v
+		case primitive.ObjectID:
+			text = v.Hex()
+		case primitive.DateTime:
+			text = v.Time().UTC().Format(time.RFC3339)
+		case int32, int64, float64, bool:
+			text = fmt.Sprint(v)
+		default:
+			// Documents and arrays can't be used as filter values
+			continue
+		}
+
+		entries = append(entries, variableQueryEntry{Value: text, Text: text})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Text < entries[j].Text
+	})
+
+	if len(entries) > adhocMaxTagValues {
+		entries = entries[:adhocMaxTagValues]
+	}
+
+	return entries
+}
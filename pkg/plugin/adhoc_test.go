@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestApplyAdhocFilters(t *testing.T) {
+	project := bson.D{{Key: "$project", Value: bson.D{{Key: "a", Value: 1}}}}
+
+	t.Run("should insert $match at the start of the pipeline", func(t *testing.T) {
+		pipeline, err := applyAdhocFilters([]bson.D{project}, []adhocFilter{
+			{Key: "host", Operator: "=", Value: "web1"},
+			{Key: "level", Operator: "=~", Value: "^err"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []bson.D{
+			{{Key: "$match", Value: bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "host", Value: bson.D{{Key: "$in", Value: bson.A{"web1"}}}}},
+				bson.D{{Key: "level", Value: bson.D{{Key: "$regex", Value: "^err"}}}},
+			}}}}},
+			project,
+		}
+
+		assertEq(t, pipeline, expected)
+	})
+
+	t.Run("should replace the placeholder stage", func(t *testing.T) {
+		placeholder := bson.D{{Key: adhocFiltersStage, Value: bson.D{}}}
+
+		pipeline, err := applyAdhocFilters([]bson.D{project, placeholder}, []adhocFilter{
+			{Key: "count", Operator: ">", Value: "5"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []bson.D{
+			project,
+			{{Key: "$match", Value: bson.D{{Key: "$and", Value: bson.A{
+				bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 5.0}}}},
+			}}}}},
+		}
+
+		assertEq(t, pipeline, expected)
+	})
+
+	t.Run("should remove the placeholder stage without filters", func(t *testing.T) {
+		placeholder := bson.D{{Key: adhocFiltersStage, Value: bson.D{}}}
+
+		pipeline, err := applyAdhocFilters([]bson.D{placeholder, project}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, pipeline, []bson.D{project})
+	})
+
+	t.Run("should reject unknown operator", func(t *testing.T) {
+		_, err := applyAdhocFilters(nil, []adhocFilter{{Key: "a", Operator: "<>", Value: "1"}})
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestAdhocCondition(t *testing.T) {
+	t.Run("should compare typed values", func(t *testing.T) {
+		oid := primitive.NewObjectID()
+		ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		assertEq(t, adhocValues("42"), bson.A{"42", int64(42)})
+		assertEq(t, adhocValues("4.2"), bson.A{"4.2", 4.2})
+		assertEq(t, adhocValues("true"), bson.A{"true", true})
+		assertEq(t, adhocValues(oid.Hex()), bson.A{oid.Hex(), oid})
+		assertEq(t, adhocValues("2024-01-01T00:00:00Z"), bson.A{"2024-01-01T00:00:00Z", ts})
+		assertEq(t, adhocOrderedValue("2024-01-01T00:00:00Z"), ts)
+		assertEq(t, adhocOrderedValue("abc"), "abc")
+	})
+
+	t.Run("should negate regex and equality", func(t *testing.T) {
+		c, err := adhocCondition(adhocFilter{Key: "a", Operator: "!~", Value: "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, c, bson.D{{Key: "a", Value: bson.D{{Key: "$not", Value: primitive.Regex{Pattern: "x"}}}}})
+
+		c, err = adhocCondition(adhocFilter{Key: "a", Operator: "!=", Value: "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, c, bson.D{{Key: "a", Value: bson.D{{Key: "$nin", Value: bson.A{"x"}}}}})
+	})
+}
+
+func TestTagValues(t *testing.T) {
+	oid := primitive.NewObjectID()
+
+	entries := tagValues([]any{"b", int32(2), nil, oid, bson.D{{Key: "a", Value: 1}}, "a"})
+
+	texts := make([]string, 0, len(entries))
+	for _, e := range entries {
+		texts = append(texts, e.Text)
+	}
+
+	assertEq(t, texts, []string{"2", oid.Hex(), "a", "b"})
+}
@@ -0,0 +1,358 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// Bucket interval following the panel interval
+	builderIntervalAuto = "auto"
+	// Output field of the time buckets
+	builderTimeOutput = "time"
+)
+
+// $percentile was added in MongoDB 7.0
+var builderPercentileVersion = []int{7, 0}
+
+// builderModel is a query made in the visual query builder
+type builderModel struct {
+	TimeField    string               `json:"timeField"`
+	Filters      []builderFilter      `json:"filters"`
+	GroupBy      []string             `json:"groupBy"`
+	Aggregations []builderAggregation `json:"aggregations"`
+	// Interval like 5m, auto for the panel interval, or empty for no time buckets
+	BucketInterval string `json:"bucketInterval"`
+	Limit          int    `json:"limit"`
+}
+
+type builderFilter struct {
+	Field string `json:"field"`
+	// One of = != < <= > >= in nin exists regex
+	Operator string `json:"operator"`
+	Value    any    `json:"value"`
+}
+
+type builderAggregation struct {
+	Type  string `json:"type"`
+	Field string `json:"field"`
+	// Percentile between 0 and 100, required by the percentile aggregation
+	Percentile *float64 `json:"percentile"`
+	// Output field name, defaults to the type and the field
+	Alias string `json:"alias"`
+}
+
+type builderCompileRequest struct {
+	Builder builderModel `json:"builder"`
+	// Panel interval in milliseconds, used by the auto bucket interval
+	IntervalMs int64 `json:"intervalMs"`
+}
+
+type builderCompileResult struct {
+	QueryText string `json:"queryText"`
+}
+
+// compileBuilder turns a builder query into a pipeline. The time range is left as macros.
+// version may be nil if the server version is unknown
+func compileBuilder(q *builderModel, interval time.Duration, version []int) ([]bson.D, error) {
+	pipeline := make([]bson.D, 0)
+
+	match, err := builderMatch(q)
+	if err != nil {
+		return nil, err
+	}
+	if match != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: match}})
+	}
+
+	bucket, err := builderBucket(q, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without aggregations the documents are returned as they are
+	if len(q.Aggregations) == 0 && len(q.GroupBy) == 0 && bucket == 0 {
+		if q.TimeField != "" {
+			pipeline = append(pipeline, bson.D{{Key: "$sort", Value: bson.D{{Key: q.TimeField, Value: 1}}}})
+		}
+		return builderLimit(pipeline, q.Limit), nil
+	}
+
+	id := bson.D{}
+	project := bson.D{{Key: "_id", Value: 0}}
+	sort := bson.D{}
+	seen := map[string]bool{}
+
+	if bucket > 0 {
+		id = append(id, bson.E{Key: builderTimeOutput, Value: timeBucketExpr("$"+q.TimeField, bucket.Milliseconds())})
+		project = append(project, bson.E{Key: builderTimeOutput, Value: "$_id." + builderTimeOutput})
+		sort = append(sort, bson.E{Key: builderTimeOutput, Value: 1})
+		seen[builderTimeOutput] = true
+	}
+
+	for _, field := range q.GroupBy {
+		if field == "" {
+			return nil, fmt.Errorf("group by field is empty")
+		}
+
+		// Field names in $group keys can't contain dots
+		name := strings.ReplaceAll(field, ".", "_")
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate output field %s", name)
+		}
+		seen[name] = true
+
+		id = append(id, bson.E{Key: name, Value: "$" + field})
+		project = append(project, bson.E{Key: name, Value: "$_id." + name})
+		sort = append(sort, bson.E{Key: name, Value: 1})
+	}
+
+	group := bson.D{{Key: "_id", Value: id}}
+	if len(id) == 0 {
+		group = bson.D{{Key: "_id", Value: nil}}
+	}
+
+	for _, agg := range q.Aggregations {
+		name, acc, err := builderAccumulator(agg, version)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate output field %s", name)
+		}
+		seen[name] = true
+
+		group = append(group, bson.E{Key: name, Value: acc})
+
+		if agg.Type == builderAggPercentile {
+			// $percentile outputs an array with one value per requested percentile
+			project = append(project, bson.E{Key: name, Value: bson.D{{Key: "$arrayElemAt", Value: bson.A{"$" + name, 0}}}})
+		} else {
+			project = append(project, bson.E{Key: name, Value: 1})
+		}
+	}
+
+	pipeline = append(pipeline,
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$project", Value: project}},
+	)
+
+	if len(sort) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: sort}})
+	}
+
+	return builderLimit(pipeline, q.Limit), nil
+}
+
+// builderMatch combines the time range and the filters into a $match document
+func builderMatch(q *builderModel) (bson.D, error) {
+	conditions := bson.A{}
+
+	if q.TimeField != "" {
+		conditions = append(conditions, bson.D{{Key: q.TimeField, Value: bson.D{
+			{Key: "$gte", Value: macroTimeFrom},
+			{Key: "$lte", Value: macroTimeTo},
+		}}})
+	}
+
+	for _, f := range q.Filters {
+		c, err := builderCondition(f)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, c)
+	}
+
+	switch len(conditions) {
+	case 0:
+		return nil, nil
+	case 1:
+		return conditions[0].(bson.D), nil
+	default:
+		return bson.D{{Key: "$and", Value: conditions}}, nil
+	}
+}
+
+// builderCondition converts a filter to a query condition. String values are interpreted
+// like ad-hoc filter values, so that numbers, dates and ObjectIds typed in the editor match
+func builderCondition(f builderFilter) (bson.D, error) {
+	if f.Field == "" {
+		return nil, fmt.Errorf("filter has no field")
+	}
+
+	s, isString := f.Value.(string)
+
+	var cond any
+	switch f.Operator {
+	case "=":
+		if isString {
+			cond = bson.D{{Key: "$in", Value: adhocValues(s)}}
+		} else {
+			cond = bson.D{{Key: "$eq", Value: f.Value}}
+		}
+	case "!=":
+		if isString {
+			cond = bson.D{{Key: "$nin", Value: adhocValues(s)}}
+		} else {
+			cond = bson.D{{Key: "$ne", Value: f.Value}}
+		}
+	case "<", "<=", ">", ">=":
+		v := f.Value
+		if isString {
+			v = adhocOrderedValue(s)
+		}
+		op := map[string]string{"<": "$lt", "<=": "$lte", ">": "$gt", ">=": "$gte"}[f.Operator]
+		cond = bson.D{{Key: op, Value: v}}
+	case "in", "nin":
+		list, ok := f.Value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("filter on %s: %s expects a list of values", f.Field, f.Operator)
+		}
+		values := bson.A{}
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				values = append(values, adhocValues(s)...)
+			} else {
+				values = append(values, v)
+			}
+		}
+		cond = bson.D{{Key: "$" + f.Operator, Value: values}}
+	case "exists":
+		exists := true
+		if f.Value != nil {
+			b, ok := f.Value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("filter on %s: exists expects true or false", f.Field)
+			}
+			exists = b
+		}
+		cond = bson.D{{Key: "$exists", Value: exists}}
+	case "regex":
+		if !isString {
+			return nil, fmt.Errorf("filter on %s: regex expects a string", f.Field)
+		}
+		cond = bson.D{{Key: "$regex", Value: s}}
+	default:
+		return nil, fmt.Errorf("unsupported filter operator %s", f.Operator)
+	}
+
+	return bson.D{{Key: f.Field, Value: cond}}, nil
+}
+
+// builderBucket returns the time bucket size, or 0 if the results aren't bucketed
+func builderBucket(q *builderModel, interval time.Duration) (time.Duration, error) {
+	if q.BucketInterval == "" {
+		return 0, nil
+	}
+
+	if q.TimeField == "" {
+		return 0, fmt.Errorf("a time field is required to bucket by time")
+	}
+
+	bucket := interval
+	if q.BucketInterval != builderIntervalAuto {
+		var err error
+		if bucket, err = parseInterval(q.BucketInterval); err != nil {
+			return 0, err
+		}
+	}
+
+	// Sub-millisecond panel intervals would make empty buckets
+	if bucket < time.Millisecond {
+		bucket = time.Millisecond
+	}
+
+	return bucket, nil
+}
+
+// builderAccumulator returns the output name and the $group accumulator of an aggregation
+func builderAccumulator(agg builderAggregation, version []int) (string, any, error) {
+	if agg.Type != builderAggCount && agg.Field == "" {
+		return "", nil, fmt.Errorf("%s aggregation has no field", agg.Type)
+	}
+
+	name := agg.Alias
+	field := strings.ReplaceAll(agg.Field, ".", "_")
+
+	var acc any
+	switch agg.Type {
+	case builderAggCount:
+		if name == "" {
+			name = "count"
+		}
+		acc = bson.D{{Key: "$sum", Value: 1}}
+	case builderAggSum, builderAggAvg, builderAggMin, builderAggMax:
+		if name == "" {
+			name = agg.Type + "_" + field
+		}
+		acc = bson.D{{Key: "$" + agg.Type, Value: "$" + agg.Field}}
+	case builderAggPercentile:
+		if agg.Percentile == nil {
+			return "", nil, fmt.Errorf("percentile aggregation of %s has no percentile", agg.Field)
+		}
+		p := *agg.Percentile
+		if p < 0 || p > 100 {
+			return "", nil, fmt.Errorf("percentile should be between 0 and 100, got %v", p)
+		}
+		if version != nil && compareVersions(version, builderPercentileVersion) < 0 {
+			return "", nil, fmt.Errorf("percentile aggregation requires MongoDB %s, the server runs %s", formatVersion(builderPercentileVersion), formatVersion(version))
+		}
+		if name == "" {
+			name = "p" + strings.ReplaceAll(fmt.Sprint(p), ".", "_") + "_" + field
+		}
+		acc = bson.D{{Key: "$percentile", Value: bson.D{
+			{Key: "input", Value: "$" + agg.Field},
+			{Key: "p", Value: bson.A{p / 100}},
+			{Key: "method", Value: "approximate"},
+		}}}
+	default:
+		return "", nil, fmt.Errorf("unsupported aggregation %s", agg.Type)
+	}
+
+	if strings.Contains(name, ".") || strings.HasPrefix(name, "$") {
+		return "", nil, fmt.Errorf("invalid output field name %s", name)
+	}
+
+	return name, acc, nil
+}
+
+func builderLimit(pipeline []bson.D, limit int) []bson.D {
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	return pipeline
+}
+
+// compileBuilderHandler returns the pipeline of a builder query, so that it can be opened in
+// the raw query editor. The macros are kept in the pipeline
+func (d *Datasource) compileBuilderHandler(rw http.ResponseWriter, req *http.Request) {
+	var body builderCompileRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(rw, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	pipeline, err := compileBuilder(&body.Builder, time.Duration(body.IntervalMs)*time.Millisecond, d.serverVersion(req.Context()))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	text, err := formatPipeline(pipeline)
+	if err != nil {
+		backend.Logger.Error("Failed to format pipeline", "error", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(builderCompileResult{QueryText: text})
+}
@@ -0,0 +1,185 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func percentile(p float64) *float64 {
+	return &p
+}
+
+func TestCompileBuilder(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    builderModel
+		pipeline []string
+	}{
+		{
+			name:     "empty query",
+			query:    builderModel{},
+			pipeline: []string{},
+		},
+		{
+			name: "raw documents in the time range",
+			query: builderModel{
+				TimeField: "ts",
+				Filters:   []builderFilter{{Field: "status", Operator: "=", Value: "paid"}},
+				Limit:     100,
+			},
+			pipeline: []string{
+				`{"$match":{"$and":[{"ts":{"$gte":"$__timeFrom","$lte":"$__timeTo"}},{"status":{"$in":["paid"]}}]}}`,
+				`{"$sort":{"ts":1}}`,
+				`{"$limit":100}`,
+			},
+		},
+		{
+			name: "typed filters",
+			query: builderModel{
+				Filters: []builderFilter{
+					{Field: "amount", Operator: ">=", Value: float64(10)},
+					{Field: "host", Operator: "nin", Value: []any{"a", true}},
+					{Field: "deleted", Operator: "exists", Value: false},
+					{Field: "name", Operator: "regex", Value: "^a"},
+				},
+			},
+			pipeline: []string{
+				`{"$match":{"$and":[{"amount":{"$gte":10.0}},{"host":{"$nin":["a",true]}},{"deleted":{"$exists":false}},{"name":{"$regex":"^a"}}]}}`,
+			},
+		},
+		{
+			name: "aggregations by time bucket and field",
+			query: builderModel{
+				TimeField:      "ts",
+				GroupBy:        []string{"tags.host"},
+				BucketInterval: "5m",
+				Aggregations: []builderAggregation{
+					{Type: builderAggCount},
+					{Type: builderAggAvg, Field: "cpu.usage"},
+					{Type: builderAggMax, Field: "mem", Alias: "peak"},
+				},
+			},
+			pipeline: []string{
+				`{"$match":{"ts":{"$gte":"$__timeFrom","$lte":"$__timeTo"}}}`,
+				`{"$group":{"_id":{"time":{"$toDate":{"$subtract":[{"$toLong":"$ts"},{"$mod":[{"$toLong":"$ts"},300000]}]}},"tags_host":"$tags.host"},"count":{"$sum":1},"avg_cpu_usage":{"$avg":"$cpu.usage"},"peak":{"$max":"$mem"}}}`,
+				`{"$project":{"_id":0,"time":"$_id.time","tags_host":"$_id.tags_host","count":1,"avg_cpu_usage":1,"peak":1}}`,
+				`{"$sort":{"time":1,"tags_host":1}}`,
+			},
+		},
+		{
+			name: "percentile over the whole range",
+			query: builderModel{
+				Aggregations: []builderAggregation{{Type: builderAggPercentile, Field: "latency", Percentile: percentile(99.5)}},
+			},
+			pipeline: []string{
+				`{"$group":{"_id":null,"p99_5_latency":{"$percentile":{"input":"$latency","p":[0.995],"method":"approximate"}}}}`,
+				`{"$project":{"_id":0,"p99_5_latency":{"$arrayElemAt":["$p99_5_latency",0]}}}`,
+			},
+		},
+		{
+			name: "auto interval",
+			query: builderModel{
+				TimeField:      "ts",
+				BucketInterval: builderIntervalAuto,
+				Aggregations:   []builderAggregation{{Type: builderAggSum, Field: "bytes"}},
+			},
+			pipeline: []string{
+				`{"$match":{"ts":{"$gte":"$__timeFrom","$lte":"$__timeTo"}}}`,
+				`{"$group":{"_id":{"time":{"$toDate":{"$subtract":[{"$toLong":"$ts"},{"$mod":[{"$toLong":"$ts"},60000]}]}}},"sum_bytes":{"$sum":"$bytes"}}}`,
+				`{"$project":{"_id":0,"time":"$_id.time","sum_bytes":1}}`,
+				`{"$sort":{"time":1}}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("should compile "+tt.name, func(t *testing.T) {
+			pipeline, err := compileBuilder(&tt.query, time.Minute, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			text, err := formatPipeline(pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := "[]"
+			if len(tt.pipeline) > 0 {
+				expected = "[\n  " + strings.Join(tt.pipeline, ",\n  ") + "\n]"
+			}
+			assertEq(t, text, expected)
+		})
+	}
+
+	errors := []struct {
+		name    string
+		query   builderModel
+		version []int
+	}{
+		{"bucket without time field", builderModel{BucketInterval: "1m"}, nil},
+		{"invalid interval", builderModel{TimeField: "ts", BucketInterval: "5 minutes"}, nil},
+		{"aggregation without field", builderModel{Aggregations: []builderAggregation{{Type: builderAggSum}}}, nil},
+		{"unknown aggregation", builderModel{Aggregations: []builderAggregation{{Type: "median", Field: "a"}}}, nil},
+		{"duplicate output", builderModel{GroupBy: []string{"count"}, Aggregations: []builderAggregation{{Type: builderAggCount}}}, nil},
+		{"unknown operator", builderModel{Filters: []builderFilter{{Field: "a", Operator: "~", Value: "b"}}}, nil},
+		{"percentile without percentile", builderModel{Aggregations: []builderAggregation{{Type: builderAggPercentile, Field: "a"}}}, nil},
+		{"percentile out of range", builderModel{Aggregations: []builderAggregation{{Type: builderAggPercentile, Field: "a", Percentile: percentile(101)}}}, nil},
+		{"percentile on old server", builderModel{Aggregations: []builderAggregation{{Type: builderAggPercentile, Field: "a", Percentile: percentile(50)}}}, []int{6, 0, 4}},
+	}
+
+	for _, tt := range errors {
+		t.Run("should reject "+tt.name, func(t *testing.T) {
+			if _, err := compileBuilder(&tt.query, time.Minute, tt.version); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestEjectedBuilderQuery(t *testing.T) {
+	t.Run("should filter the JSON query by the panel time range", func(t *testing.T) {
+		pipeline, err := compileBuilder(&builderModel{TimeField: "ts"}, time.Minute, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Edit as JSON turns the builder query into query text
+		text, err := formatPipeline(pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pipeline, err = parseQueryText(text, queryLanguageJSON, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		to := from.Add(time.Hour)
+		query := backend.DataQuery{RefID: "A", TimeRange: backend.TimeRange{From: from, To: to}}
+
+		var executed []bson.D
+		exec := func(ctx context.Context, qm *queryModel, pipeline []bson.D, refId string) (*data.Frame, error) {
+			executed = pipeline
+			return data.NewFrame(refId), nil
+		}
+
+		ds := &Datasource{}
+		response := ds.execute(context.Background(), query, &queryModel{QueryText: text, QueryLanguage: queryLanguageJSON}, pipeline, exec)
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+
+		assertEq(t, executed[0], bson.D{{Key: "$match", Value: bson.D{{Key: "ts", Value: bson.D{
+			{Key: "$gte", Value: from},
+			{Key: "$lte", Value: to},
+		}}}}})
+	})
+}
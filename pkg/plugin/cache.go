@@ -0,0 +1,221 @@
+package plugin
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/haohanyang/mongodb-datasource/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultQueryCacheTTL       = 30 * time.Second
+	defaultQueryCacheAlignment = 10 * time.Second
+	defaultQueryCacheMaxSizeMB = 64
+)
+
+// queryCache is an in-process LRU cache of query results, bounded by a TTL and a total size.
+// Frames are stored arrow-encoded so every hit gets its own copy.
+type queryCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	alignment time.Duration
+	maxBytes  int
+	size      int
+	entries   map[string]*list.Element
+	lru       *list.List
+	now       func() time.Time
+}
+
+type queryCacheEntry struct {
+	key      string
+	frame    []byte
+	cachedAt time.Time
+}
+
+// Stored in frame.Meta.Custom of cached results
+type queryCacheMeta struct {
+	Cached   bool      `json:"cached"`
+	CachedAt time.Time `json:"cachedAt"`
+}
+
+func newQueryCache(config *models.PluginSettings) *queryCache {
+	c := &queryCache{
+		ttl:       defaultQueryCacheTTL,
+		alignment: defaultQueryCacheAlignment,
+		maxBytes:  defaultQueryCacheMaxSizeMB * 1024 * 1024,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		now:       time.Now,
+	}
+
+	if config.QueryCacheTTL > 0 {
+		c.ttl = time.Duration(config.QueryCacheTTL) * time.Second
+	}
+
+	if config.QueryCacheAlignment > 0 {
+		c.alignment = time.Duration(config.QueryCacheAlignment) * time.Second
+	}
+
+	if config.QueryCacheMaxSizeMB > 0 {
+		c.maxBytes = config.QueryCacheMaxSizeMB * 1024 * 1024
+	}
+
+	return c
+}
+
+// key identifies a query by its content and the time range rounded to the cache alignment. The
+// frontend interpolates $__from and $__to into the query text, so the exact bounds of the time
+// range are turned back into macros first, otherwise every refresh would have its own key
+func (c *queryCache) key(database string, qm *queryModel, pipeline []bson.D, timeRange backend.TimeRange) (string, error) {
+	values := timeRangeValues(timeRange.From, macroTimeFrom)
+	for k, v := range timeRangeValues(timeRange.To, macroTimeTo) {
+		values[k] = v
+	}
+
+	normalized := make([]bson.D, len(pipeline))
+	for i, stage := range pipeline {
+		normalized[i] = replaceTimeValues(stage, values).(bson.D)
+	}
+
+	return queryKey(database, qm, normalized, timeRange.From.Truncate(c.alignment), timeRange.To.Truncate(c.alignment))
+}
+
+// timeRangeValues returns the forms in which Grafana interpolates a time range bound: epoch
+// milliseconds as a number or a string, ISO 8601 text and dates. Zero times have no forms
+func timeRangeValues(t time.Time, macro string) map[any]string {
+	if t.IsZero() {
+		return map[any]string{}
+	}
+
+	ms := t.UnixMilli()
+	return map[any]string{
+		ms:                        macro,
+		float64(ms):               macro,
+		strconv.FormatInt(ms, 10): macro,
+		t.UTC().Format("2006-01-02T15:04:05.000Z"): macro,
+		primitive.NewDateTimeFromTime(t):           macro,
+	}
+}
+
+func replaceTimeValues(v any, values map[any]string) any {
+	switch v := v.(type) {
+	case bson.D:
+		d := make(bson.D, len(v))
+		for i, e := range v {
+			d[i] = bson.E{Key: e.Key, Value: replaceTimeValues(e.Value, values)}
+		}
+		return d
+
+	case bson.A:
+		a := make(bson.A, len(v))
+		for i, e := range v {
+			a[i] = replaceTimeValues(e, values)
+		}
+		return a
+
+	case int64, float64, string, primitive.DateTime:
+		if macro, ok := values[v]; ok {
+			return macro
+		}
+		return v
+
+	case time.Time:
+		if macro, ok := values[primitive.NewDateTimeFromTime(v)]; ok {
+			return macro
+		}
+		return v
+
+	default:
+		return v
+	}
+}
+
+// get returns a copy of the cached frame and the time it was cached
+func (c *queryCache) get(key string) (*data.Frame, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	entry := el.Value.(*queryCacheEntry)
+	if c.now().Sub(entry.cachedAt) > c.ttl {
+		c.remove(el)
+		return nil, time.Time{}, false
+	}
+
+	frame, err := data.UnmarshalArrowFrame(entry.frame)
+	if err != nil {
+		backend.Logger.Error("Failed to decode cached frame", "error", err)
+		c.remove(el)
+		return nil, time.Time{}, false
+	}
+
+	c.lru.MoveToFront(el)
+
+	return frame, entry.cachedAt, true
+}
+
+func (c *queryCache) set(key string, frame *data.Frame) error {
+	b, err := frame.MarshalArrow()
+	if err != nil {
+		return err
+	}
+
+	if len(b) > c.maxBytes {
+		return fmt.Errorf("result of %d bytes exceeds the cache size limit", len(b))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	// Evict least recently used entries until the new one fits
+	for c.size+len(b) > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+
+	c.entries[key] = c.lru.PushFront(&queryCacheEntry{
+		key:      key,
+		frame:    b,
+		cachedAt: c.now(),
+	})
+	c.size += len(b)
+
+	return nil
+}
+
+func (c *queryCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*queryCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.frame)
+}
+
+// markCached tells the user the frame is served from the cache and may be stale
+func markCached(frame *data.Frame, cachedAt time.Time, age time.Duration) {
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+
+	frame.Meta.Custom = queryCacheMeta{
+		Cached:   true,
+		CachedAt: cachedAt,
+	}
+
+	frame.AppendNotices(data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text:     fmt.Sprintf("Cached result from %s ago", age.Round(time.Second)),
+	})
+}
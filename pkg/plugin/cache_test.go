@@ -0,0 +1,200 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/haohanyang/mongodb-datasource/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestQueryCache(t *testing.T) {
+	qm := &queryModel{Collection: "test"}
+	pipeline := []bson.D{{{Key: "$match", Value: bson.D{{Key: "a", Value: 1}}}}}
+
+	t.Run("should align time range in cache key", func(t *testing.T) {
+		c := newQueryCache(&models.PluginSettings{QueryCacheAlignment: 10})
+		from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		to := from.Add(time.Hour)
+
+		k1, err := c.key("db", qm, pipeline, backend.TimeRange{From: from.Add(2 * time.Second), To: to.Add(3 * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		k2, err := c.key("db", qm, pipeline, backend.TimeRange{From: from.Add(7 * time.Second), To: to.Add(9 * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		k3, err := c.key("db", qm, pipeline, backend.TimeRange{From: from.Add(12 * time.Second), To: to.Add(12 * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if k1 != k2 {
+			t.Error("expected keys within the same alignment window to be equal")
+		}
+		if k1 == k3 {
+			t.Error("expected keys in different alignment windows to differ")
+		}
+	})
+
+	t.Run("should align interpolated time range in cache key", func(t *testing.T) {
+		c := newQueryCache(&models.PluginSettings{QueryCacheAlignment: 10})
+		from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		to := from.Add(time.Hour)
+
+		// The pipeline as interpolated by the frontend, in the forms of $__from, ${__from:date} and $date
+		interpolated := func(from time.Time, to time.Time) []bson.D {
+			return []bson.D{{{Key: "$match", Value: bson.D{
+				{Key: "a", Value: bson.D{{Key: "$gte", Value: from.UnixMilli()}, {Key: "$lte", Value: to.UnixMilli()}}},
+				{Key: "b", Value: bson.D{{Key: "$gte", Value: from.Format("2006-01-02T15:04:05.000Z")}}},
+				{Key: "c", Value: bson.A{primitive.NewDateTimeFromTime(from), primitive.NewDateTimeFromTime(to)}},
+			}}}}
+		}
+
+		r1 := backend.TimeRange{From: from.Add(2 * time.Second), To: to.Add(3 * time.Second)}
+		r2 := backend.TimeRange{From: from.Add(7 * time.Second), To: to.Add(9 * time.Second)}
+
+		k1, err := c.key("db", qm, interpolated(r1.From, r1.To), r1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k2, err := c.key("db", qm, interpolated(r2.From, r2.To), r2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if k1 != k2 {
+			t.Error("expected keys of interpolated time ranges within the same alignment window to be equal")
+		}
+
+		// Other numbers are part of the key
+		k3, err := c.key("db", qm, interpolated(r1.From, r1.To.Add(time.Minute)), r1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if k1 == k3 {
+			t.Error("expected keys with different values to differ")
+		}
+	})
+
+	t.Run("should distinguish options in cache key", func(t *testing.T) {
+		c := newQueryCache(&models.PluginSettings{})
+		other := &queryModel{Collection: "test"}
+		other.AggregateAllowDiskUse = true
+
+		k1, err := c.key("db", qm, pipeline, backend.TimeRange{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		k2, err := c.key("db", other, pipeline, backend.TimeRange{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if k1 == k2 {
+			t.Error("expected keys with different options to differ")
+		}
+	})
+
+	t.Run("should return a copy of the cached frame", func(t *testing.T) {
+		c := newQueryCache(&models.PluginSettings{})
+		frame := data.NewFrame("A", data.NewField("a", nil, []*int32{pointer[int32](1), pointer[int32](2)}))
+
+		if err := c.set("k", frame); err != nil {
+			t.Fatal(err)
+		}
+
+		cached, _, ok := c.get("k")
+		if !ok {
+			t.Fatal("expected cache hit")
+		}
+		if !cmp.Equal(cached, frame, dataFrameComparer) {
+			t.Error("unexpected cached frame")
+		}
+
+		cached.Fields[0].Set(0, pointer[int32](3))
+		again, _, _ := c.get("k")
+		if !cmp.Equal(again, frame, dataFrameComparer) {
+			t.Error("cached frame should not be modified through a returned copy")
+		}
+	})
+
+	t.Run("should tell the age of cached results from the cache clock", func(t *testing.T) {
+		c := newQueryCache(&models.PluginSettings{QueryCacheTTL: 300})
+		now := time.Now()
+		c.now = func() time.Time { return now }
+
+		exec := func(ctx context.Context, qm *queryModel, pipeline []bson.D, refId string) (*data.Frame, error) {
+			return data.NewFrame(refId), nil
+		}
+
+		ds := &Datasource{cache: c}
+		query := backend.DataQuery{RefID: "A", TimeRange: backend.TimeRange{From: now.Add(-time.Hour), To: now}}
+		ds.execute(context.Background(), query, qm, pipeline, exec)
+
+		now = now.Add(90 * time.Second)
+		response := ds.execute(context.Background(), query, qm, pipeline, exec)
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+
+		assertEq(t, response.Frames[0].Meta.Notices[0].Text, "Cached result from 1m30s ago")
+	})
+
+	t.Run("should expire entries after ttl", func(t *testing.T) {
+		c := newQueryCache(&models.PluginSettings{QueryCacheTTL: 5})
+		now := time.Now()
+		c.now = func() time.Time { return now }
+
+		if err := c.set("k", data.NewFrame("A")); err != nil {
+			t.Fatal(err)
+		}
+
+		now = now.Add(6 * time.Second)
+		if _, _, ok := c.get("k"); ok {
+			t.Error("expected expired entry to be a miss")
+		}
+		if c.size != 0 || c.lru.Len() != 0 {
+			t.Errorf("expected expired entry to be removed, size %d", c.size)
+		}
+	})
+
+	t.Run("should evict least recently used entries", func(t *testing.T) {
+		c := newQueryCache(&models.PluginSettings{})
+		frame := data.NewFrame("A", data.NewField("a", nil, []*int32{pointer[int32](1)}))
+		b, err := frame.MarshalArrow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.maxBytes = 2 * len(b)
+
+		for _, k := range []string{"k1", "k2"} {
+			if err := c.set(k, frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Touch k1 so k2 becomes the least recently used
+		c.get("k1")
+
+		if err := c.set("k3", frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, ok := c.get("k2"); ok {
+			t.Error("expected k2 to be evicted")
+		}
+		for _, k := range []string{"k1", "k3"} {
+			if _, _, ok := c.get(k); !ok {
+				t.Errorf("expected %s to be cached", k)
+			}
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"encoding/json"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// newCollectionInfo extracts time series and view details from a collection specification
+func newCollectionInfo(spec *mongo.CollectionSpecification) (collectionInfo, error) {
+	info := collectionInfo{
+		Name:     spec.Name,
+		Type:     spec.Type,
+		ReadOnly: spec.ReadOnly,
+	}
+
+	if info.Type == "" {
+		info.Type = collectionTypeCollection
+	}
+
+	if len(spec.Options) == 0 {
+		return info, nil
+	}
+
+	var opts struct {
+		TimeSeries *struct {
+			TimeField   string `bson:"timeField"`
+			MetaField   string `bson:"metaField"`
+			Granularity string `bson:"granularity"`
+		} `bson:"timeseries"`
+		ViewOn   string   `bson:"viewOn"`
+		Pipeline bson.Raw `bson:"pipeline"`
+	}
+
+	if err := bson.Unmarshal(spec.Options, &opts); err != nil {
+		return info, err
+	}
+
+	if opts.TimeSeries != nil {
+		info.TimeSeries = &timeSeriesInfo{
+			TimeField:   opts.TimeSeries.TimeField,
+			MetaField:   opts.TimeSeries.MetaField,
+			Granularity: opts.TimeSeries.Granularity,
+		}
+		info.Type = collectionTypeTimeSeries
+	}
+
+	if info.Type == collectionTypeView {
+		pipeline := json.RawMessage("[]")
+		if len(opts.Pipeline) > 0 {
+			var err error
+			pipeline, err = rawValueToJson(bson.RawValue{Type: bson.TypeArray, Value: opts.Pipeline})
+			if err != nil {
+				return info, err
+			}
+		}
+
+		info.View = &viewInfo{
+			ViewOn:   opts.ViewOn,
+			Pipeline: pipeline,
+		}
+	}
+
+	return info, nil
+}
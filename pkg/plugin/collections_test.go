@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestNewCollectionInfo(t *testing.T) {
+	t.Run("plain collection", func(t *testing.T) {
+		info, err := newCollectionInfo(&mongo.CollectionSpecification{Name: "users", Type: "collection"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Name != "users" || info.Type != collectionTypeCollection {
+			t.Errorf("unexpected collection info %+v", info)
+		}
+		if info.TimeSeries != nil || info.View != nil {
+			t.Errorf("expected no time series or view info, got %+v", info)
+		}
+	})
+
+	t.Run("time series collection", func(t *testing.T) {
+		opts, err := bson.Marshal(bson.M{
+			"timeseries": bson.M{
+				"timeField":   "ts",
+				"metaField":   "meta",
+				"granularity": "minutes",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := newCollectionInfo(&mongo.CollectionSpecification{Name: "weather", Type: "timeseries", Options: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Type != collectionTypeTimeSeries {
+			t.Errorf("expected type %s, got %s", collectionTypeTimeSeries, info.Type)
+		}
+		if info.TimeSeries == nil {
+			t.Fatal("expected time series info to be set")
+		}
+		if info.TimeSeries.TimeField != "ts" || info.TimeSeries.MetaField != "meta" || info.TimeSeries.Granularity != "minutes" {
+			t.Errorf("unexpected time series info %+v", info.TimeSeries)
+		}
+	})
+
+	t.Run("view", func(t *testing.T) {
+		opts, err := bson.Marshal(bson.D{
+			{Key: "viewOn", Value: "orders"},
+			{Key: "pipeline", Value: bson.A{bson.D{{Key: "$match", Value: bson.D{{Key: "status", Value: "A"}}}}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := newCollectionInfo(&mongo.CollectionSpecification{Name: "active_orders", Type: "view", Options: opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.View == nil {
+			t.Fatal("expected view info to be set")
+		}
+		if info.View.ViewOn != "orders" {
+			t.Errorf("expected view source orders, got %s", info.View.ViewOn)
+		}
+		if string(info.View.Pipeline) != `[{"$match":{"status":"A"}}]` {
+			t.Errorf("unexpected view pipeline %s", info.View.Pipeline)
+		}
+	})
+}
@@ -5,6 +5,25 @@ const (
 	mongoAuthNone             = ""
 	mongoAuthUsernamePassword = "username-password"
 	mongoAuthX509             = "x509"
+	mongoAuthAWS              = "aws"
+	mongoAuthLDAP             = "ldap"
+	mongoAuthKerberos         = "kerberos"
+)
+
+// SCRAM mechanisms of username/password auth. Corresponds to src/types.ts ScramMechanism
+const (
+	// Negotiated with the server
+	scramMechanismAuto   = ""
+	scramMechanismSHA1   = "SCRAM-SHA-1"
+	scramMechanismSHA256 = "SCRAM-SHA-256"
+)
+
+// Connection modes. Corresponds to src/types.ts ConnectionMode
+const (
+	// Connection string built from the host, database and options fields
+	connectionModeFields = ""
+	// Full connection string stored in the secure settings
+	connectionModeUri = "uri"
 )
 
 const (
@@ -13,8 +32,57 @@ const (
 	tlsDisabled = "disabled"
 )
 
+// Query languages. Corresponds to src/types.ts QueryLanguage
+const (
+	queryLanguageJSON       = "json"
+	queryLanguageJavaScript = "javascript"
+	// mongosh call chains like db.orders.find({...}).limit(10)
+	queryLanguageMongosh = "mongosh"
+	// SELECT statements translated to pipelines
+	queryLanguageSQL = "sql"
+	// Structured queries from the visual builder, compiled to pipelines
+	queryLanguageBuilder = "builder"
+)
+
+// Variable query modes. Corresponds to src/types.ts VariableQueryMode
+const (
+	variableModePipeline = ""
+	variableModeDistinct = "distinct"
+)
+
+// Variable value sort orders. Corresponds to src/types.ts VariableSort
+const (
+	variableSortNone = ""
+	variableSortAsc  = "asc"
+	variableSortDesc = "desc"
+)
+
 const (
 	variableTypeString  = ""
 	variableTypeInteger = "integer"
 	variableTypeDecimal = "decimal"
 )
+
+// Collection types reported by listCollections
+const (
+	collectionTypeCollection = "collection"
+	collectionTypeView       = "view"
+	collectionTypeTimeSeries = "timeseries"
+)
+
+// Live streaming modes
+const (
+	streamModeNone = ""
+	streamModeTail = "tail"
+	streamModePoll = "poll"
+)
+
+// Builder aggregations. Corresponds to src/types.ts BuilderAggregationType
+const (
+	builderAggCount      = "count"
+	builderAggSum        = "sum"
+	builderAggAvg        = "avg"
+	builderAggMin        = "min"
+	builderAggMax        = "max"
+	builderAggPercentile = "percentile"
+)
@@ -3,7 +3,6 @@ package plugin
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -11,6 +10,7 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/haohanyang/mongodb-datasource/pkg/models"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -26,6 +26,7 @@ import (
 var (
 	_ backend.QueryDataHandler      = (*Datasource)(nil)
 	_ backend.CheckHealthHandler    = (*Datasource)(nil)
+	_ backend.StreamHandler         = (*Datasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*Datasource)(nil)
 )
 
@@ -44,27 +45,56 @@ func NewDatasource(ctx context.Context, source backend.DataSourceInstanceSetting
 		return nil, err
 	}
 
+	proxyDial, err := secureSocksDialer(ctx, source)
+	if err != nil {
+		backend.Logger.Error("Failed to configure secure socks proxy", "error", err)
+		return nil, err
+	}
+
+	tunnel, err := setDialer(config, opts, proxyDial)
+	if err != nil {
+		backend.Logger.Error("Failed to configure ssh tunnel", "error", err)
+		return nil, err
+	}
+
 	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
 		backend.Logger.Error(fmt.Sprintf("Failed to connect to db: %s", err.Error()))
+		closeTunnel(tunnel)
 		return nil, err
 	}
 
 	err = client.Ping(ctx, nil)
 	if err != nil {
-		backend.Logger.Error("Failed to connect to db", "error", "can't ping the server")
-		return nil, errors.New("can't ping the MongoDB server")
+		backend.Logger.Error("Failed to connect to db", "error", connectionErrorMessage(err))
+		client.Disconnect(ctx)
+		closeTunnel(tunnel)
+		return nil, fmt.Errorf("can't ping the MongoDB server: %s", connectionErrorMessage(err))
 	}
 
 	datasource := &Datasource{
+		uid:      source.UID,
 		client:   client,
+		tunnel:   tunnel,
 		database: config.Database,
+		schemas:  newTTLCache[*collectionSchema](schemaCacheTTL),
+	}
+
+	if config.QueryCacheEnabled {
+		datasource.cache = newQueryCache(config)
 	}
 
 	// Setup resource handlers
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /collections", datasource.listCollections)
+	mux.HandleFunc("GET /collections/{name}/schema", datasource.collectionSchemaHandler)
+	mux.HandleFunc("GET /collections/{name}/indexes", datasource.listIndexes)
 	mux.HandleFunc("POST /variable-query", datasource.queryVariableHandler)
+	mux.HandleFunc("POST /validate", datasource.validateHandler)
+	mux.HandleFunc("POST /preview", datasource.previewHandler)
+	mux.HandleFunc("POST /builder/compile", datasource.compileBuilderHandler)
+	mux.HandleFunc("GET /tag-keys", datasource.tagKeysHandler)
+	mux.HandleFunc("GET /tag-values", datasource.tagValuesHandler)
 
 	datasource.resourceHandler = httpadapter.New(mux)
 
@@ -76,6 +106,18 @@ func NewDatasource(ctx context.Context, source backend.DataSourceInstanceSetting
 // be disposed and a new one will be created using NewSampleDatasource factory function.
 func (d *Datasource) Dispose() {
 	d.client.Disconnect(context.TODO())
+	closeTunnel(d.tunnel)
+}
+
+// closeTunnel closes the SSH tunnel if there is one
+func closeTunnel(tunnel *sshTunnel) {
+	if tunnel == nil {
+		return
+	}
+
+	if err := tunnel.Close(); err != nil {
+		backend.Logger.Error("Failed to close ssh tunnel", "error", err)
+	}
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -105,23 +147,27 @@ func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResource
 }
 
 func (d *Datasource) listCollections(rw http.ResponseWriter, req *http.Request) {
-	collections, err := d.client.Database(d.database).ListCollectionNames(req.Context(), bson.D{})
-
+	specs, err := d.client.Database(d.database).ListCollectionSpecifications(req.Context(), bson.D{})
 	if err != nil {
 		backend.Logger.Error("Failed to list collections", "error", err)
-		rw.Write([]byte(`[]`))
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	bytes, err := json.Marshal(collections)
-	if err != nil {
-		backend.Logger.Error("Failed to marshal collections", "error", err)
-		rw.Write([]byte(`[]`))
-		return
+	collections := make([]collectionInfo, 0, len(specs))
+	for _, spec := range specs {
+		info, err := newCollectionInfo(spec)
+		if err != nil {
+			backend.Logger.Error("Failed to parse collection options", "collection", spec.Name, "error", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		collections = append(collections, info)
 	}
 
-	rw.Write(bytes)
+	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(collections)
 }
 
 // Query Variable support
@@ -136,14 +182,27 @@ func (d *Datasource) queryVariableHandler(rw http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	var pipeline []bson.D
+	if variableQuery.Limit == 0 {
+		variableQuery.Limit = variableDefaultLimit
+	}
 
-	err = bson.UnmarshalExtJSON([]byte(variableQuery.Query), false, &pipeline)
+	if variableQuery.Limit < 0 || variableQuery.Limit > variableMaxLimit {
+		http.Error(rw, fmt.Sprintf("limit should be between 1 and %d", variableMaxLimit), http.StatusBadRequest)
+		return
+	}
+
+	pipeline, err := variablePipeline(&variableQuery)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	// Requests without a time range keep the time macros
+	if variableQuery.To != 0 {
+		pipeline = applyMacros(pipeline, time.UnixMilli(variableQuery.From), time.UnixMilli(variableQuery.To))
+	}
+	pipeline = applyIntervalMacro(pipeline, time.Duration(variableQuery.IntervalMs)*time.Millisecond)
+
 	db := d.client.Database(d.database)
 	cursor, err := db.Collection(variableQuery.Collection).Aggregate(ctx, pipeline)
 
@@ -152,7 +211,15 @@ func (d *Datasource) queryVariableHandler(rw http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	result, err := queryVariable(ctx, cursor)
+	defer cursor.Close(ctx)
+
+	format := variableQuery.variableFormat
+	if variableQuery.Mode == variableModeDistinct {
+		// The distinct pipeline outputs the values in the default value field
+		format.ValueField, format.TextField = "", ""
+	}
+
+	values, truncated, err := queryVariable(ctx, cursor, format, variableQuery.Limit)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
@@ -160,32 +227,205 @@ func (d *Datasource) queryVariableHandler(rw http.ResponseWriter, req *http.Requ
 
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	json.NewEncoder(rw).Encode(result)
+	json.NewEncoder(rw).Encode(variableQueryResult{Values: values, Truncated: truncated})
 }
 
 func (d *Datasource) query(ctx context.Context, query backend.DataQuery) backend.DataResponse {
 	backend.Logger.Debug("Executing query", "refId", query.RefID, "json", query.JSON)
 
-	var response backend.DataResponse
 	var qm queryModel
-	db := d.client.Database(d.database)
 
 	err := json.Unmarshal(query.JSON, &qm)
 	if err != nil {
 		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to unmarshal json: %v", err.Error()))
 	}
 
+	switch qm.QueryLanguage {
+	case queryLanguageMongosh:
+		return d.shellQuery(ctx, query, &qm)
+	case queryLanguageSQL:
+		return d.sqlQuery(ctx, query, &qm)
+	}
+
 	if qm.Collection == "" {
 		return backend.ErrDataResponse(backend.StatusBadRequest, "Collection field is required")
 	}
 
-	var pipeline []bson.D
+	if qm.QueryLanguage == queryLanguageBuilder {
+		return d.builderQuery(ctx, query, &qm)
+	}
+
+	if qm.StreamMode != streamModeNone {
+		return d.streamQuery(query, &qm)
+	}
+
+	pipeline, err := parseQueryText(qm.QueryText, qm.QueryLanguage, d.serverVersion(ctx))
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Invalid query: %v", err.Error()))
+	}
+
+	pipeline, err = applyAdhocFilters(pipeline, qm.AdhocFilters)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to apply ad-hoc filters: %v", err.Error()))
+	}
+
+	return d.execute(ctx, query, &qm, pipeline, d.aggregate)
+}
+
+// shellQuery runs a mongosh query. The collection and the options come from the query text
+func (d *Datasource) shellQuery(ctx context.Context, query backend.DataQuery, qm *queryModel) backend.DataResponse {
+	if qm.StreamMode != streamModeNone {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "Streaming is not supported for mongosh queries")
+	}
+
+	sq, err := parseShellQuery(qm.QueryText)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Invalid query: %v", err.Error()))
+	}
+
+	qm.Collection = sq.Collection
+
+	calls, err := applyShellAdhocFilters(sq.Calls, qm.AdhocFilters)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to apply ad-hoc filters: %v", err.Error()))
+	}
+
+	exec := func(ctx context.Context, qm *queryModel, calls []bson.D, refId string) (*data.Frame, error) {
+		return d.runShell(ctx, qm.Collection, calls, refId)
+	}
+
+	// The calls take the place of the pipeline in the cache and query keys
+	return d.execute(ctx, query, qm, calls, exec)
+}
+
+// sqlQuery translates a SELECT statement to a pipeline on the collection of its FROM clause
+func (d *Datasource) sqlQuery(ctx context.Context, query backend.DataQuery, qm *queryModel) backend.DataResponse {
+	if qm.StreamMode != streamModeNone {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "Streaming is not supported for SQL queries")
+	}
+
+	collection, pipeline, err := translateSQL(qm.QueryText)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Invalid query: %v", err.Error()))
+	}
+
+	qm.Collection = collection
+
+	pipeline, err = applyAdhocFilters(pipeline, qm.AdhocFilters)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to apply ad-hoc filters: %v", err.Error()))
+	}
+
+	response := d.execute(ctx, query, qm, pipeline, d.aggregate)
+	setExecutedPipeline(&response, query, pipeline)
+
+	return response
+}
+
+// builderQuery compiles a query built in the visual editor to a pipeline
+func (d *Datasource) builderQuery(ctx context.Context, query backend.DataQuery, qm *queryModel) backend.DataResponse {
+	if qm.StreamMode != streamModeNone {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "Streaming is not supported for builder queries")
+	}
+
+	if qm.Builder == nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "Builder field is required")
+	}
+
+	pipeline, err := compileBuilder(qm.Builder, query.Interval, d.serverVersion(ctx))
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Invalid query: %v", err.Error()))
+	}
+
+	pipeline, err = applyAdhocFilters(pipeline, qm.AdhocFilters)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to apply ad-hoc filters: %v", err.Error()))
+	}
+
+	response := d.execute(ctx, query, qm, pipeline, d.aggregate)
+	setExecutedPipeline(&response, query, pipeline)
+
+	return response
+}
+
+// setExecutedPipeline shows a generated pipeline in the query inspector
+func setExecutedPipeline(response *backend.DataResponse, query backend.DataQuery, pipeline []bson.D) {
+	executed, err := formatPipeline(applyMacros(pipeline, query.TimeRange.From, query.TimeRange.To))
+	if err != nil {
+		backend.Logger.Warn("Failed to format pipeline", "error", err)
+		return
+	}
+
+	for _, frame := range response.Frames {
+		if frame.Meta == nil {
+			frame.SetMeta(&data.FrameMeta{})
+		}
+		frame.Meta.ExecutedQueryString = executed
+	}
+}
+
+// execute applies macros and runs the query, sharing results through the cache and with
+// identical queries in flight
+func (d *Datasource) execute(ctx context.Context, query backend.DataQuery, qm *queryModel, pipeline []bson.D,
+	exec func(ctx context.Context, qm *queryModel, pipeline []bson.D, refId string) (*data.Frame, error)) backend.DataResponse {
+	var response backend.DataResponse
+	var err error
+
+	// Unlike the time range, the interval is part of the cache key
+	pipeline = applyIntervalMacro(pipeline, query.Interval)
+
+	var cacheKey string
+	if d.cache != nil && !qm.CacheBypass {
+		cacheKey, err = d.cache.key(d.database, qm, pipeline, query.TimeRange)
+		if err != nil {
+			backend.Logger.Warn("Failed to build cache key", "error", err)
+		} else if frame, cachedAt, ok := d.cache.get(cacheKey); ok {
+			backend.Logger.Debug("Query result served from cache", "refId", query.RefID)
+
+			frame.Name = query.RefID
+			markCached(frame, cachedAt, d.cache.now().Sub(cachedAt))
+			response.Frames = append(response.Frames, frame)
+			return response
+		}
+	}
+
+	// The cache key keeps the macros, so the aligned time range decides what is shared
+	pipeline = applyMacros(pipeline, query.TimeRange.From, query.TimeRange.To)
+
+	run := func(ctx context.Context) (*data.Frame, error) {
+		return exec(ctx, qm, pipeline, query.RefID)
+	}
+
+	var frame *data.Frame
 
-	err = bson.UnmarshalExtJSON([]byte(qm.QueryText), false, &pipeline)
+	// Identical queries running at the same moment share one execution
+	flightKey, err := queryKey(d.database, qm, pipeline, query.TimeRange.From, query.TimeRange.To)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to unmarshal JsonExt: %v", err.Error()))
+		backend.Logger.Warn("Failed to build query key", "error", err)
+		frame, err = run(ctx)
+	} else {
+		frame, err = d.inflight.do(ctx, flightKey, run)
 	}
 
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to query: %v", err.Error()))
+	}
+
+	frame.Name = query.RefID
+
+	if cacheKey != "" {
+		if err := d.cache.set(cacheKey, frame); err != nil {
+			backend.Logger.Debug("Query result not cached", "error", err)
+		}
+	}
+
+	response.Frames = append(response.Frames, frame)
+
+	return response
+}
+
+// aggregate runs the pipeline and converts the result to a data frame
+func (d *Datasource) aggregate(ctx context.Context, qm *queryModel, pipeline []bson.D, refId string) (*data.Frame, error) {
 	// Set aggregate options
 	aggregateOpts := options.AggregateOptions{}
 
@@ -225,24 +465,21 @@ func (d *Datasource) query(ctx context.Context, query backend.DataQuery) backend
 		backend.Logger.Debug("Aggregate option was set", "bypassDocumentValidation", qm.AggregateBypassDocumentValidation)
 	}
 
-	cursor, err := db.Collection(qm.Collection).Aggregate(ctx, pipeline, &aggregateOpts)
+	cursor, err := d.client.Database(d.database).Collection(qm.Collection).Aggregate(ctx, pipeline, &aggregateOpts)
 	if err != nil {
 		backend.Logger.Error("Failed to execute aggregate", "error", err)
-
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to query: %v", err.Error()))
+		return nil, err
 	}
 
 	defer cursor.Close(ctx)
 
-	frame, err := createTableFramesFromQuery(ctx, query.RefID, cursor)
+	frame, err := createTableFramesFromQuery(ctx, refId, cursor)
 	if err != nil {
 		backend.Logger.Error("Failed to create data frame from query", "error", err)
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to query: %v", err.Error()))
+		return nil, err
 	}
 
-	response.Frames = append(response.Frames, frame)
-
-	return response
+	return frame, nil
 }
 
 // CheckHealth handles health checks sent from Grafana to the plugin.
@@ -273,6 +510,24 @@ func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRe
 
 	opts.SetTimeout(5 * time.Second)
 
+	proxyDial, err := secureSocksDialer(ctx, *req.PluginContext.DataSourceInstanceSettings)
+	if err != nil {
+		backend.Logger.Error("Failed to configure secure socks proxy", "error", err)
+		res.Status = backend.HealthStatusError
+		res.Message = err.Error()
+		return res, nil
+	}
+
+	tunnel, err := setDialer(config, opts, proxyDial)
+	if err != nil {
+		backend.Logger.Error("Failed to configure ssh tunnel", "error", err)
+		res.Status = backend.HealthStatusError
+		res.Message = err.Error()
+		return res, nil
+	}
+
+	defer closeTunnel(tunnel)
+
 	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
 		res.Status = backend.HealthStatusError
@@ -291,9 +546,9 @@ func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRe
 	err = client.Ping(ctx, nil)
 	if err != nil {
 		res.Status = backend.HealthStatusError
-		res.Message = "Failed to ping the MongoDB server"
+		res.Message = "Failed to ping the MongoDB server: " + connectionErrorMessage(err)
 
-		backend.Logger.Error("Failed to connect to db", "error", "can't ping the server")
+		backend.Logger.Error("Failed to connect to db", "error", connectionErrorMessage(err))
 		return res, nil
 	}
 
@@ -0,0 +1,151 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// indexInfo is the response entry of the index listing endpoint
+type indexInfo struct {
+	Name string `json:"name"`
+	// Index keys in order, e.g. {"a": 1, "b": -1}
+	Keys               json.RawMessage `json:"keys"`
+	Unique             bool            `json:"unique"`
+	Sparse             bool            `json:"sparse"`
+	PartialFilter      json.RawMessage `json:"partialFilter,omitempty"`
+	ExpireAfterSeconds *int64          `json:"expireAfterSeconds,omitempty"`
+	Usage              *indexUsage     `json:"usage,omitempty"`
+}
+
+// indexUsage is reported by $indexStats, summed over all hosts
+type indexUsage struct {
+	Ops   int64     `json:"ops"`
+	Since time.Time `json:"since"`
+}
+
+func newIndexInfo(spec bson.Raw) (indexInfo, error) {
+	info := indexInfo{}
+
+	if v, ok := spec.Lookup("name").StringValueOK(); ok {
+		info.Name = v
+	}
+
+	keys, err := rawValueToJson(spec.Lookup("key"))
+	if err != nil {
+		return info, err
+	}
+	info.Keys = keys
+
+	if v, ok := spec.Lookup("unique").BooleanOK(); ok {
+		info.Unique = v
+	}
+
+	if v, ok := spec.Lookup("sparse").BooleanOK(); ok {
+		info.Sparse = v
+	}
+
+	if rv := spec.Lookup("partialFilterExpression"); rv.Type == bson.TypeEmbeddedDocument {
+		filter, err := rawValueToJson(rv)
+		if err != nil {
+			return info, err
+		}
+		info.PartialFilter = filter
+	}
+
+	if v, ok := spec.Lookup("expireAfterSeconds").AsInt64OK(); ok {
+		info.ExpireAfterSeconds = &v
+	}
+
+	return info, nil
+}
+
+// indexUsages aggregates the $indexStats output by index name
+func indexUsages(ctx context.Context, cursor *mongo.Cursor) (map[string]*indexUsage, error) {
+	usages := make(map[string]*indexUsage)
+
+	for cursor.Next(ctx) {
+		var stat struct {
+			Name     string `bson:"name"`
+			Accesses struct {
+				Ops   int64     `bson:"ops"`
+				Since time.Time `bson:"since"`
+			} `bson:"accesses"`
+		}
+
+		if err := cursor.Decode(&stat); err != nil {
+			return nil, err
+		}
+
+		usage, ok := usages[stat.Name]
+		if !ok {
+			usages[stat.Name] = &indexUsage{Ops: stat.Accesses.Ops, Since: stat.Accesses.Since}
+			continue
+		}
+
+		usage.Ops += stat.Accesses.Ops
+		if stat.Accesses.Since.Before(usage.Since) {
+			usage.Since = stat.Accesses.Since
+		}
+	}
+
+	return usages, cursor.Err()
+}
+
+func (d *Datasource) listIndexes(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	name := req.PathValue("name")
+	coll := d.client.Database(d.database).Collection(name)
+
+	cursor, err := coll.Indexes().List(ctx)
+	if err != nil {
+		backend.Logger.Error("Failed to list indexes", "collection", name, "error", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer cursor.Close(ctx)
+
+	indexes := make([]indexInfo, 0)
+	for cursor.Next(ctx) {
+		info, err := newIndexInfo(cursor.Current)
+		if err != nil {
+			backend.Logger.Error("Failed to parse index", "collection", name, "error", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		indexes = append(indexes, info)
+	}
+
+	if err := cursor.Err(); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// $indexStats requires the indexStats privilege, so usage is only added when permitted
+	statsCursor, err := coll.Aggregate(ctx, bson.A{bson.D{{Key: "$indexStats", Value: bson.D{}}}})
+	if err == nil {
+		defer statsCursor.Close(ctx)
+
+		var usages map[string]*indexUsage
+		usages, err = indexUsages(ctx, statsCursor)
+		if err == nil {
+			for i := range indexes {
+				indexes[i].Usage = usages[indexes[i].Name]
+			}
+		}
+	}
+
+	if err != nil {
+		backend.Logger.Debug("Index usage is not available", "collection", name, "error", err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(indexes)
+}
@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewIndexInfo(t *testing.T) {
+	t.Run("should parse index options", func(t *testing.T) {
+		spec, err := bson.Marshal(bson.D{
+			{Key: "v", Value: 2},
+			{Key: "key", Value: bson.D{{Key: "b", Value: int32(1)}, {Key: "a", Value: int32(-1)}}},
+			{Key: "name", Value: "b_1_a_-1"},
+			{Key: "unique", Value: true},
+			{Key: "partialFilterExpression", Value: bson.D{{Key: "a", Value: bson.D{{Key: "$gt", Value: int32(5)}}}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := newIndexInfo(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Name != "b_1_a_-1" || !info.Unique || info.Sparse {
+			t.Errorf("unexpected index info %+v", info)
+		}
+		if string(info.Keys) != `{"b":1,"a":-1}` {
+			t.Errorf("unexpected keys %s", info.Keys)
+		}
+		if string(info.PartialFilter) != `{"a":{"$gt":5}}` {
+			t.Errorf("unexpected partial filter %s", info.PartialFilter)
+		}
+		if info.ExpireAfterSeconds != nil {
+			t.Error("expected no ttl")
+		}
+	})
+
+	t.Run("should parse ttl index", func(t *testing.T) {
+		spec, err := bson.Marshal(bson.D{
+			{Key: "key", Value: bson.D{{Key: "createdAt", Value: int32(1)}}},
+			{Key: "name", Value: "createdAt_1"},
+			{Key: "sparse", Value: true},
+			{Key: "expireAfterSeconds", Value: int32(3600)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := newIndexInfo(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !info.Sparse || info.ExpireAfterSeconds == nil || *info.ExpireAfterSeconds != 3600 {
+			t.Errorf("unexpected index info %+v", info)
+		}
+	})
+}
+
+func TestIndexUsages(t *testing.T) {
+	early := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+
+	cursor := initCursorWithData([]interface{}{
+		bson.M{"name": "_id_", "accesses": bson.M{"ops": int64(3), "since": primitive.NewDateTimeFromTime(late)}},
+		bson.M{"name": "_id_", "accesses": bson.M{"ops": int64(4), "since": primitive.NewDateTimeFromTime(early)}},
+		bson.M{"name": "a_1", "accesses": bson.M{"ops": int64(0), "since": primitive.NewDateTimeFromTime(late)}},
+	}, t)
+
+	usages, err := indexUsages(context.Background(), cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usages["_id_"].Ops != 7 || !usages["_id_"].Since.Equal(early) {
+		t.Errorf("unexpected _id_ usage %+v", usages["_id_"])
+	}
+	if usages["a_1"].Ops != 0 {
+		t.Errorf("unexpected a_1 usage %+v", usages["a_1"])
+	}
+}
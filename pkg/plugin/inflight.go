@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// inflightGroup collapses concurrent executions of identical queries into one.
+// The shared execution is detached from the callers' contexts and is only
+// cancelled once every caller waiting for it has given up.
+type inflightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+type inflightCall struct {
+	done    chan struct{}
+	frame   []byte
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do runs fn once for all concurrent callers with the same key and returns each caller its own copy of the frame
+func (g *inflightGroup) do(ctx context.Context, key string, fn func(context.Context) (*data.Frame, error)) (*data.Frame, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*inflightCall)
+	}
+
+	c, ok := g.calls[key]
+	if !ok {
+		workCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &inflightCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		g.calls[key] = c
+
+		go g.run(workCtx, key, c, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		if c.err != nil {
+			return nil, c.err
+		}
+		return data.UnmarshalArrowFrame(c.frame)
+
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			// Later callers start a fresh execution instead of joining a cancelled one
+			g.forget(key, c)
+		}
+		g.mu.Unlock()
+
+		return nil, ctx.Err()
+	}
+}
+
+func (g *inflightGroup) run(ctx context.Context, key string, c *inflightCall, fn func(context.Context) (*data.Frame, error)) {
+	defer c.cancel()
+
+	frame, err := fn(ctx)
+	if err == nil {
+		c.frame, err = frame.MarshalArrow()
+	}
+	c.err = err
+
+	g.mu.Lock()
+	g.forget(key, c)
+	g.mu.Unlock()
+
+	close(c.done)
+}
+
+// forget must be called with g.mu held
+func (g *inflightGroup) forget(key string, c *inflightCall) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
@@ -0,0 +1,158 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestInflightGroup(t *testing.T) {
+	t.Run("should share one execution between concurrent callers", func(t *testing.T) {
+		var g inflightGroup
+		var calls atomic.Int32
+		release := make(chan struct{})
+		expected := data.NewFrame("A", data.NewField("a", nil, []*int32{pointer[int32](1)}))
+
+		fn := func(ctx context.Context) (*data.Frame, error) {
+			calls.Add(1)
+			<-release
+			return expected, nil
+		}
+
+		var wg sync.WaitGroup
+		frames := make([]*data.Frame, 5)
+		for i := range frames {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				frame, err := g.do(context.Background(), "k", fn)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				frames[i] = frame
+			}(i)
+		}
+
+		// Wait for all callers to join before releasing the execution
+		for {
+			g.mu.Lock()
+			c := g.calls["k"]
+			joined := c != nil && c.waiters == len(frames)
+			g.mu.Unlock()
+			if joined {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		wg.Wait()
+
+		if calls.Load() != 1 {
+			t.Errorf("expected 1 execution, got %d", calls.Load())
+		}
+
+		for _, frame := range frames {
+			if !cmp.Equal(frame, expected, dataFrameComparer) {
+				t.Error("unexpected frame")
+			}
+		}
+
+		if frames[0] == frames[1] {
+			t.Error("expected each caller to get its own frame")
+		}
+	})
+
+	t.Run("should keep running when one of the callers gives up", func(t *testing.T) {
+		var g inflightGroup
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		fn := func(ctx context.Context) (*data.Frame, error) {
+			close(started)
+			select {
+			case <-release:
+				return data.NewFrame("A"), nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func() {
+			_, err := g.do(ctx, "k", fn)
+			errc <- err
+		}()
+		<-started
+
+		resc := make(chan error, 1)
+		go func() {
+			_, err := g.do(context.Background(), "k", fn)
+			resc <- err
+		}()
+
+		for {
+			g.mu.Lock()
+			joined := g.calls["k"].waiters == 2
+			g.mu.Unlock()
+			if joined {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+		if err := <-errc; !errors.Is(err, context.Canceled) {
+			t.Errorf("expected cancelled caller to get context.Canceled, got %v", err)
+		}
+
+		close(release)
+		if err := <-resc; err != nil {
+			t.Errorf("expected remaining caller to get the result, got %v", err)
+		}
+	})
+
+	t.Run("should cancel the execution when all callers give up", func(t *testing.T) {
+		var g inflightGroup
+		cancelled := make(chan struct{})
+
+		fn := func(ctx context.Context) (*data.Frame, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func() {
+			_, err := g.do(ctx, "k", fn)
+			errc <- err
+		}()
+
+		for {
+			g.mu.Lock()
+			joined := g.calls["k"] != nil
+			g.mu.Unlock()
+			if joined {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+		<-errc
+
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected shared execution to be cancelled")
+		}
+	})
+}
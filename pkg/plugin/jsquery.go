@@ -0,0 +1,1037 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Date formats accepted by ISODate() and new Date(), without zone they are UTC like in mongosh
+var jsDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// jsParser converts the JavaScript subset of mongosh literals to Extended JSON.
+// White space and line breaks are kept, so lines match, but literals like ObjectId()
+// are rewritten and shift the columns. The offset map locates values in the input
+type jsParser struct {
+	text    string
+	pos     int
+	out     bytes.Buffer
+	offsets jsOffsetMap
+	// Time used by new Date() without arguments
+	now time.Time
+}
+
+// jsOffsetMap maps offsets of the output to the input, it holds the start of every value
+type jsOffsetMap []struct{ out, in int }
+
+// input returns the input offset of an output offset. It's exact at the start of a value and
+// approximate inside a rewritten value
+func (m jsOffsetMap) input(offset int) int {
+	i := sort.Search(len(m), func(i int) bool { return m[i].out > offset }) - 1
+	if i < 0 {
+		return offset
+	}
+	return m[i].in + offset - m[i].out
+}
+
+// jsToExtJSON converts a JavaScript query to Extended JSON
+func jsToExtJSON(text string) (string, error) {
+	p := &jsParser{text: text, now: time.Now()}
+	return p.parse()
+}
+
+// parseJSPipelineStages parses the stages of a JavaScript query, located in the query text
+func parseJSPipelineStages(text string) ([]pipelineStage, error) {
+	p := &jsParser{text: text, now: time.Now()}
+	converted, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	stages, err := parsePipelineStages(converted)
+	if err != nil {
+		var perr *pipelineError
+		if errors.As(err, &perr) {
+			return nil, newPipelineError(text, p.offsets.input(perr.offset), perr.Message)
+		}
+		return nil, err
+	}
+
+	for i := range stages {
+		stages[i].Offset = p.offsets.input(stages[i].Offset)
+	}
+
+	return stages, nil
+}
+
+// parseQueryText parses the query text of the given query language into a pipeline
+func parseQueryText(text string, language string, version []int) ([]bson.D, error) {
+	switch language {
+	case queryLanguageMongosh, queryLanguageSQL, queryLanguageBuilder:
+		return nil, fmt.Errorf("%s queries are not supported here", language)
+	case queryLanguageJavaScript:
+		stages, err := parseJSPipelineStages(text)
+		if err != nil {
+			return nil, err
+		}
+		return stagesPipeline(text, stages, version)
+	}
+
+	return parsePipeline(text, version)
+}
+
+func (p *jsParser) parse() (string, error) {
+	if err := p.space(); err != nil {
+		return "", err
+	}
+
+	if err := p.value(); err != nil {
+		return "", err
+	}
+
+	if err := p.space(); err != nil {
+		return "", err
+	}
+
+	// Statements copied from the shell often end with semicolons
+	for p.pos < len(p.text) && p.text[p.pos] == ';' {
+		p.pos++
+		if err := p.space(); err != nil {
+			return "", err
+		}
+	}
+
+	if p.pos < len(p.text) {
+		return "", p.errorf("unexpected %q", p.peekRune())
+	}
+
+	return p.out.String(), nil
+}
+
+func (p *jsParser) errorf(format string, args ...any) error {
+	return newPipelineError(p.text, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *jsParser) peek() byte {
+	if p.pos < len(p.text) {
+		return p.text[p.pos]
+	}
+	return 0
+}
+
+func (p *jsParser) peekRune() rune {
+	r, _ := utf8.DecodeRuneInString(p.text[p.pos:])
+	return r
+}
+
+// space copies white space to the output and replaces comments with spaces
+func (p *jsParser) space() error {
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			p.out.WriteByte(c)
+			p.pos++
+
+		case strings.HasPrefix(p.text[p.pos:], "//"):
+			end := strings.IndexByte(p.text[p.pos:], '\n')
+			if end < 0 {
+				end = len(p.text) - p.pos
+			}
+			p.out.WriteString(strings.Repeat(" ", end))
+			p.pos += end
+
+		case strings.HasPrefix(p.text[p.pos:], "/*"):
+			end := strings.Index(p.text[p.pos+2:], "*/")
+			if end < 0 {
+				return p.errorf("unterminated comment")
+			}
+			comment := p.text[p.pos : p.pos+end+4]
+			p.out.WriteString(strings.Map(func(r rune) rune {
+				if r == '\n' {
+					return r
+				}
+				return ' '
+			}, comment))
+			p.pos += len(comment)
+
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (p *jsParser) expect(c byte) error {
+	if p.peek() != c {
+		if p.pos >= len(p.text) {
+			return p.errorf("expected %q, got end of query", c)
+		}
+		return p.errorf("expected %q, got %q", c, p.peekRune())
+	}
+	p.pos++
+	return nil
+}
+
+func (p *jsParser) value() error {
+	if p.pos >= len(p.text) {
+		return p.errorf("unexpected end of query")
+	}
+
+	p.offsets = append(p.offsets, struct{ out, in int }{p.out.Len(), p.pos})
+
+	c := p.peek()
+	switch {
+	case c == '{':
+		return p.object()
+	case c == '[':
+		return p.array()
+	case c == '"' || c == '\'':
+		s, err := p.concatenation()
+		if err != nil {
+			return err
+		}
+		return p.writeJSON(s)
+	case c == '/':
+		return p.regex()
+	case c == '-' || c == '+' || c == '.' || c == '(' || (c >= '0' && c <= '9'):
+		return p.numberOrExpression()
+	case p.numericCall():
+		return p.expression()
+	case isIdentStart(rune(c)):
+		return p.identifier()
+	default:
+		return p.errorf("unexpected %q", p.peekRune())
+	}
+}
+
+// lookahead returns the next character after white space and comments, without consuming them
+func (p *jsParser) lookahead() byte {
+	pos := p.pos
+	for pos < len(p.text) {
+		switch rest := p.text[pos:]; {
+		case strings.IndexByte(" \t\r\n", rest[0]) >= 0:
+			pos++
+		case strings.HasPrefix(rest, "//"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				return 0
+			}
+			pos += end
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return 0
+			}
+			pos += end + 4
+		default:
+			return rest[0]
+		}
+	}
+	return 0
+}
+
+// numberOrExpression writes a number literal as it is, so that integers keep their type, or
+// the value of an arithmetic expression
+func (p *jsParser) numberOrExpression() error {
+	if p.peek() != '(' {
+		start, outLen := p.pos, p.out.Len()
+		if err := p.number(); err != nil {
+			return err
+		}
+		if strings.IndexByte("+-*/%", p.lookahead()) < 0 {
+			return nil
+		}
+		p.pos = start
+		p.out.Truncate(outLen)
+	}
+
+	return p.expression()
+}
+
+// expression writes the value of an arithmetic expression, integers are written without a
+// fraction so that they decode to integers like the number literals
+func (p *jsParser) expression() error {
+	v, err := p.numericExpression()
+	if err != nil {
+		return err
+	}
+
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return p.writeExtJSON(v)
+	}
+	if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+		p.out.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	} else {
+		p.out.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	return nil
+}
+
+// concatenation reads a string and the strings and numbers added to it, like 'host-' + 1
+func (p *jsParser) concatenation() (string, error) {
+	s, err := p.string()
+	if err != nil {
+		return "", err
+	}
+
+	for p.lookahead() == '+' {
+		if err := p.space(); err != nil {
+			return "", err
+		}
+		p.pos++
+		if err := p.space(); err != nil {
+			return "", err
+		}
+
+		if c := p.peek(); c == '"' || c == '\'' {
+			r, err := p.string()
+			if err != nil {
+				return "", err
+			}
+			s += r
+			continue
+		}
+
+		v, err := p.numericTerm()
+		if err != nil {
+			return "", err
+		}
+		s += strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	return s, nil
+}
+
+// Math functions accepted in arithmetic expressions
+var jsMathFuncs = map[string]func(args []float64) float64{
+	"abs":   func(args []float64) float64 { return math.Abs(args[0]) },
+	"ceil":  func(args []float64) float64 { return math.Ceil(args[0]) },
+	"floor": func(args []float64) float64 { return math.Floor(args[0]) },
+	"round": func(args []float64) float64 { return math.Floor(args[0] + 0.5) },
+	"trunc": func(args []float64) float64 { return math.Trunc(args[0]) },
+	"min": func(args []float64) float64 {
+		v := math.Inf(1)
+		for _, a := range args {
+			v = math.Min(v, a)
+		}
+		return v
+	},
+	"max": func(args []float64) float64 {
+		v := math.Inf(-1)
+		for _, a := range args {
+			v = math.Max(v, a)
+		}
+		return v
+	},
+}
+
+// numericCall reports whether a call of Date.now() or of a Math function starts at the position
+func (p *jsParser) numericCall() bool {
+	return strings.HasPrefix(p.text[p.pos:], "Date.now") || strings.HasPrefix(p.text[p.pos:], "Math.")
+}
+
+// numericExpression evaluates the arithmetic of numbers, Date.now() and Math functions, like
+// Date.now() - 24 * 3600 * 1000
+func (p *jsParser) numericExpression() (float64, error) {
+	v, err := p.numericTerm()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		if err := p.space(); err != nil {
+			return 0, err
+		}
+
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return v, nil
+		}
+		p.pos++
+
+		r, err := p.numericTerm()
+		if err != nil {
+			return 0, err
+		}
+
+		if op == '+' {
+			v += r
+		} else {
+			v -= r
+		}
+	}
+}
+
+func (p *jsParser) numericTerm() (float64, error) {
+	v, err := p.numericFactor()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		if err := p.space(); err != nil {
+			return 0, err
+		}
+
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return v, nil
+		}
+		p.pos++
+
+		r, err := p.numericFactor()
+		if err != nil {
+			return 0, err
+		}
+
+		switch op {
+		case '*':
+			v *= r
+		case '/':
+			v /= r
+		default:
+			v = math.Mod(v, r)
+		}
+	}
+}
+
+func (p *jsParser) numericFactor() (float64, error) {
+	if err := p.space(); err != nil {
+		return 0, err
+	}
+
+	start := p.pos
+	c := p.peek()
+	switch {
+	case c == '-' || c == '+':
+		p.pos++
+		v, err := p.numericFactor()
+		if c == '-' {
+			v = -v
+		}
+		return v, err
+
+	case c == '(':
+		p.pos++
+		v, err := p.numericExpression()
+		if err != nil {
+			return 0, err
+		}
+		return v, p.expect(')')
+
+	case c == '.' || (c >= '0' && c <= '9'):
+		for p.pos < len(p.text) && strings.IndexByte("0123456789.eE", p.text[p.pos]) >= 0 {
+			if c := p.text[p.pos]; (c == 'e' || c == 'E') && p.pos+1 < len(p.text) && (p.text[p.pos+1] == '-' || p.text[p.pos+1] == '+') {
+				p.pos++
+			}
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+		if err != nil {
+			p.pos = start
+			return 0, p.errorf("invalid number %s", p.text[start:p.pos])
+		}
+		return v, nil
+
+	case isIdentStart(rune(c)):
+		name := p.ident()
+		switch name {
+		case "Infinity":
+			return math.Inf(1), nil
+		case "NaN":
+			return math.NaN(), nil
+		case "Date", "Math":
+		default:
+			p.pos = start
+			return 0, p.errorf("unknown identifier %s in expression", name)
+		}
+
+		if err := p.expect('.'); err != nil {
+			return 0, err
+		}
+		method := p.ident()
+
+		var fn func(args []float64) float64
+		switch {
+		case name == "Date" && method == "now":
+			fn = func([]float64) float64 { return float64(p.now.UnixMilli()) }
+		case name == "Math" && jsMathFuncs[method] != nil:
+			fn = jsMathFuncs[method]
+		default:
+			p.pos = start
+			return 0, p.errorf("unsupported function %s.%s", name, method)
+		}
+
+		if err := p.space(); err != nil {
+			return 0, err
+		}
+		if err := p.expect('('); err != nil {
+			return 0, err
+		}
+
+		args, err := p.numericArguments()
+		if err != nil {
+			return 0, err
+		}
+
+		if (name == "Date" && len(args) > 0) || (name == "Math" && len(args) == 0) {
+			p.pos = start
+			return 0, p.errorf("wrong number of arguments for %s.%s", name, method)
+		}
+
+		return fn(args), nil
+
+	case p.pos >= len(p.text):
+		return 0, p.errorf("expected a number, got end of query")
+	default:
+		return 0, p.errorf("expected a number, got %q", p.peekRune())
+	}
+}
+
+// numericArguments reads the arguments of a function call in an arithmetic expression
+func (p *jsParser) numericArguments() ([]float64, error) {
+	args := make([]float64, 0)
+	for {
+		if err := p.space(); err != nil {
+			return nil, err
+		}
+
+		if p.peek() == ')' {
+			p.pos++
+			return args, nil
+		}
+
+		if len(args) > 0 {
+			if err := p.expect(','); err != nil {
+				return nil, err
+			}
+		}
+
+		v, err := p.numericExpression()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+}
+
+func (p *jsParser) object() error {
+	p.pos++
+	p.out.WriteByte('{')
+
+	first := true
+	for {
+		if err := p.space(); err != nil {
+			return err
+		}
+
+		if p.peek() == '}' {
+			p.pos++
+			p.out.WriteByte('}')
+			return nil
+		}
+
+		if !first {
+			if err := p.expect(','); err != nil {
+				return err
+			}
+
+			if err := p.space(); err != nil {
+				return err
+			}
+
+			// Trailing comma
+			if p.peek() == '}' {
+				p.pos++
+				p.out.WriteByte('}')
+				return nil
+			}
+
+			p.out.WriteByte(',')
+		}
+		first = false
+
+		key, err := p.key()
+		if err != nil {
+			return err
+		}
+		if err := p.writeJSON(key); err != nil {
+			return err
+		}
+
+		if err := p.space(); err != nil {
+			return err
+		}
+		if err := p.expect(':'); err != nil {
+			return err
+		}
+		p.out.WriteByte(':')
+
+		if err := p.space(); err != nil {
+			return err
+		}
+		if err := p.value(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *jsParser) key() (string, error) {
+	c := p.peek()
+	switch {
+	case c == '"' || c == '\'':
+		return p.string()
+	case isIdentStart(rune(c)):
+		return p.ident(), nil
+	case c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.text) && p.text[p.pos] >= '0' && p.text[p.pos] <= '9' {
+			p.pos++
+		}
+		return p.text[start:p.pos], nil
+	case p.pos >= len(p.text):
+		return "", p.errorf("expected a key, got end of query")
+	default:
+		return "", p.errorf("expected a key, got %q", p.peekRune())
+	}
+}
+
+func (p *jsParser) array() error {
+	p.pos++
+	p.out.WriteByte('[')
+
+	first := true
+	for {
+		if err := p.space(); err != nil {
+			return err
+		}
+
+		if p.peek() == ']' {
+			p.pos++
+			p.out.WriteByte(']')
+			return nil
+		}
+
+		if !first {
+			if err := p.expect(','); err != nil {
+				return err
+			}
+
+			if err := p.space(); err != nil {
+				return err
+			}
+
+			if p.peek() == ']' {
+				p.pos++
+				p.out.WriteByte(']')
+				return nil
+			}
+
+			p.out.WriteByte(',')
+		}
+		first = false
+
+		if err := p.value(); err != nil {
+			return err
+		}
+	}
+}
+
+// string reads a single or double quoted string
+func (p *jsParser) string() (string, error) {
+	start := p.pos
+	quote := p.text[p.pos]
+	p.pos++
+
+	var sb strings.Builder
+	for {
+		if p.pos >= len(p.text) {
+			p.pos = start
+			return "", p.errorf("unterminated string")
+		}
+
+		c := p.text[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return sb.String(), nil
+
+		case c == '\n':
+			p.pos = start
+			return "", p.errorf("unterminated string")
+
+		case c == '\\':
+			p.pos++
+			if p.pos >= len(p.text) {
+				p.pos = start
+				return "", p.errorf("unterminated string")
+			}
+
+			e := p.text[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case '0':
+				sb.WriteByte(0)
+			case 'u':
+				if p.pos+4 > len(p.text) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(p.text[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				sb.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				// \' \" \\ \/ and unknown escapes stand for the character itself
+				sb.WriteByte(e)
+			}
+
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// regex reads a regular expression literal, e.g. /^abc/i
+func (p *jsParser) regex() error {
+	start := p.pos
+	p.pos++
+
+	inClass := false
+	for {
+		if p.pos >= len(p.text) || p.text[p.pos] == '\n' {
+			p.pos = start
+			return p.errorf("unterminated regular expression")
+		}
+
+		c := p.text[p.pos]
+		if c == '\\' {
+			p.pos += 2
+			continue
+		}
+
+		if c == '[' {
+			inClass = true
+		} else if c == ']' {
+			inClass = false
+		} else if c == '/' && !inClass {
+			break
+		}
+		p.pos++
+	}
+
+	pattern := p.text[start+1 : p.pos]
+	p.pos++
+
+	flagsStart := p.pos
+	for p.pos < len(p.text) && strings.IndexByte("dgimsuy", p.text[p.pos]) >= 0 {
+		p.pos++
+	}
+	flags := p.text[flagsStart:p.pos]
+
+	// Flags with a meaning for the server, options must be sorted in Extended JSON
+	options := make([]byte, 0, len(flags))
+	for _, f := range []byte("imsux") {
+		if strings.IndexByte(flags, f) >= 0 {
+			options = append(options, f)
+		}
+	}
+
+	return p.writeExtJSON(primitive.Regex{Pattern: pattern, Options: string(options)})
+}
+
+func (p *jsParser) number() error {
+	start := p.pos
+
+	if c := p.peek(); c == '-' || c == '+' {
+		p.pos++
+	}
+
+	// Infinity and -Infinity
+	if strings.HasPrefix(p.text[p.pos:], "Infinity") {
+		p.pos += len("Infinity")
+		if p.text[start] == '-' {
+			return p.writeExtJSON(math.Inf(-1))
+		}
+		return p.writeExtJSON(math.Inf(1))
+	}
+
+	for p.pos < len(p.text) && strings.IndexByte("0123456789.eE", p.text[p.pos]) >= 0 {
+		if c := p.text[p.pos]; (c == 'e' || c == 'E') && p.pos+1 < len(p.text) && (p.text[p.pos+1] == '-' || p.text[p.pos+1] == '+') {
+			p.pos++
+		}
+		p.pos++
+	}
+
+	literal := strings.TrimPrefix(p.text[start:p.pos], "+")
+	if _, err := strconv.ParseFloat(literal, 64); err != nil {
+		p.pos = start
+		return p.errorf("invalid number %s", literal)
+	}
+
+	// JSON doesn't accept .5 or 5.
+	negative := strings.HasPrefix(literal, "-")
+	literal = strings.TrimPrefix(literal, "-")
+	if strings.HasPrefix(literal, ".") {
+		literal = "0" + literal
+	}
+	literal = strings.Replace(literal, ".e", ".0e", 1)
+	literal = strings.Replace(literal, ".E", ".0E", 1)
+	if strings.HasSuffix(literal, ".") {
+		literal += "0"
+	}
+	if negative {
+		literal = "-" + literal
+	}
+
+	p.out.WriteString(literal)
+	return nil
+}
+
+func isIdentStart(r rune) bool {
+	return r == '$' || r == '_' || unicode.IsLetter(r)
+}
+
+func (p *jsParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.text) {
+		r, size := utf8.DecodeRuneInString(p.text[p.pos:])
+		if !isIdentStart(r) && !unicode.IsDigit(r) {
+			break
+		}
+		p.pos += size
+	}
+	return p.text[start:p.pos]
+}
+
+// identifier handles literals and the constructors of BSON types
+func (p *jsParser) identifier() error {
+	start := p.pos
+	name := p.ident()
+
+	switch name {
+	case "true", "false", "null":
+		p.out.WriteString(name)
+		return nil
+	case "undefined":
+		p.out.WriteString("null")
+		return nil
+	case "Infinity":
+		return p.writeExtJSON(math.Inf(1))
+	case "NaN":
+		return p.writeExtJSON(math.NaN())
+	case "new":
+		if err := p.space(); err != nil {
+			return err
+		}
+		start = p.pos
+		name = p.ident()
+		if name != "Date" && name != "ObjectId" && name != "NumberLong" && name != "NumberInt" && name != "NumberDecimal" {
+			p.pos = start
+			return p.errorf("unsupported constructor %s", name)
+		}
+	}
+
+	if err := p.space(); err != nil {
+		return err
+	}
+
+	if p.peek() != '(' {
+		p.pos = start
+		return p.errorf("unknown identifier %s", name)
+	}
+
+	args, err := p.arguments(name)
+	if err != nil {
+		return err
+	}
+
+	value, err := jsConstructor(name, args, p.now)
+	if err != nil {
+		p.pos = start
+		return p.errorf("%v", err)
+	}
+
+	return p.writeExtJSON(value)
+}
+
+// arguments reads the literal arguments of a constructor call
+func (p *jsParser) arguments(name string) ([]any, error) {
+	p.pos++
+
+	args := make([]any, 0)
+	for {
+		if err := p.space(); err != nil {
+			return nil, err
+		}
+
+		if p.peek() == ')' {
+			p.pos++
+			return args, nil
+		}
+
+		if len(args) > 0 {
+			if err := p.expect(','); err != nil {
+				return nil, err
+			}
+			if err := p.space(); err != nil {
+				return nil, err
+			}
+			if p.peek() == ')' {
+				p.pos++
+				return args, nil
+			}
+		}
+
+		switch c := p.peek(); {
+		case c == '"' || c == '\'':
+			s, err := p.string()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, s)
+
+		case c == '-' || c == '+' || c == '.' || c == '(' || (c >= '0' && c <= '9') || p.numericCall():
+			n, err := p.numericExpression()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, n)
+
+		default:
+			return nil, p.errorf("%s only accepts string and number arguments", name)
+		}
+	}
+}
+
+// jsConstructor builds the BSON value of a mongosh constructor call
+func jsConstructor(name string, args []any, now time.Time) (any, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("%s takes at most one argument", name)
+	}
+
+	switch name {
+	case "ISODate", "Date":
+		if len(args) == 0 {
+			return primitive.NewDateTimeFromTime(now), nil
+		}
+
+		switch arg := args[0].(type) {
+		case float64:
+			return primitive.DateTime(int64(arg)), nil
+		case string:
+			for _, layout := range jsDateLayouts {
+				if t, err := time.Parse(layout, arg); err == nil {
+					return primitive.NewDateTimeFromTime(t), nil
+				}
+			}
+			return nil, fmt.Errorf("invalid date %q", arg)
+		}
+
+	case "ObjectId":
+		if len(args) == 0 {
+			return primitive.NewObjectID(), nil
+		}
+
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("ObjectId takes a hex string")
+		}
+		if _, err := hex.DecodeString(s); err != nil || len(s) != 24 {
+			return nil, fmt.Errorf("invalid ObjectId %q", s)
+		}
+		return primitive.ObjectIDFromHex(s)
+
+	case "NumberLong", "NumberInt":
+		var n int64
+		if len(args) == 1 {
+			switch arg := args[0].(type) {
+			case float64:
+				n = int64(arg)
+				if float64(n) != arg {
+					return nil, fmt.Errorf("%s takes an integer", name)
+				}
+			case string:
+				var err error
+				if n, err = strconv.ParseInt(arg, 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid %s %q", name, arg)
+				}
+			}
+		}
+
+		if name == "NumberInt" {
+			if n < math.MinInt32 || n > math.MaxInt32 {
+				return nil, fmt.Errorf("NumberInt %d out of range", n)
+			}
+			return int32(n), nil
+		}
+		return n, nil
+
+	case "NumberDecimal":
+		s := "0"
+		if len(args) == 1 {
+			s = fmt.Sprint(args[0])
+		}
+		d, err := primitive.ParseDecimal128(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NumberDecimal %q", s)
+		}
+		return d, nil
+	}
+
+	return nil, fmt.Errorf("unknown function %s", name)
+}
+
+func (p *jsParser) writeJSON(v string) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	p.out.Write(b)
+	return nil
+}
+
+// writeExtJSON writes a BSON value in canonical Extended JSON, so that its type is kept
+func (p *jsParser) writeExtJSON(v any) error {
+	b, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, true, false)
+	if err != nil {
+		return err
+	}
+
+	// Strip the wrapping document {"v":...}
+	p.out.Write(b[len(`{"v":`) : len(b)-1])
+	return nil
+}
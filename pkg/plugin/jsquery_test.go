@@ -0,0 +1,227 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestJsToExtJSON(t *testing.T) {
+	parse := func(t *testing.T, text string) []bson.D {
+		t.Helper()
+
+		pipeline, err := parseQueryText(text, queryLanguageJavaScript, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pipeline
+	}
+
+	t.Run("should accept unquoted keys, single quotes and trailing commas", func(t *testing.T) {
+		pipeline := parse(t, `[
+  // Only errors
+  { $match: { level: 'error', "host": 'a', }, },
+  { $limit: 10 },
+];`)
+
+		assertEq(t, pipeline, []bson.D{
+			{{Key: "$match", Value: bson.D{{Key: "level", Value: "error"}, {Key: "host", Value: "a"}}}},
+			{{Key: "$limit", Value: int32(10)}},
+		})
+	})
+
+	t.Run("should convert constructors", func(t *testing.T) {
+		pipeline := parse(t, `[{ $match: {
+  ts: { $gte: ISODate("2024-01-01T00:00:00Z"), $lt: new Date('2024-01-02') },
+  at: new Date(1704067200000),
+  _id: ObjectId("65a1b2c3d4e5f6a7b8c9d0e1"),
+  n: NumberLong("9007199254740993"),
+  i: NumberInt(5),
+  d: NumberDecimal("1.5"),
+} }]`)
+
+		from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		oid, _ := primitive.ObjectIDFromHex("65a1b2c3d4e5f6a7b8c9d0e1")
+		// Decimal128 has unexported fields, compare its string form
+		match := pipeline[0][0].Value.(bson.D)
+		assertEq(t, match[len(match)-1].Value.(primitive.Decimal128).String(), "1.5")
+		pipeline[0][0].Value = match[:len(match)-1]
+
+		assertEq(t, pipeline, []bson.D{
+			{{Key: "$match", Value: bson.D{
+				{Key: "ts", Value: bson.D{
+					{Key: "$gte", Value: primitive.NewDateTimeFromTime(from)},
+					{Key: "$lt", Value: primitive.NewDateTimeFromTime(from.AddDate(0, 0, 1))},
+				}},
+				{Key: "at", Value: primitive.NewDateTimeFromTime(from)},
+				{Key: "_id", Value: oid},
+				{Key: "n", Value: int64(9007199254740993)},
+				{Key: "i", Value: int32(5)},
+			}}},
+		})
+	})
+
+	t.Run("should convert regex literals", func(t *testing.T) {
+		pipeline := parse(t, `[{ $match: { name: /^a[/]b\/c/gi } }]`)
+
+		assertEq(t, pipeline, []bson.D{
+			{{Key: "$match", Value: bson.D{{Key: "name", Value: primitive.Regex{Pattern: `^a[/]b\/c`, Options: "i"}}}}},
+		})
+	})
+
+	t.Run("should convert numbers", func(t *testing.T) {
+		pipeline := parse(t, `[{ $match: { a: -.5, b: 2., c: 1e3, d: +4 } }]`)
+
+		assertEq(t, pipeline, []bson.D{
+			{{Key: "$match", Value: bson.D{
+				{Key: "a", Value: -0.5},
+				{Key: "b", Value: 2.0},
+				{Key: "c", Value: 1000.0},
+				{Key: "d", Value: int32(4)},
+			}}},
+		})
+	})
+
+	t.Run("should accept Extended JSON", func(t *testing.T) {
+		pipeline := parse(t, `[{"$match": {"ts": {"$date": "2024-01-01T00:00:00Z"}}}]`)
+
+		assertEq(t, pipeline, []bson.D{
+			{{Key: "$match", Value: bson.D{{Key: "ts", Value: primitive.NewDateTimeFromTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))}}}},
+		})
+	})
+
+	t.Run("should evaluate arithmetic of dashboard queries", func(t *testing.T) {
+		now := time.Date(2024, 1, 1, 12, 30, 15, 0, time.UTC)
+		convert := func(t *testing.T, text string) []bson.D {
+			t.Helper()
+
+			p := &jsParser{text: text, now: now}
+			out, err := p.parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pipeline, err := parsePipeline(out, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pipeline
+		}
+
+		date := func(t time.Time) primitive.DateTime { return primitive.NewDateTimeFromTime(t) }
+
+		tests := []struct {
+			text     string
+			pipeline []bson.D
+		}{
+			{
+				`[{ $match: { ts: { $gte: new Date(Date.now() - 3600000) } } }]`,
+				[]bson.D{{{Key: "$match", Value: bson.D{{Key: "ts", Value: bson.D{{Key: "$gte", Value: date(now.Add(-time.Hour))}}}}}}},
+			},
+			{
+				`[{ $match: { ts: { $gte: new Date(Date.now() - 24 * 60 * 60 * 1000), $lt: new Date() } } }]`,
+				[]bson.D{{{Key: "$match", Value: bson.D{{Key: "ts", Value: bson.D{
+					{Key: "$gte", Value: date(now.AddDate(0, 0, -1))},
+					{Key: "$lt", Value: date(now)},
+				}}}}}},
+			},
+			{
+				`[{ $match: { ts: { $gte: new Date(Math.floor(Date.now() / 60000) * 60000) } } }]`,
+				[]bson.D{{{Key: "$match", Value: bson.D{{Key: "ts", Value: bson.D{{Key: "$gte", Value: date(now.Truncate(time.Minute))}}}}}}},
+			},
+			{
+				`[{ $match: { at: Date.now(), v: { $gt: (100 + 50) * 1.25 } } }, { $limit: 5 * 2 }]`,
+				[]bson.D{
+					{{Key: "$match", Value: bson.D{
+						{Key: "at", Value: now.UnixMilli()},
+						{Key: "v", Value: bson.D{{Key: "$gt", Value: 187.5}}},
+					}}},
+					{{Key: "$limit", Value: int32(10)}},
+				},
+			},
+			{
+				`[{ $match: { property_type: 'Apartmen' + 't', host: "host-" + 2 * 3 + '-a' } }, { $limit: 2 + 4 }]`,
+				[]bson.D{
+					{{Key: "$match", Value: bson.D{{Key: "property_type", Value: "Apartment"}, {Key: "host", Value: "host-6-a"}}}},
+					{{Key: "$limit", Value: int32(6)}},
+				},
+			},
+			{
+				"[{ $skip: 10 /* rows */ }, { $limit: 20 // rows\n }, { $project: { a: 1, b: -1 } }]",
+				[]bson.D{
+					{{Key: "$skip", Value: int32(10)}},
+					{{Key: "$limit", Value: int32(20)}},
+					{{Key: "$project", Value: bson.D{{Key: "a", Value: int32(1)}, {Key: "b", Value: int32(-1)}}}},
+				},
+			},
+		}
+
+		for _, tt := range tests {
+			assertEq(t, convert(t, tt.text), tt.pipeline)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		text   string
+		line   int
+		column int
+	}{
+		{"unterminated string", "[\n  { $match: { a: 'b } }\n]", 2, 18},
+		{"unknown identifier", "[{ $match: { a: foo } }]", 1, 17},
+		{"invalid ObjectId", "[{ $match: { _id: ObjectId('xyz') } }]", 1, 19},
+		{"invalid date", "[{ $match: { ts: ISODate('yesterday') } }]", 1, 18},
+		{"missing comma", "[{ $match: { a: 1 b: 2 } }]", 1, 19},
+		{"trailing content", "[] []", 1, 4},
+		{"unexpected end", "[{ $match: ", 1, 12},
+		{"unsupported function", "[{ $limit: Math.pow(2, 3) }]", 1, 12},
+	}
+
+	for _, tt := range tests {
+		t.Run("should locate "+tt.name, func(t *testing.T) {
+			_, err := jsToExtJSON(tt.text)
+
+			perr, ok := err.(*pipelineError)
+			if !ok {
+				t.Fatalf("expected pipeline error, got %v", err)
+			}
+
+			if perr.Line != tt.line || perr.Column != tt.column {
+				t.Errorf("expected error at %d:%d, got %d:%d (%s)", tt.line, tt.column, perr.Line, perr.Column, perr.Message)
+			}
+		})
+	}
+
+	t.Run("should keep line positions for pipeline errors", func(t *testing.T) {
+		_, err := parseQueryText("[\n  { $match: {} },\n  { $match: {}, $limit: 1 },\n]", queryLanguageJavaScript, nil)
+
+		perr, ok := err.(*pipelineError)
+		if !ok {
+			t.Fatalf("expected pipeline error, got %v", err)
+		}
+		assertEq(t, perr.Line, 3)
+	})
+
+	t.Run("should locate pipeline errors after rewritten literals", func(t *testing.T) {
+		text := "[{ $match: { _id: ObjectId('65a1b2c3d4e5f6a7b8c9d0e1') } }, { $match: {}, $limit: 1 }]"
+		_, err := parseQueryText(text, queryLanguageJavaScript, nil)
+
+		perr, ok := err.(*pipelineError)
+		if !ok {
+			t.Fatalf("expected pipeline error, got %v", err)
+		}
+		assertEq(t, perr.Column, strings.Index(text, "{ $match: {}")+1)
+	})
+
+	t.Run("should locate stages in the query text", func(t *testing.T) {
+		text := "[{ ts: ISODate('2024-01-01') }, { $foo: 1 }]"
+		stages, err := parseJSPipelineStages(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, stages[1].Offset, strings.Index(text, "{ $foo"))
+	})
+}
@@ -0,0 +1,210 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/auth"
+)
+
+// The driver's GSSAPI mechanism uses the Kerberos C library, which only reads the client keytab
+// from the process environment. Datasources with a keytab use this mechanism instead, which
+// authenticates with GSSAPI in Go, so every datasource can use its own keytab
+const (
+	kerberosKeytabMechanism = "GSSAPI-KEYTAB"
+	// Mechanism property passing the keytab path to the authenticator
+	kerberosKeytabProperty = "KEYTAB_PATH"
+
+	kerberosDefaultConfigPath  = "/etc/krb5.conf"
+	kerberosDefaultServiceName = "mongodb"
+)
+
+func init() {
+	auth.RegisterAuthenticatorFactory(kerberosKeytabMechanism, newKeytabAuthenticator)
+}
+
+// keytabAuthenticator logs in once with the keytab and authenticates the connections with
+// service tickets of the logged in client
+type keytabAuthenticator struct {
+	principal string
+	realm     string
+	keytab    *keytab.Keytab
+	config    *config.Config
+	props     map[string]string
+
+	mu     sync.Mutex
+	client *client.Client
+}
+
+func newKeytabAuthenticator(cred *auth.Cred) (auth.Authenticator, error) {
+	if cred.Source != "" && cred.Source != "$external" {
+		return nil, errors.New("GSSAPI source must be empty or $external")
+	}
+
+	kt, err := keytab.Load(cred.Props[kerberosKeytabProperty])
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Kerberos keytab: %w", err)
+	}
+
+	// KRB5_CONFIG is only read, like the Kerberos library does
+	configPath := os.Getenv("KRB5_CONFIG")
+	if configPath == "" {
+		configPath = kerberosDefaultConfigPath
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Kerberos configuration %s: %w", configPath, err)
+	}
+
+	principal, realm := cred.Username, cfg.LibDefaults.DefaultRealm
+	if i := strings.LastIndex(cred.Username, "@"); i >= 0 {
+		principal, realm = cred.Username[:i], cred.Username[i+1:]
+	}
+	if realm == "" {
+		return nil, fmt.Errorf("missing realm of Kerberos principal %s", cred.Username)
+	}
+
+	return &keytabAuthenticator{
+		principal: principal,
+		realm:     realm,
+		keytab:    kt,
+		config:    cfg,
+		props:     cred.Props,
+	}, nil
+}
+
+// Auth authenticates the connection
+func (a *keytabAuthenticator) Auth(ctx context.Context, cfg *auth.Config) error {
+	host, _, err := net.SplitHostPort(cfg.Description.Addr.String())
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %s: %w", cfg.Description.Addr, err)
+	}
+
+	spn, err := servicePrincipal(host, a.props)
+	if err != nil {
+		return err
+	}
+
+	cl, tkt, key, err := a.serviceTicket(spn)
+	if err != nil {
+		return err
+	}
+
+	return auth.ConductSaslConversation(ctx, cfg, "$external", &keytabSaslClient{
+		client:   cl,
+		ticket:   tkt,
+		key:      key,
+		username: a.principal + "@" + a.realm,
+	})
+}
+
+// serviceTicket logs in on first use and returns a service ticket of the logged in client.
+// The ticket is cached by the client until it expires
+func (a *keytabAuthenticator) serviceTicket(spn string) (*client.Client, messages.Ticket, types.EncryptionKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client == nil {
+		cl := client.NewWithKeytab(a.principal, a.realm, a.keytab, a.config, client.DisablePAFXFAST(true))
+		if err := cl.Login(); err != nil {
+			return nil, messages.Ticket{}, types.EncryptionKey{}, fmt.Errorf("failed to log in as %s@%s: %w", a.principal, a.realm, err)
+		}
+		a.client = cl
+	}
+
+	// The client resolves the realm of the service from the host
+	if realm := a.props["SERVICE_REALM"]; realm != "" {
+		a.config.DomainRealm[spn[strings.Index(spn, "/")+1:]] = realm
+	}
+
+	tkt, key, err := a.client.GetServiceTicket(spn)
+	if err != nil {
+		return nil, messages.Ticket{}, types.EncryptionKey{}, fmt.Errorf("failed to get service ticket for %s: %w", spn, err)
+	}
+
+	return a.client, tkt, key, nil
+}
+
+// servicePrincipal returns the service principal of the MongoDB server, like mongodb/host
+func servicePrincipal(host string, props map[string]string) (string, error) {
+	service := kerberosDefaultServiceName
+	if props["SERVICE_NAME"] != "" {
+		service = props["SERVICE_NAME"]
+	}
+
+	if props["SERVICE_HOST"] != "" {
+		host = props["SERVICE_HOST"]
+	} else if props["CANONICALIZE_HOST_NAME"] == "true" {
+		canonical, err := net.LookupCNAME(host)
+		if err != nil {
+			return "", fmt.Errorf("failed to canonicalize host name %s: %w", host, err)
+		}
+		host = strings.TrimSuffix(canonical, ".")
+	}
+
+	return service + "/" + host, nil
+}
+
+// keytabSaslClient runs the GSSAPI SASL exchange of RFC 4752 without security layer
+type keytabSaslClient struct {
+	client   *client.Client
+	ticket   messages.Ticket
+	key      types.EncryptionKey
+	username string
+
+	done bool
+}
+
+// Start sends the service ticket to the server
+func (c *keytabSaslClient) Start() (string, []byte, error) {
+	token, err := spnego.NewKRB5TokenAPREQ(c.client, c.ticket, c.key, []int{gssapi.ContextFlagInteg, gssapi.ContextFlagConf}, nil)
+	if err != nil {
+		return auth.GSSAPI, nil, err
+	}
+
+	payload, err := token.Marshal()
+	return auth.GSSAPI, payload, err
+}
+
+// Next answers the security layers offered by the server with no security layer and the
+// user to authenticate as
+func (c *keytabSaslClient) Next(challenge []byte) ([]byte, error) {
+	// The server accepted the ticket and waits for the client before offering security layers
+	if len(challenge) == 0 {
+		return []byte{}, nil
+	}
+
+	var offer gssapi.WrapToken
+	if err := offer.Unmarshal(challenge, true); err != nil {
+		return nil, fmt.Errorf("invalid GSSAPI challenge: %w", err)
+	}
+	if ok, err := offer.Verify(c.key, keyusage.GSSAPI_ACCEPTOR_SEAL); !ok {
+		return nil, fmt.Errorf("invalid GSSAPI challenge: %w", err)
+	}
+
+	reply, err := gssapi.NewInitiatorWrapToken(append([]byte{1, 0, 0, 0}, c.username...), c.key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.done = true
+	return reply.Marshal()
+}
+
+// Completed returns whether the client sent the user to authenticate as
+func (c *keytabSaslClient) Completed() bool {
+	return c.done
+}
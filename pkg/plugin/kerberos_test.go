@@ -0,0 +1,215 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/auth"
+)
+
+func TestServicePrincipal(t *testing.T) {
+	tests := []struct {
+		name     string
+		props    map[string]string
+		expected string
+	}{
+		{"should default to the mongodb service of the host", nil, "mongodb/db1.example.com"},
+		{"should use the service name", map[string]string{"SERVICE_NAME": "mongo"}, "mongo/db1.example.com"},
+		{"should use the service host", map[string]string{"SERVICE_HOST": "mongo.example.com"}, "mongodb/mongo.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spn, err := servicePrincipal("db1.example.com", tt.props)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEq(t, spn, tt.expected)
+		})
+	}
+}
+
+func TestNewKeytabAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+
+	kt := keytab.New()
+	if err := kt.AddEntry("grafana", "EXAMPLE.COM", "password", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+	b, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keytabPath := filepath.Join(dir, "grafana.keytab")
+	if err := os.WriteFile(keytabPath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(dir, "krb5.conf")
+	if err := os.WriteFile(configPath, []byte("[libdefaults]\n  default_realm = DEFAULT.COM\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KRB5_CONFIG", configPath)
+
+	t.Run("should split the principal and its realm", func(t *testing.T) {
+		a, err := newKeytabAuthenticator(&auth.Cred{
+			Source:   "$external",
+			Username: "grafana@EXAMPLE.COM",
+			Props:    map[string]string{kerberosKeytabProperty: keytabPath},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, a.(*keytabAuthenticator).principal, "grafana")
+		assertEq(t, a.(*keytabAuthenticator).realm, "EXAMPLE.COM")
+	})
+
+	t.Run("should default to the realm of the configuration", func(t *testing.T) {
+		a, err := newKeytabAuthenticator(&auth.Cred{
+			Username: "grafana",
+			Props:    map[string]string{kerberosKeytabProperty: keytabPath},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, a.(*keytabAuthenticator).realm, "DEFAULT.COM")
+	})
+
+	t.Run("should return error for missing keytab", func(t *testing.T) {
+		_, err := newKeytabAuthenticator(&auth.Cred{
+			Username: "grafana@EXAMPLE.COM",
+			Props:    map[string]string{kerberosKeytabProperty: filepath.Join(dir, "missing.keytab")},
+		})
+		if err == nil {
+			t.Fatal("expected error for missing keytab, got nil")
+		}
+	})
+
+	t.Run("should be created by the driver", func(t *testing.T) {
+		a, err := auth.CreateAuthenticator(kerberosKeytabMechanism, &auth.Cred{
+			Source:   "$external",
+			Username: "grafana@EXAMPLE.COM",
+			Props:    map[string]string{kerberosKeytabProperty: keytabPath},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := a.(*keytabAuthenticator); !ok {
+			t.Errorf("expected keytab authenticator, got %T", a)
+		}
+	})
+}
+
+func TestKeytabSaslClient(t *testing.T) {
+	serviceKeytab := keytab.New()
+	if err := serviceKeytab.AddEntry("mongodb/mongo.example.com", "EXAMPLE.COM", "secret", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	ticket, key, err := messages.NewTicket(
+		types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "grafana"), "EXAMPLE.COM",
+		types.NewPrincipalName(nametype.KRB_NT_SRV_HST, "mongodb/mongo.example.com"), "EXAMPLE.COM",
+		types.NewKrbFlags(), serviceKeytab, etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := client.NewWithKeytab("grafana", "EXAMPLE.COM", keytab.New(), config.New())
+	c := &keytabSaslClient{client: cl, ticket: ticket, key: key, username: "grafana@EXAMPLE.COM"}
+
+	t.Run("should start with the service ticket", func(t *testing.T) {
+		mechanism, payload, err := c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, mechanism, "GSSAPI")
+
+		var token spnego.KRB5Token
+		if err := token.Unmarshal(payload); err != nil {
+			t.Fatal(err)
+		}
+		if !token.IsAPReq() {
+			t.Fatal("expected AP-REQ token")
+		}
+		if err := token.APReq.Ticket.DecryptEncPart(serviceKeytab, nil); err != nil {
+			t.Fatalf("expected ticket for the service, got %v", err)
+		}
+	})
+
+	t.Run("should answer an empty challenge", func(t *testing.T) {
+		reply, err := c.Next(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, len(reply), 0)
+		assertEq(t, c.Completed(), false)
+	})
+
+	t.Run("should choose no security layer and send the user", func(t *testing.T) {
+		offer := gssapi.WrapToken{Flags: 0x01, EC: 12, Payload: []byte{7, 0, 16, 0}}
+		if err := offer.SetCheckSum(key, keyusage.GSSAPI_ACCEPTOR_SEAL); err != nil {
+			t.Fatal(err)
+		}
+		challenge, err := offer.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply, err := c.Next(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var answer gssapi.WrapToken
+		if err := answer.Unmarshal(reply, false); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := answer.Verify(key, keyusage.GSSAPI_INITIATOR_SEAL); !ok {
+			t.Fatal(err)
+		}
+		assertEq(t, answer.Payload, append([]byte{1, 0, 0, 0}, "grafana@EXAMPLE.COM"...))
+		assertEq(t, c.Completed(), true)
+	})
+
+	t.Run("should return error for a challenge signed with another key", func(t *testing.T) {
+		et, err := crypto.GetEtype(key.KeyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := types.GenerateEncryptionKey(et)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		offer := gssapi.WrapToken{Flags: 0x01, EC: 12, Payload: []byte{7, 0, 16, 0}}
+		if err := offer.SetCheckSum(other, keyusage.GSSAPI_ACCEPTOR_SEAL); err != nil {
+			t.Fatal(err)
+		}
+		challenge, err := offer.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := (&keytabSaslClient{key: key}).Next(challenge); err == nil {
+			t.Fatal("expected error for invalid challenge, got nil")
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Server-side macros. Unlike Grafana template variables they are replaced after
+// the query is parsed, so they keep their BSON type and also work in alerting.
+const (
+	macroTimeFrom = "$__timeFrom"
+	macroTimeTo   = "$__timeTo"
+	// Panel or variable interval in milliseconds
+	macroIntervalMs = "$__interval_ms"
+)
+
+// applyMacros replaces macro string values in the pipeline with typed values
+func applyMacros(pipeline []bson.D, from time.Time, to time.Time) []bson.D {
+	values := map[string]any{
+		macroTimeFrom: from,
+		macroTimeTo:   to,
+	}
+
+	result := make([]bson.D, len(pipeline))
+	for i, stage := range pipeline {
+		result[i] = replaceMacros(stage, values).(bson.D)
+	}
+
+	return result
+}
+
+// applyIntervalMacro replaces the interval macro with the interval in milliseconds
+func applyIntervalMacro(pipeline []bson.D, interval time.Duration) []bson.D {
+	values := map[string]any{
+		macroIntervalMs: interval.Milliseconds(),
+	}
+
+	result := make([]bson.D, len(pipeline))
+	for i, stage := range pipeline {
+		result[i] = replaceMacros(stage, values).(bson.D)
+	}
+
+	return result
+}
+
+func replaceMacros(v any, values map[string]any) any {
+	switch v := v.(type) {
+	case string:
+		if r, ok := values[v]; ok {
+			return r
+		}
+		return v
+
+	case bson.D:
+		d := make(bson.D, len(v))
+		for i, e := range v {
+			d[i] = bson.E{Key: e.Key, Value: replaceMacros(e.Value, values)}
+		}
+		return d
+
+	case bson.A:
+		a := make(bson.A, len(v))
+		for i, e := range v {
+			a[i] = replaceMacros(e, values)
+		}
+		return a
+
+	default:
+		return v
+	}
+}
@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestApplyMacros(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	var pipeline []bson.D
+	err := bson.UnmarshalExtJSON([]byte(`[
+		{"$match": {"ts": {"$gte": "$__timeFrom", "$lt": "$__timeTo"}, "name": "foo"}},
+		{"$project": {"range": ["$__timeFrom", "$__timeTo"]}}
+	]`), false, &pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := applyMacros(pipeline, from, to)
+
+	expected := []bson.D{
+		{{Key: "$match", Value: bson.D{
+			{Key: "ts", Value: bson.D{{Key: "$gte", Value: from}, {Key: "$lt", Value: to}}},
+			{Key: "name", Value: "foo"},
+		}}},
+		{{Key: "$project", Value: bson.D{{Key: "range", Value: bson.A{from, to}}}}},
+	}
+
+	assertEq(t, result, expected)
+
+	// The original pipeline is left untouched
+	if pipeline[0][0].Value.(bson.D)[0].Value.(bson.D)[0].Value != macroTimeFrom {
+		t.Error("expected original pipeline to keep the macro")
+	}
+}
+
+func TestApplyIntervalMacro(t *testing.T) {
+	pipeline := []bson.D{{{Key: "$group", Value: bson.D{{Key: "size", Value: macroIntervalMs}}}}}
+
+	result := applyIntervalMacro(pipeline, 30*time.Second)
+
+	assertEq(t, result, []bson.D{{{Key: "$group", Value: bson.D{{Key: "size", Value: int64(30000)}}}}})
+}
@@ -1,29 +1,48 @@
 package plugin
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"net"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/haohanyang/mongodb-datasource/pkg/models"
+	"github.com/youmark/pkcs8"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
 func buildMongoOpts(config *models.PluginSettings) (*options.ClientOptions, error) {
 
 	opts := options.Client()
 
-	err := setUri(config, opts)
-	if err != nil {
-		return nil, err
-	}
+	if config.ConnectionMode == connectionModeUri {
+		// Credentials are part of the connection string
+		err := setFullUri(config, opts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := setUri(config, opts)
+		if err != nil {
+			return nil, err
+		}
 
-	err = setAuth(config, opts)
-	if err != nil {
-		return nil, err
+		err = setAuth(config, opts)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err = setupTls(config, opts)
+	err := setupTls(config, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -46,6 +65,14 @@ func setAuth(config *models.PluginSettings, opts *options.ClientOptions) error {
 			cred.AuthSource = config.AuthDatabase
 		}
 
+		switch config.AuthMechanism {
+		case scramMechanismAuto:
+		case scramMechanismSHA1, scramMechanismSHA256:
+			cred.AuthMechanism = config.AuthMechanism
+		default:
+			return fmt.Errorf("unsupported authentication mechanism %s, expected %s or %s", config.AuthMechanism, scramMechanismSHA1, scramMechanismSHA256)
+		}
+
 		opts.SetAuth(cred)
 	} else if config.AuthMethod == mongoAuthX509 {
 		cred := options.Credential{
@@ -54,20 +81,191 @@ func setAuth(config *models.PluginSettings, opts *options.ClientOptions) error {
 		}
 
 		opts.SetAuth(cred)
+	} else if config.AuthMethod == mongoAuthLDAP {
+		// LDAP proxy authentication sends the password in plain text, TLS should be enabled
+		if config.Username == "" || config.Secrets == nil || config.Secrets.Password == "" {
+			return errors.New("missing LDAP username or password")
+		}
+
+		cred := options.Credential{
+			AuthMechanism: "PLAIN",
+			AuthSource:    "$external",
+			Username:      config.Username,
+			Password:      config.Secrets.Password,
+		}
+
+		opts.SetAuth(cred)
+	} else if config.AuthMethod == mongoAuthKerberos {
+		cred, err := kerberosCredential(config)
+		if err != nil {
+			return err
+		}
+
+		opts.SetAuth(cred)
+	} else if config.AuthMethod == mongoAuthAWS {
+		cred, err := awsCredential(config.Secrets)
+		if err != nil {
+			return err
+		}
+
+		opts.SetAuth(cred)
+	}
+
+	if len(config.AuthMechanismProperties) > 0 {
+		if opts.Auth == nil {
+			return errors.New("authentication mechanism properties require an authentication method")
+		}
+
+		if err := validateMechanismProperties(opts.Auth.AuthMechanism, config.AuthMechanismProperties); err != nil {
+			return err
+		}
+
+		// Properties derived from other settings take precedence
+		props := make(map[string]string, len(config.AuthMechanismProperties))
+		for key, value := range config.AuthMechanismProperties {
+			props[key] = value
+		}
+		for key, value := range opts.Auth.AuthMechanismProperties {
+			props[key] = value
+		}
+		opts.Auth.AuthMechanismProperties = props
+	}
+
+	return nil
+}
+
+// Mechanism properties accepted by each authentication mechanism. The AWS session token is a
+// secure setting, it's not accepted as a property which is stored in plain text
+var authMechanismProperties = map[string][]string{
+	"":              {},
+	"SCRAM-SHA-1":   {},
+	"SCRAM-SHA-256": {},
+	"MONGODB-X509":  {},
+	"PLAIN":         {},
+	"GSSAPI":        {"SERVICE_NAME", "SERVICE_REALM", "CANONICALIZE_HOST_NAME", "SERVICE_HOST"},
+	// GSSAPI with the keytab of the datasource
+	kerberosKeytabMechanism: {"SERVICE_NAME", "SERVICE_REALM", "CANONICALIZE_HOST_NAME", "SERVICE_HOST"},
+	"MONGODB-AWS":           {},
+}
+
+// validateMechanismProperties checks the mechanism properties of the settings, so that
+// misconfigurations are reported when the settings are saved rather than when connecting
+func validateMechanismProperties(mechanism string, props map[string]string) error {
+	allowed, ok := authMechanismProperties[mechanism]
+	if !ok {
+		return fmt.Errorf("unsupported authentication mechanism %s", mechanism)
+	}
+
+	for key, value := range props {
+		if !slices.Contains(allowed, key) {
+			if len(allowed) == 0 {
+				return fmt.Errorf("authentication mechanism %s doesn't accept mechanism properties, got %s", mechanismName(mechanism), key)
+			}
+			return fmt.Errorf("unknown authentication mechanism property %s for %s, expected one of %s", key, mechanismName(mechanism), strings.Join(allowed, ", "))
+		}
+
+		if key == "CANONICALIZE_HOST_NAME" && value != "true" && value != "false" {
+			return fmt.Errorf("authentication mechanism property %s should be true or false, got %s", key, value)
+		}
 	}
 
 	return nil
 }
 
+func mechanismName(mechanism string) string {
+	switch mechanism {
+	case "":
+		return "SCRAM"
+	case kerberosKeytabMechanism:
+		return "GSSAPI"
+	}
+	return mechanism
+}
+
+// kerberosCredential authenticates the principal with GSSAPI. Unless the keytab of the
+// datasource is used, the plugin has to be built with the gssapi tag for the driver to support it
+func kerberosCredential(config *models.PluginSettings) (options.Credential, error) {
+	if config.Username == "" {
+		return options.Credential{}, errors.New("missing Kerberos principal")
+	}
+
+	cred := options.Credential{
+		AuthMechanism: "GSSAPI",
+		AuthSource:    "$external",
+		Username:      config.Username,
+	}
+
+	// Without a password or keytab the ticket cache is used, or the client keytab given by
+	// KRB5_CLIENT_KTNAME in the environment of the Grafana server
+	if config.Secrets != nil && config.Secrets.Password != "" {
+		cred.Password = config.Secrets.Password
+		cred.PasswordSet = true
+	}
+	if config.KerberosKeytabPath != "" {
+		if cred.PasswordSet {
+			return options.Credential{}, errors.New("set either a Kerberos password or a keytab, not both")
+		}
+		cred.AuthMechanism = kerberosKeytabMechanism
+	}
+
+	props := map[string]string{}
+	if config.KerberosServiceName != "" {
+		props["SERVICE_NAME"] = config.KerberosServiceName
+	}
+	if config.KerberosServiceRealm != "" {
+		props["SERVICE_REALM"] = config.KerberosServiceRealm
+	}
+	if config.KerberosCanonicalizeHost {
+		props["CANONICALIZE_HOST_NAME"] = "true"
+	}
+	if config.KerberosKeytabPath != "" {
+		props[kerberosKeytabProperty] = config.KerberosKeytabPath
+	}
+	if len(props) > 0 {
+		cred.AuthMechanismProperties = props
+	}
+
+	return cred, nil
+}
+
+// awsCredential uses the access keys from the secure settings, or leaves them empty for the
+// driver to read them from the environment, the ECS task role or the EC2 instance role
+func awsCredential(secrets *models.SecretPluginSettings) (options.Credential, error) {
+	cred := options.Credential{
+		AuthMechanism: "MONGODB-AWS",
+		AuthSource:    "$external",
+	}
+
+	if secrets == nil || (secrets.AwsAccessKeyId == "" && secrets.AwsSecretAccessKey == "" && secrets.AwsSessionToken == "") {
+		return cred, nil
+	}
+
+	if secrets.AwsAccessKeyId == "" || secrets.AwsSecretAccessKey == "" {
+		return cred, errors.New("missing AWS access key ID or secret access key")
+	}
+
+	cred.Username = secrets.AwsAccessKeyId
+	cred.Password = secrets.AwsSecretAccessKey
+
+	if secrets.AwsSessionToken != "" {
+		cred.AuthMechanismProperties = map[string]string{
+			"AWS_SESSION_TOKEN": secrets.AwsSessionToken,
+		}
+	}
+
+	return cred, nil
+}
+
 // Set connection string from plugin settings
 // Only set connection schema, host, database and connection options here
 func setUri(config *models.PluginSettings, opts *options.ClientOptions) error {
-	if config.Host == "" {
-		return errors.New("missing MongoDB host")
+	seeds, err := seedList(config)
+	if err != nil {
+		return err
 	}
 
 	u := &url.URL{
-		Host:   config.Host,
+		Host:   strings.Join(seeds, ","),
 		Path:   config.Database,
 		Scheme: connstring.SchemeMongoDB,
 	}
@@ -100,6 +298,22 @@ func setUri(config *models.PluginSettings, opts *options.ClientOptions) error {
 		}
 	}
 
+	if config.ReplicaSet != "" {
+		query.Set("replicaSet", config.ReplicaSet)
+	}
+	if config.DirectConnection {
+		query.Set("directConnection", "true")
+	}
+	if config.LoadBalanced {
+		query.Set("loadBalanced", "true")
+	}
+
+	// The driver has no tlsAllowInvalidCertificates option, skipping the verification of the
+	// certificate also skips the hostname. Invalid hostnames alone are handled in setupTls
+	if config.TlsOption != tlsDisabled && (config.TlsInsecure || config.TlsAllowInvalidCertificates) {
+		query.Set("tlsInsecure", "true")
+	}
+
 	// Ref: https://github.com/mongodb-js/compass/blob/ffbe6d0b9c4401342de5222e066efff6d77ee455/packages/connection-form/src/utils/tls-handler.ts#L42
 	if config.TlsOption == tlsEnabled {
 		query.Del("ssl")
@@ -120,23 +334,225 @@ func setUri(config *models.PluginSettings, opts *options.ClientOptions) error {
 	return err
 }
 
+// seedList validates the hosts of the settings and returns them as host:port strings. The host
+// list is used if set, otherwise the host setting, which may hold several comma separated hosts
+func seedList(config *models.PluginSettings) ([]string, error) {
+	hosts := config.Hosts
+	if len(hosts) == 0 && config.Host != "" {
+		for _, host := range strings.Split(config.Host, ",") {
+			hosts = append(hosts, models.HostSetting{Host: host})
+		}
+
+		// The port setting applies to a single host without a port
+		if len(hosts) == 1 && config.Port > 0 && config.ConnectionStringScheme != connstring.SchemeMongoDBSRV {
+			if _, port, _ := splitHostPort(hosts[0].Host); port == "" {
+				hosts[0].Port = config.Port
+			}
+		}
+	}
+
+	if len(hosts) == 0 {
+		return nil, errors.New("missing MongoDB host")
+	}
+
+	seeds := make([]string, 0, len(hosts))
+	for i, h := range hosts {
+		seed, err := formatSeed(h)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %d: %w", i+1, err)
+		}
+
+		if slices.Contains(seeds, seed) {
+			return nil, fmt.Errorf("duplicate host %s", seed)
+		}
+		seeds = append(seeds, seed)
+	}
+
+	if config.ConnectionStringScheme == connstring.SchemeMongoDBSRV {
+		if len(seeds) > 1 {
+			return nil, errors.New("mongodb+srv requires a single host")
+		}
+		if _, port, _ := splitHostPort(seeds[0]); port != "" {
+			return nil, fmt.Errorf("mongodb+srv host %s can't have a port", seeds[0])
+		}
+	}
+
+	if config.DirectConnection && len(seeds) > 1 {
+		return nil, errors.New("direct connection requires a single host")
+	}
+
+	if config.LoadBalanced {
+		if len(seeds) > 1 {
+			return nil, errors.New("load balanced mode requires a single host")
+		}
+		if config.ReplicaSet != "" || config.DirectConnection {
+			return nil, errors.New("load balanced mode can't be used with a replica set name or a direct connection")
+		}
+	}
+
+	return seeds, nil
+}
+
+// formatSeed validates a host and returns it as host:port, or host if it has no port
+func formatSeed(h models.HostSetting) (string, error) {
+	host, port, err := splitHostPort(strings.TrimSpace(h.Host))
+	if err != nil {
+		return "", err
+	}
+
+	if host == "" {
+		return "", errors.New("host is empty")
+	}
+
+	if strings.ContainsAny(host, ",/?#@[] \t") {
+		return "", fmt.Errorf("host %q contains invalid characters", host)
+	}
+
+	if h.Port != 0 {
+		if port != "" {
+			return "", fmt.Errorf("port of %s is set twice", h.Host)
+		}
+		port = strconv.Itoa(h.Port)
+	}
+
+	if port == "" {
+		if strings.Contains(host, ":") {
+			// IPv6 addresses need brackets
+			return "[" + host + "]", nil
+		}
+		return host, nil
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port %s of host %s", port, host)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// splitHostPort splits host:port, allowing hosts without a port and IPv6 addresses
+// with or without brackets
+func splitHostPort(s string) (string, string, error) {
+	if strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+			return s[1 : len(s)-1], "", nil
+		}
+
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid host %s", s)
+		}
+		if port == "" {
+			return "", "", fmt.Errorf("missing port after %s", s)
+		}
+		return host, port, nil
+	}
+
+	return s, "", nil
+}
+
+// connectionErrorMessage describes a connection error. When no server could be selected, it
+// names each host that failed and why, instead of printing the whole topology
+func connectionErrorMessage(err error) string {
+	var selectionErr topology.ServerSelectionError
+	if !errors.As(err, &selectionErr) {
+		return err.Error()
+	}
+
+	var failures []string
+	for _, server := range selectionErr.Desc.Servers {
+		if server.LastError != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", server.Addr, server.LastError))
+		}
+	}
+
+	if len(failures) == 0 {
+		return err.Error()
+	}
+
+	return "failed to connect to " + strings.Join(failures, "; ")
+}
+
+// Set the connection string stored in the secure settings. The default database is taken
+// from the connection string, falling back to the database setting
+func setFullUri(config *models.PluginSettings, opts *options.ClientOptions) error {
+	if config.Secrets == nil || config.Secrets.ConnectionString == "" {
+		return errors.New("missing MongoDB connection string")
+	}
+
+	uri := config.Secrets.ConnectionString
+
+	cs, err := connstring.ParseAndValidate(uri)
+	if err != nil {
+		return fmt.Errorf("invalid connection string: %s", redactUri(err.Error(), uri))
+	}
+
+	if cs.Database != "" {
+		config.Database = cs.Database
+	}
+
+	if config.Database == "" {
+		return errors.New("missing database, add it to the connection string path")
+	}
+
+	opts.ApplyURI(uri)
+
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("invalid connection string: %s", redactUri(err.Error(), uri))
+	}
+
+	return nil
+}
+
+// redactUri removes the connection string and its password from an error message
+func redactUri(msg string, uri string) string {
+	msg = strings.ReplaceAll(msg, uri, "<connection string>")
+
+	if u, err := url.Parse(uri); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok && password != "" {
+			msg = strings.ReplaceAll(msg, password, "<password>")
+		}
+	}
+
+	return msg
+}
+
 func setupTls(config *models.PluginSettings, opts *options.ClientOptions) error {
-	if config.TlsOption == tlsDisabled || (config.CaCertPath == "" && config.ClientCertAndKeyPath == "") {
+	secrets := config.Secrets
+	if secrets == nil {
+		secrets = &models.SecretPluginSettings{}
+	}
+
+	hasCa := config.CaCertPath != "" || secrets.CaCert != ""
+	hasClientCert := config.ClientCertAndKeyPath != "" || secrets.ClientCert != ""
+
+	if config.TlsOption == tlsDisabled {
+		return nil
+	}
+
+	// Without certificates the TLS config comes from the connection string, if TLS is enabled
+	if !hasCa && !hasClientCert {
+		if opts.TLSConfig != nil {
+			tlsConfig := opts.TLSConfig.Clone()
+			relaxTlsValidation(config, tlsConfig)
+			opts.SetTLSConfig(tlsConfig)
+		}
 		return nil
 	}
 
 	tlsOpts := map[string]any{}
 
-	if config.CaCertPath != "" {
+	// PEM certificates from the secure settings take precedence over the paths
+	if config.CaCertPath != "" && secrets.CaCert == "" {
 		tlsOpts["tlsCAFile"] = config.CaCertPath
 	}
 
-	if config.ClientCertAndKeyPath != "" {
+	if config.ClientCertAndKeyPath != "" && secrets.ClientCert == "" {
 		tlsOpts["tlsCertificateKeyFile"] = config.ClientCertAndKeyPath
-	}
 
-	if config.Secrets != nil && config.Secrets.ClientKeyPassword != "" {
-		tlsOpts["tlsCertificateKeyFilePassword"] = config.Secrets.ClientKeyPassword
+		if secrets.ClientKeyPassword != "" {
+			tlsOpts["tlsCertificateKeyFilePassword"] = secrets.ClientKeyPassword
+		}
 	}
 
 	tlsConfig, err := options.BuildTLSConfig(tlsOpts)
@@ -144,6 +560,151 @@ func setupTls(config *models.PluginSettings, opts *options.ClientOptions) error
 		return err
 	}
 
+	if secrets.CaCert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(secrets.CaCert)) {
+			return errors.New("no certificate found in the CA certificate")
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if secrets.ClientCert != "" {
+		cert, err := clientCertificate(secrets.ClientCert, secrets.ClientKey, secrets.ClientKeyPassword)
+		if err != nil {
+			return err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	relaxTlsValidation(config, tlsConfig)
+
 	opts.SetTLSConfig(tlsConfig)
 	return nil
 }
+
+// relaxTlsValidation applies the tlsInsecure, tlsAllowInvalidCertificates and
+// tlsAllowInvalidHostnames settings to the TLS config
+func relaxTlsValidation(config *models.PluginSettings, tlsConfig *tls.Config) {
+	if config.TlsInsecure || config.TlsAllowInvalidCertificates {
+		backend.Logger.Warn("TLS certificate validation is DISABLED, the connection to MongoDB is vulnerable to man-in-the-middle attacks",
+			"tlsInsecure", config.TlsInsecure, "tlsAllowInvalidCertificates", config.TlsAllowInvalidCertificates)
+
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = nil
+		return
+	}
+
+	if config.TlsAllowInvalidHostnames {
+		backend.Logger.Warn("TLS hostname validation is DISABLED, any server with a trusted certificate is accepted as the MongoDB server",
+			"tlsAllowInvalidHostnames", true)
+
+		// Go can't skip only the hostname check, so the chain is verified here instead
+		roots := tlsConfig.RootCAs
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyCertificateChain(state, roots)
+		}
+	}
+}
+
+// verifyCertificateChain verifies the server certificate against the roots, or the system
+// roots if nil, without checking the hostname
+func verifyCertificateChain(state tls.ConnectionState, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("the server presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// clientCertificate loads a client certificate and its key from PEM text. The key may be
+// part of the certificate text, and may be encrypted with the PEM DEK-Info or PKCS #8 schemes
+func clientCertificate(certPem string, keyPem string, password string) (tls.Certificate, error) {
+	var certBlocks, keyBlocks []*pem.Block
+
+	rest := []byte(certPem + "\n" + keyPem)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if block.Type == "CERTIFICATE" {
+			certBlocks = append(certBlocks, block)
+		} else if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			key, err := decryptKeyBlock(block, password)
+			if err != nil {
+				return tls.Certificate{}, err
+			}
+			keyBlocks = append(keyBlocks, key)
+		}
+	}
+
+	if len(certBlocks) == 0 {
+		return tls.Certificate{}, errors.New("no certificate found in the client certificate")
+	}
+
+	if len(keyBlocks) == 0 {
+		return tls.Certificate{}, errors.New("no private key found in the client key")
+	}
+
+	var certs, keys []byte
+	for _, b := range certBlocks {
+		certs = append(certs, pem.EncodeToMemory(b)...)
+	}
+	for _, b := range keyBlocks {
+		keys = append(keys, pem.EncodeToMemory(b)...)
+	}
+
+	cert, err := tls.X509KeyPair(certs, keys)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid client certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+func decryptKeyBlock(block *pem.Block, password string) (*pem.Block, error) {
+	//lint:ignore SA1019 legacy encrypted keys are still produced by openssl
+	legacy := x509.IsEncryptedPEMBlock(block)
+	if !legacy && block.Type != "ENCRYPTED PRIVATE KEY" {
+		return block, nil
+	}
+
+	if password == "" {
+		return nil, errors.New("the client key is encrypted, a client key password is required")
+	}
+
+	if legacy {
+		//lint:ignore SA1019 legacy encrypted keys are still produced by openssl
+		der, err := x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the client key: %w", err)
+		}
+		return &pem.Block{Type: block.Type, Bytes: der}, nil
+	}
+
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the client key: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+}
@@ -0,0 +1,228 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	previewDefaultSampleSize = 20
+	previewMaxSampleSize     = 1000
+	// Time limit of each aggregation run by a preview
+	previewMaxTime = 10 * time.Second
+	// Max number of documents counted per stage, larger counts are reported as at least the cap
+	previewMaxCount = 10000
+)
+
+// previewRequest is the body of the pipeline preview endpoint
+type previewRequest struct {
+	Collection string `json:"collection"`
+	QueryText  string `json:"queryText"`
+	// Defaults to JSON
+	QueryLanguage string `json:"queryLanguage"`
+	// Index of the last stage to run, starting at 0
+	Stage        int           `json:"stage"`
+	SampleSize   int           `json:"sampleSize"`
+	AdhocFilters []adhocFilter `json:"adhocFilters"`
+	// Time range in epoch milliseconds, used by the macros
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+type previewStageCount struct {
+	Stage int    `json:"stage"`
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+	// The stage outputs at least Count documents
+	Capped bool `json:"capped"`
+}
+
+type previewResult struct {
+	Frames []*data.Frame       `json:"frames"`
+	Counts []previewStageCount `json:"counts"`
+}
+
+// truncatePipeline keeps the stages up to and including the given one. Stages writing
+// to collections are rejected, a preview must not have side effects
+func truncatePipeline(pipeline []bson.D, stage int) ([]bson.D, error) {
+	if stage < 0 || stage >= len(pipeline) {
+		return nil, fmt.Errorf("stage should be between 0 and %d", len(pipeline)-1)
+	}
+
+	truncated := pipeline[:stage+1]
+	for _, s := range truncated {
+		if len(s) == 1 && (s[0].Key == "$out" || s[0].Key == "$merge") {
+			return nil, fmt.Errorf("stage %s can't be previewed", s[0].Key)
+		}
+	}
+
+	return truncated, nil
+}
+
+// withStage returns a copy of the pipeline with the stage appended
+func withStage(pipeline []bson.D, stage bson.D) []bson.D {
+	result := make([]bson.D, 0, len(pipeline)+1)
+	result = append(result, pipeline...)
+	return append(result, stage)
+}
+
+// preparePreviewPipeline turns the first stages of the user's pipeline into an executable pipeline.
+// Ad-hoc filters are left out when their placeholder comes after the truncated stages
+func preparePreviewPipeline(stages []bson.D, placeholder bool, req *previewRequest) ([]bson.D, error) {
+	filters := req.AdhocFilters
+	if placeholder && !hasAdhocPlaceholder(stages) {
+		filters = nil
+	}
+
+	pipeline, err := applyAdhocFilters(stages, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Requests without a time range keep the time macros
+	if req.To != 0 {
+		pipeline = applyMacros(pipeline, time.UnixMilli(req.From), time.UnixMilli(req.To))
+	}
+
+	return pipeline, nil
+}
+
+func hasAdhocPlaceholder(pipeline []bson.D) bool {
+	for _, stage := range pipeline {
+		if isAdhocPlaceholder(stage) {
+			return true
+		}
+	}
+	return false
+}
+
+// countPipeline returns the pipeline counting the documents of the pipeline, up to previewMaxCount
+func countPipeline(pipeline []bson.D) []bson.D {
+	return withStage(withStage(pipeline, bson.D{{Key: "$limit", Value: previewMaxCount}}), bson.D{{Key: "$count", Value: "count"}})
+}
+
+// countStage counts the documents the pipeline outputs, up to previewMaxCount
+func (d *Datasource) countStage(ctx context.Context, collection string, pipeline []bson.D) (int64, error) {
+	cursor, err := d.client.Database(d.database).Collection(collection).Aggregate(ctx,
+		countPipeline(pipeline),
+		options.Aggregate().SetMaxTime(previewMaxTime))
+	if err != nil {
+		return 0, err
+	}
+
+	defer cursor.Close(ctx)
+
+	// $count outputs nothing when there are no documents
+	if !cursor.Next(ctx) {
+		return 0, cursor.Err()
+	}
+
+	count, ok := cursor.Current.Lookup("count").AsInt64OK()
+	if !ok {
+		return 0, fmt.Errorf("unexpected $count result %s", cursor.Current)
+	}
+
+	return count, nil
+}
+
+func (d *Datasource) previewHandler(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	var body previewRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(rw, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	if body.Collection == "" {
+		http.Error(rw, "collection is required", http.StatusBadRequest)
+		return
+	}
+
+	if body.SampleSize == 0 {
+		body.SampleSize = previewDefaultSampleSize
+	}
+
+	if body.SampleSize < 0 || body.SampleSize > previewMaxSampleSize {
+		http.Error(rw, fmt.Sprintf("sampleSize should be between 1 and %d", previewMaxSampleSize), http.StatusBadRequest)
+		return
+	}
+
+	stages, err := parseQueryText(body.QueryText, body.QueryLanguage, d.serverVersion(ctx))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	placeholder := hasAdhocPlaceholder(stages)
+
+	stages, err = truncatePipeline(stages, body.Stage)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := previewResult{
+		Counts: make([]previewStageCount, 0, len(stages)),
+	}
+
+	for i, stage := range stages {
+		pipeline, err := preparePreviewPipeline(stages[:i+1], placeholder, &body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		count, err := d.countStage(ctx, body.Collection, pipeline)
+		if err != nil {
+			backend.Logger.Error("Failed to count stage documents", "collection", body.Collection, "stage", i, "error", err)
+			http.Error(rw, fmt.Sprintf("stage %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+
+		result.Counts = append(result.Counts, previewStageCount{
+			Stage:  i,
+			Name:   stage[0].Key,
+			Count:  count,
+			Capped: count >= previewMaxCount,
+		})
+	}
+
+	pipeline, err := preparePreviewPipeline(stages, placeholder, &body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := d.client.Database(d.database).Collection(body.Collection).Aggregate(ctx,
+		withStage(pipeline, bson.D{{Key: "$limit", Value: body.SampleSize}}),
+		options.Aggregate().SetMaxTime(previewMaxTime))
+	if err != nil {
+		backend.Logger.Error("Failed to execute preview", "collection", body.Collection, "error", err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer cursor.Close(ctx)
+
+	frame, err := createTableFramesFromQuery(ctx, body.Collection, cursor)
+	if err != nil {
+		backend.Logger.Error("Failed to create data frame from preview", "error", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result.Frames = []*data.Frame{frame}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(result)
+}
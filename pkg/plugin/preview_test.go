@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTruncatePipeline(t *testing.T) {
+	pipeline := []bson.D{
+		{{Key: "$match", Value: bson.D{{Key: "a", Value: 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "b", Value: 1}}}},
+		{{Key: "$out", Value: "target"}},
+	}
+
+	t.Run("should keep stages up to the given one", func(t *testing.T) {
+		truncated, err := truncatePipeline(pipeline, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, truncated, pipeline[:2])
+	})
+
+	t.Run("should reject out of range stage", func(t *testing.T) {
+		if _, err := truncatePipeline(pipeline, 3); err == nil {
+			t.Error("expected an error")
+		}
+		if _, err := truncatePipeline(pipeline, -1); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("should reject writing stages", func(t *testing.T) {
+		if _, err := truncatePipeline(pipeline, 2); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestWithStage(t *testing.T) {
+	pipeline := make([]bson.D, 1, 2)
+	pipeline[0] = bson.D{{Key: "$match", Value: bson.D{}}}
+
+	limited := withStage(pipeline, bson.D{{Key: "$limit", Value: 10}})
+	counted := withStage(pipeline, bson.D{{Key: "$count", Value: "count"}})
+
+	assertEq(t, limited[1][0].Key, "$limit")
+	assertEq(t, counted[1][0].Key, "$count")
+	assertEq(t, len(pipeline), 1)
+}
+
+func TestCountPipeline(t *testing.T) {
+	pipeline := []bson.D{{{Key: "$match", Value: bson.D{}}}}
+
+	assertEq(t, countPipeline(pipeline), []bson.D{
+		{{Key: "$match", Value: bson.D{}}},
+		{{Key: "$limit", Value: previewMaxCount}},
+		{{Key: "$count", Value: "count"}},
+	})
+}
+
+func TestPreparePreviewPipeline(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	req := &previewRequest{
+		AdhocFilters: []adhocFilter{{Key: "host", Operator: "=", Value: "a"}},
+		From:         from.UnixMilli(),
+		To:           to.UnixMilli(),
+	}
+
+	stages := []bson.D{
+		{{Key: "$match", Value: bson.D{{Key: "ts", Value: bson.D{{Key: "$gte", Value: macroTimeFrom}}}}}},
+		{{Key: adhocFiltersStage, Value: bson.D{}}},
+		{{Key: "$limit", Value: 5}},
+	}
+
+	t.Run("should leave out filters placed after the truncated stages", func(t *testing.T) {
+		pipeline, err := preparePreviewPipeline(stages[:1], true, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, len(pipeline), 1)
+		assertEq(t, pipeline[0], bson.D{{Key: "$match", Value: bson.D{{Key: "ts", Value: bson.D{{Key: "$gte", Value: from}}}}}})
+	})
+
+	t.Run("should apply filters at the placeholder", func(t *testing.T) {
+		pipeline, err := preparePreviewPipeline(stages, true, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, len(pipeline), 3)
+		assertEq(t, pipeline[1][0].Key, "$match")
+	})
+
+	t.Run("should apply filters first without placeholder", func(t *testing.T) {
+		pipeline, err := preparePreviewPipeline(stages[2:], false, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, len(pipeline), 2)
+		assertEq(t, pipeline[0][0].Key, "$match")
+	})
+
+	t.Run("should keep the time macros without time range", func(t *testing.T) {
+		pipeline, err := preparePreviewPipeline(stages[:1], true, &previewRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, pipeline[0], bson.D{{Key: "$match", Value: bson.D{{Key: "ts", Value: bson.D{{Key: "$gte", Value: macroTimeFrom}}}}}})
+	})
+}
@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/proxy"
+)
+
+// contextDialer is implemented by the dialer of the secure socks proxy
+type contextDialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// secureSocksDialer returns the dialer of the Grafana secure socks proxy, which is used by
+// Private Data Source Connect. It's nil if the datasource doesn't use the proxy
+func secureSocksDialer(ctx context.Context, source backend.DataSourceInstanceSettings) (dialFunc, error) {
+	proxyOpts, err := source.ProxyOptionsFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secure socks proxy settings: %w", err)
+	}
+
+	if proxyOpts == nil || !proxyOpts.Enabled {
+		return nil, nil
+	}
+
+	if proxyOpts.ClientCfg == nil {
+		return nil, errors.New("secure socks proxy is enabled on the datasource but not on the Grafana server")
+	}
+
+	dialer, err := proxy.New(proxyOpts).NewSecureSocksProxyContextDialer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secure socks proxy dialer: %w", err)
+	}
+
+	d, ok := dialer.(contextDialer)
+	if !ok {
+		return nil, errors.New("secure socks proxy dialer doesn't support contexts")
+	}
+
+	backend.Logger.Debug("Using secure socks proxy", "datasource", source.UID)
+
+	return d.DialContext, nil
+}
@@ -0,0 +1,197 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/proxy"
+	"github.com/haohanyang/mongodb-datasource/pkg/models"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// startSocksServer returns the address of a SOCKS5 server accepting the username and password.
+// It counts the connections it forwards
+func startSocksServer(t *testing.T, username string, password string, count *atomic.Int32) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks(conn, username, password, count)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveSocks(conn net.Conn, username string, password string, count *atomic.Int32) {
+	defer conn.Close()
+
+	// Greeting, the client must offer username/password authentication
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	// Username/password authentication, RFC 1929
+	readField := func() string {
+		n := make([]byte, 1)
+		io.ReadFull(conn, n)
+		field := make([]byte, n[0])
+		io.ReadFull(conn, field)
+		return string(field)
+	}
+	io.ReadFull(conn, make([]byte, 1))
+	if readField() != username || readField() != password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// Connect request with an IPv4 address or a domain name
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		host = readField()
+	default:
+		return
+	}
+
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+
+	count.Add(1)
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func socksContext(address string) context.Context {
+	return backend.WithGrafanaConfig(context.Background(), backend.NewGrafanaCfg(map[string]string{
+		proxy.PluginSecureSocksProxyEnabled:       "true",
+		proxy.PluginSecureSocksProxyAllowInsecure: "true",
+		proxy.PluginSecureSocksProxyProxyAddress:  address,
+	}))
+}
+
+func socksSettings() backend.DataSourceInstanceSettings {
+	return backend.DataSourceInstanceSettings{
+		UID:      "mongo-uid",
+		JSONData: []byte(`{"enableSecureSocksProxy": true}`),
+		DecryptedSecureJSONData: map[string]string{
+			"secureSocksProxyPassword": "token",
+		},
+	}
+}
+
+func TestSecureSocksDialer(t *testing.T) {
+	echo := startEchoServer(t)
+
+	t.Run("should return nil when the proxy is disabled", func(t *testing.T) {
+		settings := socksSettings()
+		settings.JSONData = []byte(`{}`)
+
+		dial, err := secureSocksDialer(socksContext("127.0.0.1:1"), settings)
+		if err != nil || dial != nil {
+			t.Fatalf("expected no dialer, got %v", err)
+		}
+	})
+
+	t.Run("should return error when the proxy is disabled on Grafana", func(t *testing.T) {
+		_, err := secureSocksDialer(context.Background(), socksSettings())
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+	})
+
+	t.Run("should dial through the proxy", func(t *testing.T) {
+		var count atomic.Int32
+		address := startSocksServer(t, "mongo-uid", "token", &count)
+
+		dial, err := secureSocksDialer(socksContext(address), socksSettings())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts := options.Client()
+		if _, err := setDialer(&models.PluginSettings{}, opts, dial); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := opts.Dialer.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("expected ping, got %s, %v", buf, err)
+		}
+
+		if count.Load() != 1 {
+			t.Errorf("expected 1 proxied connection, got %d", count.Load())
+		}
+	})
+
+	t.Run("should open the ssh tunnel through the proxy", func(t *testing.T) {
+		var count atomic.Int32
+		address := startSocksServer(t, "mongo-uid", "token", &count)
+		server := newTestSSHServer(t, "secret", nil)
+
+		dial, err := secureSocksDialer(socksContext(address), socksSettings())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts := options.Client()
+		tunnel, err := setDialer(server.settings(), opts, dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+
+		assertEcho(t, tunnel, echo)
+
+		// Only the ssh connection goes through the proxy
+		if count.Load() != 1 {
+			t.Errorf("expected 1 proxied connection, got %d", count.Load())
+		}
+	})
+}
@@ -2,7 +2,14 @@ package plugin
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/haohanyang/mongodb-datasource/pkg/models"
@@ -11,133 +18,337 @@ import (
 )
 
 func createTableFramesFromQuery(ctx context.Context, tableName string, cursor *mongo.Cursor) (*data.Frame, error) {
-
-	columns := make(map[string]*models.Column)
-	rowIndex := 0
+	builder := newTableFrameBuilder()
 	for cursor.Next(ctx) {
 		var result bson.Raw
 		if err := cursor.Decode(&result); err != nil {
 			return nil, err
 		}
 
-		elements, err := result.Elements()
-		if err != nil {
+		if err := builder.append(result); err != nil {
 			return nil, err
 		}
+	}
 
-		for _, element := range elements {
-			name := element.Key()
-			if c, ok := columns[name]; ok {
-				err = c.AppendValue(element.Value())
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				if element.Value().Type == bson.TypeNull {
-					continue
-				}
-				nc, err := models.NewColumn(rowIndex, element)
-				if err != nil {
-					return nil, err
-				}
-				columns[name] = nc
-			}
-		}
+	return builder.frame(tableName), nil
+}
 
-		// Make sure all columns have the same size
-		for _, c := range columns {
-			// Pad other columns with null value
-			if c.Size() != rowIndex+1 {
-				c.Field.Append(nil)
+// tableFrameBuilder converts documents to table columns row by row
+type tableFrameBuilder struct {
+	columns map[string]*models.Column
+	// Column names in the order they were first seen, so that frames have a stable field order
+	names    []string
+	rowIndex int
+}
+
+func newTableFrameBuilder() *tableFrameBuilder {
+	return &tableFrameBuilder{
+		columns: make(map[string]*models.Column),
+	}
+}
+
+func (b *tableFrameBuilder) append(result bson.Raw) error {
+	elements, err := result.Elements()
+	if err != nil {
+		return err
+	}
+
+	for _, element := range elements {
+		name := element.Key()
+		if c, ok := b.columns[name]; ok {
+			err = c.AppendValue(element.Value())
+			if err != nil {
+				return err
+			}
+		} else {
+			if element.Value().Type == bson.TypeNull {
+				continue
+			}
+			nc, err := models.NewColumn(b.rowIndex, element)
+			if err != nil {
+				return err
 			}
+			b.columns[name] = nc
+			b.names = append(b.names, name)
 		}
+	}
 
-		rowIndex++
+	// Make sure all columns have the same size
+	for _, c := range b.columns {
+		// Pad other columns with null value
+		if c.Size() != b.rowIndex+1 {
+			c.Field.Append(nil)
+		}
 	}
 
+	b.rowIndex++
+	return nil
+}
+
+func (b *tableFrameBuilder) rows() int {
+	return b.rowIndex
+}
+
+// frame builds the data frame. The builder should not be appended to afterwards
+func (b *tableFrameBuilder) frame(tableName string) *data.Frame {
 	frame := data.NewFrame(tableName)
 
-	if c, ok := columns["_id"]; ok {
+	if c, ok := b.columns["_id"]; ok {
 		frame.Fields = append(frame.Fields, c.Field)
 	}
 
-	for _, c := range columns {
-		if c.Name != "_id" {
+	for _, name := range b.names {
+		if name != "_id" {
+			c := b.columns[name]
 			c.Rectify()
 			frame.Fields = append(frame.Fields, c.Field)
 		}
 	}
 
-	return frame, nil
+	return frame
+}
+
+// queryKey identifies a query by database, collection, normalised pipeline, options and time range
+func queryKey(database string, qm *queryModel, pipeline []bson.D, from time.Time, to time.Time) (string, error) {
+	// Canonical extended JSON drops the formatting of the original query text
+	normalized, err := bson.MarshalExtJSON(bson.D{{Key: "pipeline", Value: pipeline}}, true, false)
+	if err != nil {
+		return "", err
+	}
+
+	k, err := json.Marshal(struct {
+		Database   string           `json:"database"`
+		Collection string           `json:"collection"`
+		Pipeline   json.RawMessage  `json:"pipeline"`
+		Options    aggregateOptions `json:"options"`
+		From       int64            `json:"from"`
+		To         int64            `json:"to"`
+	}{
+		Database:   database,
+		Collection: qm.Collection,
+		Pipeline:   normalized,
+		Options:    qm.aggregateOptions,
+		From:       from.UnixMilli(),
+		To:         to.UnixMilli(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(k)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+const (
+	variableDefaultLimit = 1000
+	variableMaxLimit     = 100000
+)
+
+// variablePipeline returns the pipeline of a variable query. The distinct mode lists the
+// values of a field, optionally among the documents matching a filter
+func variablePipeline(req *variableQueryRequest) ([]bson.D, error) {
+	switch req.Mode {
+	case variableModePipeline:
+		var pipeline []bson.D
+		if err := bson.UnmarshalExtJSON([]byte(req.Query), false, &pipeline); err != nil {
+			return nil, err
+		}
+		return pipeline, nil
+
+	case variableModeDistinct:
+		if req.Field == "" {
+			return nil, fmt.Errorf("field is required")
+		}
+
+		pipeline := make([]bson.D, 0, 5)
+		if strings.TrimSpace(req.Filter) != "" {
+			var filter bson.D
+			if err := bson.UnmarshalExtJSON([]byte(req.Filter), false, &filter); err != nil {
+				return nil, fmt.Errorf("invalid filter: %v", err)
+			}
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: filter}})
+		}
+
+		// Arrays are expanded by queryVariable, the sort makes truncated results stable
+		return append(pipeline,
+			bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$" + req.Field}}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+			bson.D{{Key: "$limit", Value: req.Limit + 1}},
+			bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: 0}, {Key: "value", Value: "$_id"}}}},
+		), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported variable query mode %s", req.Mode)
+	}
 }
 
-func queryVariable(ctx context.Context, cursor *mongo.Cursor) ([]variableQueryEntry, error) {
-	results := make([]variableQueryEntry, 0)
+// queryVariable reads the variable values from the query results. It stops after limit values
+// and reports whether there were more, a limit of 0 reads all results
+func queryVariable(ctx context.Context, cursor *mongo.Cursor, format variableFormat, limit int) ([]variableQueryEntry, bool, error) {
+	valuePath := strings.Split(defaultString(format.ValueField, "value"), ".")
+	textPath := strings.Split(defaultString(format.TextField, "text"), ".")
+	dateFormat := defaultString(format.DateFormat, time.RFC3339)
+
+	entries := make([]variableEntry, 0)
+	seen := map[string]bool{}
+
+	add := func(value bson.RawValue, text bson.RawValue) {
+		e, ok := newVariableEntry(value, dateFormat)
+		if !ok {
+			return
+		}
+
+		// Values of different types may look the same, e.g. "1" and 1
+		key := fmt.Sprintf("%d:%s", e.rank, e.key)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+
+		if t, ok := newVariableEntry(text, dateFormat); ok {
+			e.Text = t.Text
+		}
+
+		entries = append(entries, e)
+	}
+
+	truncated := false
 
 	// Parse results row by row
-	// The value is either string or int32/int64/float64
 	for cursor.Next(ctx) {
+		if limit > 0 && len(entries) > limit {
+			truncated = true
+			break
+		}
+
 		var result bson.Raw
 		if err := cursor.Decode(&result); err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
-		// Get text(label)
-		var text *string
-
-		textRaw := result.Lookup("text")
-		if textRaw.Type == bson.TypeString {
-			text = pointer(textRaw.StringValue())
+		valueRaw, err := result.LookupErr(valuePath...)
+		if err != nil {
+			continue
 		}
+		textRaw, _ := result.LookupErr(textPath...)
 
-		// Check value
-		valueRaw := result.Lookup("value")
-		if valueRaw.Type == bson.TypeString {
+		// An array expands into one entry per element. Its text is paired by index
+		// when the text is an array too
+		if valueRaw.Type == bson.TypeArray {
+			values, _ := valueRaw.Array().Values()
 
-			strVal := valueRaw.StringValue()
+			var texts []bson.RawValue
+			if textRaw.Type == bson.TypeArray {
+				texts, _ = textRaw.Array().Values()
+			}
 
-			if text == nil {
-				text = pointer(strVal)
+			for i, v := range values {
+				var t bson.RawValue
+				if i < len(texts) {
+					t = texts[i]
+				}
+				add(v, t)
 			}
+			continue
+		}
 
-			results = append(results, variableQueryEntry{
-				Value: strVal,
-				Text:  *text,
-			})
+		add(valueRaw, textRaw)
+	}
 
-		} else if valueRaw.Type == bson.TypeInt32 {
-			intVav := valueRaw.Int32()
-			if text == nil {
-				text = pointer(fmt.Sprintf("%d", intVav))
-			}
+	if err := cursor.Err(); err != nil {
+		return nil, false, err
+	}
 
-			results = append(results, variableQueryEntry{
-				Value: intVav,
-				Text:  *text,
-			})
-		} else if valueRaw.Type == bson.TypeInt64 {
-			intVav := valueRaw.Int64()
-		
-			if text == nil {
-				text = pointer(fmt.Sprintf("%d", intVav))
-			}
-		
-			results = append(results, variableQueryEntry{
-				Value: intVav,
-				Text:  *text,
-			})
-		} else if valueRaw.Type == bson.TypeDouble {
-			floatVal := valueRaw.Double()
-			if text == nil {
-				text = pointer(fmt.Sprintf("%f", floatVal))
-			}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+		truncated = true
+	}
 
-			results = append(results, variableQueryEntry{
-				Value: floatVal,
-				Text:  *text,
-			})
+	switch format.Sort {
+	case variableSortAsc:
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].less(&entries[j]) })
+	case variableSortDesc:
+		sort.SliceStable(entries, func(i, j int) bool { return entries[j].less(&entries[i]) })
+	}
+
+	results := make([]variableQueryEntry, len(entries))
+	for i, e := range entries {
+		results[i] = e.variableQueryEntry
+	}
+
+	return results, truncated, nil
+}
+
+// variableEntry is a variable value with the keys used to deduplicate and sort it
+type variableEntry struct {
+	variableQueryEntry
+	// Sorts values of different types in a fixed order: numbers, strings, ObjectIds,
+	// booleans then dates
+	rank int
+	num  float64
+	key  string
+}
+
+// newVariableEntry converts a scalar BSON value to a variable entry. ObjectIds, dates
+// and decimals are returned as strings as they have no JSON equivalent
+func newVariableEntry(v bson.RawValue, dateFormat string) (variableEntry, bool) {
+	switch v.Type {
+	case bson.TypeString:
+		s := v.StringValue()
+		return variableEntry{variableQueryEntry{s, s}, 1, 0, s}, true
+
+	case bson.TypeInt32:
+		i := v.Int32()
+		return variableEntry{variableQueryEntry{i, fmt.Sprintf("%d", i)}, 0, float64(i), fmt.Sprint(i)}, true
+
+	case bson.TypeInt64:
+		i := v.Int64()
+		return variableEntry{variableQueryEntry{i, fmt.Sprintf("%d", i)}, 0, float64(i), fmt.Sprint(i)}, true
+
+	case bson.TypeDouble:
+		f := v.Double()
+		return variableEntry{variableQueryEntry{f, fmt.Sprintf("%f", f)}, 0, f, fmt.Sprint(f)}, true
+
+	case bson.TypeDecimal128:
+		s := v.Decimal128().String()
+		f, _ := strconv.ParseFloat(s, 64)
+		return variableEntry{variableQueryEntry{s, s}, 0, f, s}, true
+
+	case bson.TypeObjectID:
+		s := v.ObjectID().Hex()
+		return variableEntry{variableQueryEntry{s, s}, 2, 0, s}, true
+
+	case bson.TypeBoolean:
+		b := v.Boolean()
+		num := 0.0
+		if b {
+			num = 1
 		}
+		return variableEntry{variableQueryEntry{b, strconv.FormatBool(b)}, 3, num, strconv.FormatBool(b)}, true
+
+	case bson.TypeDateTime:
+		t := v.Time().UTC()
+		s := t.Format(dateFormat)
+		return variableEntry{variableQueryEntry{s, s}, 4, float64(t.UnixMilli()), s}, true
+
+	default:
+		return variableEntry{}, false
 	}
+}
 
-	return results, nil
+func (e *variableEntry) less(other *variableEntry) bool {
+	if e.rank != other.rank {
+		return e.rank < other.rank
+	}
+	if e.num != other.num {
+		return e.num < other.num
+	}
+	return e.key < other.key
+}
+
+func defaultString(s string, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
 }
@@ -270,6 +270,31 @@ func TestCreateTableFramesFromQuery(t *testing.T) {
 		assertEq(t, frames.Fields[0].Name, "_id")
 	})
 
+	t.Run("should keep the field order of the documents", func(t *testing.T) {
+		ctx := context.Background()
+		toInsert := []interface{}{
+			bson.D{{Key: "z", Value: 1}, {Key: "a", Value: 2}, {Key: "_id", Value: 3}},
+			bson.D{{Key: "m", Value: 4}, {Key: "a", Value: 5}},
+		}
+
+		for range 10 {
+			cursor, err := mongo.NewCursorFromDocuments(toInsert, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			frame, err := createTableFramesFromQuery(ctx, "test", cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := make([]string, 0, len(frame.Fields))
+			for _, field := range frame.Fields {
+				names = append(names, field.Name)
+			}
+			assertEq(t, names, []string{"_id", "z", "a", "m"})
+		}
+	})
 }
 
 func TestQueryVariable(t *testing.T) {
@@ -289,7 +314,7 @@ func TestQueryVariable(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		results, err := queryVariable(ctx, cursor)
+		results, _, err := queryVariable(ctx, cursor, variableFormat{}, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -321,7 +346,7 @@ func TestQueryVariable(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		results, err := queryVariable(ctx, cursor)
+		results, _, err := queryVariable(ctx, cursor, variableFormat{}, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -353,7 +378,7 @@ func TestQueryVariable(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		results, err := queryVariable(ctx, cursor)
+		results, _, err := queryVariable(ctx, cursor, variableFormat{}, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -389,7 +414,7 @@ func TestQueryVariable(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		results, err := queryVariable(ctx, cursor)
+		results, _, err := queryVariable(ctx, cursor, variableFormat{}, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -405,4 +430,153 @@ func TestQueryVariable(t *testing.T) {
 		}
 	})
 
+	t.Run("other value types", func(t *testing.T) {
+		ctx := context.Background()
+		oid, _ := primitive.ObjectIDFromHex("65a1b2c3d4e5f60718293a4b")
+		dec, _ := primitive.ParseDecimal128("12.50")
+		date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		toInsert := []interface{}{
+			bson.M{"value": oid},
+			bson.M{"value": true, "text": "yes"},
+			bson.M{"value": date},
+			bson.M{"value": dec},
+			bson.M{"value": bson.A{"a", "b"}, "text": bson.A{"A"}},
+			bson.M{"value": bson.M{"nested": 1}},
+		}
+		cursor, err := mongo.NewCursorFromDocuments(toInsert, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results, _, err := queryVariable(ctx, cursor, variableFormat{DateFormat: "2006-01-02"}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, results, []variableQueryEntry{
+			{Value: "65a1b2c3d4e5f60718293a4b", Text: "65a1b2c3d4e5f60718293a4b"},
+			{Value: true, Text: "yes"},
+			{Value: "2024-01-02", Text: "2024-01-02"},
+			{Value: "12.50", Text: "12.50"},
+			{Value: "a", Text: "A"},
+			{Value: "b", Text: "b"},
+		})
+	})
+
+	t.Run("custom field paths", func(t *testing.T) {
+		ctx := context.Background()
+		toInsert := []interface{}{
+			bson.M{"host": bson.M{"id": "h1", "name": "Host 1"}},
+			bson.M{"host": bson.M{"id": "h2"}},
+			bson.M{"other": "h3"},
+		}
+		cursor, err := mongo.NewCursorFromDocuments(toInsert, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results, _, err := queryVariable(ctx, cursor, variableFormat{ValueField: "host.id", TextField: "host.name"}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, results, []variableQueryEntry{
+			{Value: "h1", Text: "Host 1"},
+			{Value: "h2", Text: "h2"},
+		})
+	})
+
+	t.Run("deduplicate and sort mixed types", func(t *testing.T) {
+		ctx := context.Background()
+		toInsert := []interface{}{
+			bson.M{"value": "b"},
+			bson.M{"value": int32(10)},
+			bson.M{"value": "1"},
+			bson.M{"value": bson.A{int32(10), 2.5, "b"}},
+			bson.M{"value": false},
+			bson.M{"value": "a"},
+		}
+		cursor, err := mongo.NewCursorFromDocuments(toInsert, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results, _, err := queryVariable(ctx, cursor, variableFormat{Sort: variableSortAsc}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, results, []variableQueryEntry{
+			{Value: 2.5, Text: "2.500000"},
+			{Value: int32(10), Text: "10"},
+			{Value: "1", Text: "1"},
+			{Value: "a", Text: "a"},
+			{Value: "b", Text: "b"},
+			{Value: false, Text: "false"},
+		})
+	})
+
+	t.Run("limit values", func(t *testing.T) {
+		ctx := context.Background()
+		toInsert := []interface{}{
+			bson.M{"value": bson.A{"a", "b"}},
+			bson.M{"value": "c"},
+		}
+		cursor, err := mongo.NewCursorFromDocuments(toInsert, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results, truncated, err := queryVariable(ctx, cursor, variableFormat{}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, len(results), 2)
+		assertEq(t, truncated, true)
+	})
+
+}
+
+func TestVariablePipeline(t *testing.T) {
+	t.Run("should list the distinct values of a field", func(t *testing.T) {
+		pipeline, err := variablePipeline(&variableQueryRequest{
+			Mode:   variableModeDistinct,
+			Field:  "host",
+			Filter: `{"ts": {"$gte": "$__timeFrom"}}`,
+			Limit:  10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		text, err := formatPipeline(pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, text, `[
+  {"$match":{"ts":{"$gte":"$__timeFrom"}}},
+  {"$group":{"_id":"$host"}},
+  {"$sort":{"_id":1}},
+  {"$limit":11},
+  {"$project":{"_id":0,"value":"$_id"}}
+]`)
+	})
+
+	t.Run("should require a field", func(t *testing.T) {
+		if _, err := variablePipeline(&variableQueryRequest{Mode: variableModeDistinct}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("should parse the query text", func(t *testing.T) {
+		pipeline, err := variablePipeline(&variableQueryRequest{Query: `[{"$limit": 1}]`})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, len(pipeline), 1)
+	})
 }
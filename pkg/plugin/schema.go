@@ -0,0 +1,325 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/haohanyang/mongodb-datasource/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	schemaDefaultSampleSize = 100
+	schemaMaxSampleSize     = 1000
+	schemaCacheTTL          = 5 * time.Minute
+	// Max number of distinct example values kept per field
+	schemaMaxExamples = 3
+)
+
+// collectionSchema is the response of the schema inference endpoint
+type collectionSchema struct {
+	Collection string        `json:"collection"`
+	SampleSize int           `json:"sampleSize"`
+	Fields     []schemaField `json:"fields"`
+}
+
+type schemaField struct {
+	Path string `json:"path"`
+	// Number of sampled values with this path
+	Count int `json:"count"`
+	// BSON types seen and their frequencies
+	Types             map[string]int    `json:"types"`
+	ArrayElementTypes map[string]int    `json:"arrayElementTypes,omitempty"`
+	Examples          []json.RawMessage `json:"examples,omitempty"`
+	// Type of the data frame field the values are converted to
+	FieldType   string `json:"fieldType,omitempty"`
+	GrafanaType string `json:"grafanaType,omitempty"`
+	// The values can't be converted to a single data frame field
+	Conflict bool `json:"conflict,omitempty"`
+}
+
+// schemaInferrer collects field statistics from sampled documents
+type schemaInferrer struct {
+	docs     int
+	fields   map[string]*schemaField
+	columns  map[string]*models.Column
+	examples map[string]map[string]bool
+}
+
+func newSchemaInferrer() *schemaInferrer {
+	return &schemaInferrer{
+		fields:   make(map[string]*schemaField),
+		columns:  make(map[string]*models.Column),
+		examples: make(map[string]map[string]bool),
+	}
+}
+
+func inferSchema(ctx context.Context, collection string, cursor *mongo.Cursor) (*collectionSchema, error) {
+	inferrer := newSchemaInferrer()
+	for cursor.Next(ctx) {
+		if err := inferrer.addDocument(cursor.Current, ""); err != nil {
+			return nil, err
+		}
+		inferrer.docs++
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return inferrer.schema(collection), nil
+}
+
+func (s *schemaInferrer) addDocument(doc bson.Raw, prefix string) error {
+	elements, err := doc.Elements()
+	if err != nil {
+		return err
+	}
+
+	for _, element := range elements {
+		path := prefix + element.Key()
+		value := element.Value()
+
+		field, ok := s.fields[path]
+		if !ok {
+			field = &schemaField{
+				Path:  path,
+				Types: make(map[string]int),
+			}
+			s.fields[path] = field
+		}
+
+		field.Count++
+		field.Types[value.Type.String()]++
+
+		// Predict the data frame field type with the same conversion used for query results
+		if c, ok := s.columns[path]; ok {
+			if !field.Conflict && c.AppendValue(value) != nil {
+				field.Conflict = true
+			}
+		} else if value.Type != bson.TypeNull {
+			c, err := models.NewColumn(0, element)
+			if err != nil {
+				return err
+			}
+			s.columns[path] = c
+		}
+
+		switch value.Type {
+		case bson.TypeEmbeddedDocument:
+			if err := s.addDocument(value.Document(), path+"."); err != nil {
+				return err
+			}
+
+		case bson.TypeArray:
+			values, err := value.Array().Values()
+			if err != nil {
+				return err
+			}
+
+			if field.ArrayElementTypes == nil {
+				field.ArrayElementTypes = make(map[string]int)
+			}
+
+			for _, v := range values {
+				field.ArrayElementTypes[v.Type.String()]++
+
+				// Dotted paths reach into documents inside arrays
+				if v.Type == bson.TypeEmbeddedDocument {
+					if err := s.addDocument(v.Document(), path+"."); err != nil {
+						return err
+					}
+				}
+			}
+
+		case bson.TypeNull:
+
+		default:
+			if err := s.addExample(field, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *schemaInferrer) addExample(field *schemaField, value bson.RawValue) error {
+	if len(field.Examples) >= schemaMaxExamples {
+		return nil
+	}
+
+	example, err := rawValueToJson(value)
+	if err != nil {
+		return err
+	}
+
+	seen, ok := s.examples[field.Path]
+	if !ok {
+		seen = make(map[string]bool)
+		s.examples[field.Path] = seen
+	}
+
+	if !seen[string(example)] {
+		seen[string(example)] = true
+		field.Examples = append(field.Examples, example)
+	}
+
+	return nil
+}
+
+func (s *schemaInferrer) schema(collection string) *collectionSchema {
+	schema := &collectionSchema{
+		Collection: collection,
+		SampleSize: s.docs,
+		Fields:     make([]schemaField, 0, len(s.fields)),
+	}
+
+	for path, field := range s.fields {
+		if c, ok := s.columns[path]; ok && !field.Conflict {
+			c.Rectify()
+			field.FieldType = c.Type().ItemTypeString()
+			field.GrafanaType = grafanaType(c.Type())
+		}
+
+		schema.Fields = append(schema.Fields, *field)
+	}
+
+	sort.Slice(schema.Fields, func(i, j int) bool {
+		return schema.Fields[i].Path < schema.Fields[j].Path
+	})
+
+	return schema
+}
+
+// grafanaType maps a data frame field type to the field type name used by the Grafana frontend
+func grafanaType(t data.FieldType) string {
+	switch {
+	case t.Numeric():
+		return "number"
+	case t.Time():
+		return "time"
+	case t == data.FieldTypeNullableBool || t == data.FieldTypeBool:
+		return "boolean"
+	case t == data.FieldTypeNullableString || t == data.FieldTypeString:
+		return "string"
+	default:
+		return "other"
+	}
+}
+
+// sampleSchema samples documents of the collection and infers its fields.
+// Results are cached per collection and sample size
+func (d *Datasource) sampleSchema(ctx context.Context, collection string, size int) (*collectionSchema, error) {
+	key := fmt.Sprintf("%s/%d", collection, size)
+	if schema, ok := d.schemas.get(key); ok {
+		return schema, nil
+	}
+
+	pipeline := bson.A{bson.D{{Key: "$sample", Value: bson.D{{Key: "size", Value: size}}}}}
+
+	cursor, err := d.client.Database(d.database).Collection(collection).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	defer cursor.Close(ctx)
+
+	schema, err := inferSchema(ctx, collection, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	d.schemas.set(key, schema)
+
+	return schema, nil
+}
+
+func (d *Datasource) collectionSchemaHandler(rw http.ResponseWriter, req *http.Request) {
+	collection := req.PathValue("name")
+
+	size := schemaDefaultSampleSize
+	if s := req.URL.Query().Get("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > schemaMaxSampleSize {
+			http.Error(rw, fmt.Sprintf("size should be between 1 and %d", schemaMaxSampleSize), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	schema, err := d.sampleSchema(req.Context(), collection, size)
+	if err != nil {
+		backend.Logger.Error("Failed to infer collection schema", "collection", collection, "error", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(schema)
+}
+
+// ttlCache is a map whose entries expire after a fixed duration
+type ttlCache[V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]ttlCacheEntry[V]
+	now     func() time.Time
+}
+
+type ttlCacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+func newTTLCache[V any](ttl time.Duration) *ttlCache[V] {
+	return &ttlCache[V]{
+		ttl:     ttl,
+		entries: make(map[string]ttlCacheEntry[V]),
+		now:     time.Now,
+	}
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || c.now().After(entry.expiresAt) {
+		delete(c.entries, key)
+
+		var zero V
+		return zero, false
+	}
+
+	return entry.value, true
+}
+
+func (c *ttlCache[V]) set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+
+	// Drop expired entries so that the map doesn't grow with stale keys
+	for k, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = ttlCacheEntry[V]{
+		value:     value,
+		expiresAt: now.Add(c.ttl),
+	}
+}
@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestInferSchema(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	cursor := initCursorWithData([]interface{}{
+		bson.M{
+			"name":  "a",
+			"count": int32(1),
+			"ts":    primitive.NewDateTimeFromTime(now),
+			"tags":  bson.A{"x", "y"},
+			"meta":  bson.M{"host": "h1"},
+			"mixed": "foo",
+		},
+		bson.M{
+			"name":  "b",
+			"count": int64(2),
+			"tags":  bson.A{"z", int32(1)},
+			"meta":  bson.M{"host": "h2", "port": int32(80)},
+			"mixed": int32(1),
+		},
+		bson.M{
+			"name":  "a",
+			"count": nil,
+		},
+	}, t)
+
+	schema, err := inferSchema(ctx, "test", cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if schema.SampleSize != 3 {
+		t.Errorf("expected sample size 3, got %d", schema.SampleSize)
+	}
+
+	fields := make(map[string]schemaField)
+	paths := make([]string, 0)
+	for _, f := range schema.Fields {
+		fields[f.Path] = f
+		paths = append(paths, f.Path)
+	}
+
+	assertEq(t, paths, []string{"count", "meta", "meta.host", "meta.port", "mixed", "name", "tags", "ts"})
+
+	count := fields["count"]
+	assertEq(t, count.Types, map[string]int{"32-bit integer": 1, "64-bit integer": 1, "null": 1})
+	if count.FieldType != "*int64" || count.GrafanaType != "number" {
+		t.Errorf("unexpected count type %s/%s", count.FieldType, count.GrafanaType)
+	}
+
+	name := fields["name"]
+	if name.Count != 3 || len(name.Examples) != 2 {
+		t.Errorf("expected 3 values and 2 distinct examples for name, got %d and %d", name.Count, len(name.Examples))
+	}
+	if name.GrafanaType != "string" {
+		t.Errorf("expected name to be string, got %s", name.GrafanaType)
+	}
+
+	if fields["ts"].GrafanaType != "time" {
+		t.Errorf("expected ts to be time, got %s", fields["ts"].GrafanaType)
+	}
+
+	tags := fields["tags"]
+	assertEq(t, tags.ArrayElementTypes, map[string]int{"string": 3, "32-bit integer": 1})
+	if tags.FieldType != "*json.RawMessage" {
+		t.Errorf("expected tags to become json, got %s", tags.FieldType)
+	}
+
+	if fields["meta.host"].Count != 2 || fields["meta.port"].Count != 1 {
+		t.Error("unexpected nested field counts")
+	}
+
+	mixed := fields["mixed"]
+	if !mixed.Conflict || mixed.FieldType != "" {
+		t.Errorf("expected mixed to conflict, got %+v", mixed)
+	}
+}
+
+func TestTTLCache(t *testing.T) {
+	c := newTTLCache[int](time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.set("a", 1)
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Errorf("expected cached value 1, got %v", v)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.get("a"); ok {
+		t.Error("expected entry to expire")
+	}
+}
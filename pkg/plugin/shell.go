@@ -0,0 +1,595 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Options accepted by the mongosh methods, in an options document or as cursor modifiers
+var shellMethodOptions = map[string][]string{
+	"aggregate":      {"allowDiskUse", "batchSize", "comment", "hint", "maxTimeMS"},
+	"find":           {"allowDiskUse", "batchSize", "comment", "hint", "limit", "maxTimeMS", "projection", "skip", "sort"},
+	"countDocuments": {"comment", "hint", "limit", "maxTimeMS", "skip"},
+	"distinct":       {"comment", "maxTimeMS"},
+}
+
+// Cursor modifiers that don't change the result
+var shellNoopModifiers = map[string]bool{
+	"toArray": true,
+	"pretty":  true,
+}
+
+// shellQuery is a mongosh call chain, e.g. db.orders.find({...}).sort({ts: -1}).
+// Each call is a single-field document of the method name and its arguments, so that
+// macros can be applied and keys built the same way as for pipelines
+type shellQuery struct {
+	Collection string
+	Calls      []bson.D
+}
+
+// shellCommand is a validated shell query ready to run
+type shellCommand struct {
+	method   string
+	pipeline []bson.D
+	filter   bson.D
+	field    string
+	opts     shellOptions
+}
+
+type shellOptions struct {
+	allowDiskUse *bool
+	batchSize    *int32
+	comment      *string
+	hint         any
+	limit        *int64
+	maxTime      *time.Duration
+	projection   any
+	skip         *int64
+	sort         any
+}
+
+// parseShellQuery parses a mongosh query like db.getCollection("orders").aggregate([...], {allowDiskUse: true})
+func parseShellQuery(text string) (*shellQuery, error) {
+	p := &jsParser{text: text, now: time.Now()}
+
+	if err := p.space(); err != nil {
+		return nil, err
+	}
+
+	start := p.pos
+	if p.ident() != "db" {
+		p.pos = start
+		return nil, p.errorf("query should start with db")
+	}
+
+	// Collection names may contain dots, the first name followed by ( is the method
+	names := make([]string, 0)
+	var collection string
+	for collection == "" {
+		if err := p.shellToken('.'); err != nil {
+			return nil, err
+		}
+
+		start := p.pos
+		name := p.ident()
+		if name == "" {
+			return nil, p.errorf("expected a name")
+		}
+
+		if err := p.space(); err != nil {
+			return nil, err
+		}
+
+		if p.peek() != '(' {
+			names = append(names, name)
+			continue
+		}
+
+		if len(names) == 0 && name == "getCollection" {
+			args, err := p.shellArguments()
+			if err != nil {
+				return nil, err
+			}
+
+			s, ok := singleString(args)
+			if !ok || s == "" {
+				p.pos = start
+				return nil, p.errorf("getCollection takes a collection name")
+			}
+			collection = s
+
+			if err := p.shellToken('.'); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if len(names) == 0 {
+			p.pos = start
+			return nil, p.errorf("expected a collection name")
+		}
+
+		// Went one name too far, it is the method
+		collection = strings.Join(names, ".")
+		p.pos = start
+	}
+
+	sq := &shellQuery{Collection: collection}
+	offsets := make([]int, 0)
+
+	for {
+		if err := p.space(); err != nil {
+			return nil, err
+		}
+
+		if p.pos >= len(p.text) || p.peek() == ';' {
+			break
+		}
+
+		if len(sq.Calls) > 0 {
+			if err := p.shellToken('.'); err != nil {
+				return nil, err
+			}
+		}
+
+		offset := p.pos
+		name := p.ident()
+		if name == "" {
+			return nil, p.errorf("expected a method name")
+		}
+
+		if err := p.space(); err != nil {
+			return nil, err
+		}
+		if p.peek() != '(' {
+			return nil, p.errorf("expected '(' after %s", name)
+		}
+
+		args, err := p.shellArguments()
+		if err != nil {
+			return nil, err
+		}
+
+		sq.Calls = append(sq.Calls, bson.D{{Key: name, Value: args}})
+		offsets = append(offsets, offset)
+	}
+
+	for p.pos < len(p.text) && p.peek() == ';' {
+		p.pos++
+		if err := p.space(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.pos < len(p.text) {
+		return nil, p.errorf("unexpected %q", p.peekRune())
+	}
+
+	if len(sq.Calls) == 0 {
+		return nil, p.errorf("expected a method call")
+	}
+
+	// Check the arguments now, so that errors point at the faulty call
+	if _, i, err := newShellCommand(sq.Calls); err != nil {
+		return nil, newPipelineError(text, offsets[i], err.Error())
+	}
+
+	return sq, nil
+}
+
+// shellToken skips white space and expects the given character
+func (p *jsParser) shellToken(c byte) error {
+	if err := p.space(); err != nil {
+		return err
+	}
+	if err := p.expect(c); err != nil {
+		return err
+	}
+	return p.space()
+}
+
+// shellArguments reads a parenthesised list of values
+func (p *jsParser) shellArguments() (bson.A, error) {
+	p.pos++
+
+	args := bson.A{}
+	for {
+		if err := p.space(); err != nil {
+			return nil, err
+		}
+
+		if p.peek() == ')' {
+			p.pos++
+			return args, nil
+		}
+
+		if len(args) > 0 {
+			if err := p.shellToken(','); err != nil {
+				return nil, err
+			}
+			if p.peek() == ')' {
+				p.pos++
+				return args, nil
+			}
+		}
+
+		v, err := p.shellValue()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+}
+
+// shellValue reads a JavaScript value and decodes its Extended JSON form
+func (p *jsParser) shellValue() (any, error) {
+	start := p.pos
+
+	p.out.Reset()
+	if err := p.value(); err != nil {
+		return nil, err
+	}
+
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON([]byte(`{"v":`+p.out.String()+`}`), false, &doc); err != nil {
+		p.pos = start
+		return nil, p.errorf("invalid value: %v", err)
+	}
+
+	return doc[0].Value, nil
+}
+
+func singleString(args bson.A) (string, bool) {
+	if len(args) != 1 {
+		return "", false
+	}
+	s, ok := args[0].(string)
+	return s, ok
+}
+
+// newShellCommand checks the calls of a shell query. On error it returns the index of the faulty call
+func newShellCommand(calls []bson.D) (*shellCommand, int, error) {
+	method := calls[0][0].Key
+	args, _ := calls[0][0].Value.(bson.A)
+
+	allowed, ok := shellMethodOptions[method]
+	if !ok {
+		return nil, 0, fmt.Errorf("unsupported method %s, expected aggregate, find, countDocuments or distinct", method)
+	}
+
+	cmd := &shellCommand{method: method, filter: bson.D{}}
+
+	// Position of the options document in the arguments
+	optionsArg := 0
+
+	var err error
+	switch method {
+	case "aggregate":
+		if len(args) == 0 {
+			return nil, 0, errors.New("aggregate takes a pipeline")
+		}
+		if cmd.pipeline, err = shellPipeline(args[0]); err != nil {
+			return nil, 0, err
+		}
+		optionsArg = 1
+
+	case "find":
+		if len(args) > 0 {
+			if cmd.filter, err = shellDocument("filter", args[0]); err != nil {
+				return nil, 0, err
+			}
+		}
+		if len(args) > 1 {
+			if err := cmd.opts.set("projection", args[1]); err != nil {
+				return nil, 0, err
+			}
+		}
+		optionsArg = 2
+
+	case "countDocuments":
+		if len(args) > 0 {
+			if cmd.filter, err = shellDocument("filter", args[0]); err != nil {
+				return nil, 0, err
+			}
+		}
+		optionsArg = 1
+
+	case "distinct":
+		if len(args) > 0 {
+			cmd.field, _ = args[0].(string)
+		}
+		if cmd.field == "" {
+			return nil, 0, errors.New("distinct takes a field name")
+		}
+
+		if len(args) > 1 {
+			if cmd.filter, err = shellDocument("filter", args[1]); err != nil {
+				return nil, 0, err
+			}
+		}
+		optionsArg = 2
+	}
+
+	if len(args) > optionsArg+1 {
+		return nil, 0, fmt.Errorf("%s takes at most %d arguments", method, optionsArg+1)
+	}
+
+	if len(args) > optionsArg {
+		opts, err := shellDocument("options", args[optionsArg])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, e := range opts {
+			if !contains(allowed, e.Key) {
+				return nil, 0, fmt.Errorf("unsupported %s option %s", method, e.Key)
+			}
+			if err := cmd.opts.set(e.Key, e.Value); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	for i, call := range calls[1:] {
+		name := call[0].Key
+		args, _ := call[0].Value.(bson.A)
+
+		if shellNoopModifiers[name] {
+			continue
+		}
+
+		// Only find returns a cursor that can be modified
+		if method != "find" || !contains(allowed, name) {
+			return nil, i + 1, fmt.Errorf("unsupported modifier %s for %s", name, method)
+		}
+
+		if len(args) != 1 {
+			return nil, i + 1, fmt.Errorf("%s takes one argument", name)
+		}
+
+		if err := cmd.opts.set(name, args[0]); err != nil {
+			return nil, i + 1, err
+		}
+	}
+
+	return cmd, 0, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func shellDocument(name string, v any) (bson.D, error) {
+	doc, ok := v.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("%s should be a document", name)
+	}
+	return doc, nil
+}
+
+func shellPipeline(v any) ([]bson.D, error) {
+	stages, ok := v.(bson.A)
+	if !ok {
+		return nil, errors.New("pipeline should be an array of stages")
+	}
+
+	pipeline := make([]bson.D, len(stages))
+	for i, s := range stages {
+		stage, ok := s.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("stage %d should be a document", i)
+		}
+		pipeline[i] = stage
+	}
+
+	return pipeline, nil
+}
+
+func shellInt(name string, v any) (int64, error) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case float64:
+		if n == float64(int64(n)) {
+			return int64(n), nil
+		}
+	}
+	return 0, fmt.Errorf("%s should be an integer", name)
+}
+
+func (o *shellOptions) set(name string, v any) error {
+	switch name {
+	case "allowDiskUse":
+		b, ok := v.(bool)
+		if !ok {
+			return errors.New("allowDiskUse should be a boolean")
+		}
+		o.allowDiskUse = &b
+
+	case "batchSize":
+		n, err := shellInt(name, v)
+		if err != nil {
+			return err
+		}
+		batchSize := int32(n)
+		o.batchSize = &batchSize
+
+	case "comment":
+		s, ok := v.(string)
+		if !ok {
+			return errors.New("comment should be a string")
+		}
+		o.comment = &s
+
+	case "hint":
+		o.hint = v
+
+	case "limit", "skip":
+		n, err := shellInt(name, v)
+		if err != nil {
+			return err
+		}
+		if name == "limit" {
+			o.limit = &n
+		} else {
+			o.skip = &n
+		}
+
+	case "maxTimeMS":
+		n, err := shellInt(name, v)
+		if err != nil {
+			return err
+		}
+		maxTime := time.Duration(n) * time.Millisecond
+		o.maxTime = &maxTime
+
+	case "projection", "sort":
+		doc, err := shellDocument(name, v)
+		if err != nil {
+			return err
+		}
+		if name == "projection" {
+			o.projection = doc
+		} else {
+			o.sort = doc
+		}
+	}
+
+	return nil
+}
+
+// applyShellAdhocFilters adds the ad-hoc filters to the pipeline or the filter of the method call
+func applyShellAdhocFilters(calls []bson.D, filters []adhocFilter) ([]bson.D, error) {
+	method := calls[0][0].Key
+	args, _ := calls[0][0].Value.(bson.A)
+	args = append(bson.A{}, args...)
+
+	if method == "aggregate" {
+		pipeline, err := shellPipeline(args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		pipeline, err = applyAdhocFilters(pipeline, filters)
+		if err != nil {
+			return nil, err
+		}
+
+		stages := make(bson.A, len(pipeline))
+		for i, stage := range pipeline {
+			stages[i] = stage
+		}
+		args[0] = stages
+	} else if len(filters) > 0 {
+		match, err := applyAdhocFilters(nil, filters)
+		if err != nil {
+			return nil, err
+		}
+
+		// The filter is the first argument, after the field name for distinct
+		i := 0
+		if method == "distinct" {
+			i = 1
+		}
+		for len(args) <= i {
+			args = append(args, bson.D{})
+		}
+
+		args[i] = bson.D{{Key: "$and", Value: bson.A{args[i], match[0][0].Value}}}
+	}
+
+	result := append([]bson.D{{{Key: method, Value: args}}}, calls[1:]...)
+	return result, nil
+}
+
+// runShell runs the calls of a shell query with the matching driver method
+func (d *Datasource) runShell(ctx context.Context, collection string, calls []bson.D, refId string) (*data.Frame, error) {
+	cmd, _, err := newShellCommand(calls)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := d.client.Database(d.database).Collection(collection)
+	o := cmd.opts
+
+	switch cmd.method {
+	case "aggregate":
+		opts := &options.AggregateOptions{AllowDiskUse: o.allowDiskUse, BatchSize: o.batchSize, Comment: o.comment, Hint: o.hint, MaxTime: o.maxTime}
+
+		cursor, err := coll.Aggregate(ctx, cmd.pipeline, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(ctx)
+
+		return createTableFramesFromQuery(ctx, refId, cursor)
+
+	case "find":
+		opts := &options.FindOptions{AllowDiskUse: o.allowDiskUse, BatchSize: o.batchSize, Comment: o.comment, Hint: o.hint,
+			Limit: o.limit, MaxTime: o.maxTime, Projection: o.projection, Skip: o.skip, Sort: o.sort}
+
+		cursor, err := coll.Find(ctx, cmd.filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(ctx)
+
+		return createTableFramesFromQuery(ctx, refId, cursor)
+
+	case "countDocuments":
+		opts := &options.CountOptions{Comment: o.comment, Hint: o.hint, Limit: o.limit, MaxTime: o.maxTime, Skip: o.skip}
+
+		count, err := coll.CountDocuments(ctx, cmd.filter, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		return data.NewFrame(refId, data.NewField("count", nil, []int64{count})), nil
+
+	case "distinct":
+		opts := &options.DistinctOptions{MaxTime: o.maxTime}
+		if o.comment != nil {
+			opts.Comment = *o.comment
+		}
+
+		values, err := coll.Distinct(ctx, cmd.field, cmd.filter, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		return distinctFrame(refId, cmd.field, values)
+	}
+
+	return nil, fmt.Errorf("unsupported method %s", cmd.method)
+}
+
+// distinctFrame converts distinct values to a single field frame named after the field
+func distinctFrame(refId string, field string, values []any) (*data.Frame, error) {
+	builder := newTableFrameBuilder()
+	for _, v := range values {
+		doc, err := bson.Marshal(bson.D{{Key: field, Value: v}})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := builder.append(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	return builder.frame(refId), nil
+}
@@ -0,0 +1,174 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseShellQuery(t *testing.T) {
+	t.Run("should parse aggregate with options", func(t *testing.T) {
+		sq, err := parseShellQuery(`db.getCollection("orders").aggregate([
+  { $match: { status: 'paid' } },
+], { allowDiskUse: true, maxTimeMS: 5000 });`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, sq.Collection, "orders")
+		assertEq(t, sq.Calls, []bson.D{
+			{{Key: "aggregate", Value: bson.A{
+				bson.A{bson.D{{Key: "$match", Value: bson.D{{Key: "status", Value: "paid"}}}}},
+				bson.D{{Key: "allowDiskUse", Value: true}, {Key: "maxTimeMS", Value: int32(5000)}},
+			}}},
+		})
+
+		cmd, _, err := newShellCommand(sq.Calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, *cmd.opts.allowDiskUse, true)
+		assertEq(t, *cmd.opts.maxTime, 5*time.Second)
+	})
+
+	t.Run("should parse find with modifiers", func(t *testing.T) {
+		sq, err := parseShellQuery(`db.system.profile
+  .find({ millis: { $gt: 100 } }, { op: 1 })
+  .sort({ ts: -1 })
+  .limit(100)
+  .toArray()`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, sq.Collection, "system.profile")
+		assertEq(t, len(sq.Calls), 4)
+
+		cmd, _, err := newShellCommand(sq.Calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, cmd.method, "find")
+		assertEq(t, cmd.filter, bson.D{{Key: "millis", Value: bson.D{{Key: "$gt", Value: int32(100)}}}})
+		assertEq(t, cmd.opts.projection, bson.D{{Key: "op", Value: int32(1)}})
+		assertEq(t, cmd.opts.sort, bson.D{{Key: "ts", Value: int32(-1)}})
+		assertEq(t, *cmd.opts.limit, int64(100))
+	})
+
+	t.Run("should parse countDocuments and distinct", func(t *testing.T) {
+		sq, err := parseShellQuery(`db.orders.countDocuments()`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd, _, err := newShellCommand(sq.Calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, cmd.method, "countDocuments")
+		assertEq(t, cmd.filter, bson.D{})
+
+		sq, err = parseShellQuery(`db.orders.distinct("status", { year: 2024 })`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd, _, err = newShellCommand(sq.Calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, cmd.field, "status")
+		assertEq(t, cmd.filter, bson.D{{Key: "year", Value: int32(2024)}})
+	})
+
+	tests := []struct {
+		name   string
+		text   string
+		line   int
+		column int
+	}{
+		{"missing db", "orders.find()", 1, 1},
+		{"missing method", "db.orders", 1, 10},
+		{"unsupported method", "db.orders.deleteMany({})", 1, 11},
+		{"unsupported modifier", "db.orders.aggregate([])\n  .sort({ a: 1 })", 2, 4},
+		{"unsupported option", "db.orders.find({}, {}, { upsert: true })", 1, 11},
+		{"invalid modifier argument", "db.orders.find().limit('10')", 1, 18},
+		{"invalid value", "db.orders.find({ a: foo })", 1, 21},
+		{"trailing content", "db.orders.find() x", 1, 18},
+	}
+
+	for _, tt := range tests {
+		t.Run("should locate "+tt.name, func(t *testing.T) {
+			_, err := parseShellQuery(tt.text)
+
+			perr, ok := err.(*pipelineError)
+			if !ok {
+				t.Fatalf("expected pipeline error, got %v", err)
+			}
+
+			if perr.Line != tt.line || perr.Column != tt.column {
+				t.Errorf("expected error at %d:%d, got %d:%d (%s)", tt.line, tt.column, perr.Line, perr.Column, perr.Message)
+			}
+		})
+	}
+}
+
+func TestApplyShellAdhocFilters(t *testing.T) {
+	filters := []adhocFilter{{Key: "host", Operator: "!=", Value: "a"}}
+	match := bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "host", Value: bson.D{{Key: "$nin", Value: bson.A{"a"}}}}}}}}
+
+	t.Run("should add $match to aggregate", func(t *testing.T) {
+		calls := []bson.D{{{Key: "aggregate", Value: bson.A{bson.A{bson.D{{Key: "$limit", Value: 1}}}}}}}
+
+		result, err := applyShellAdhocFilters(calls, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, result, []bson.D{{{Key: "aggregate", Value: bson.A{bson.A{
+			bson.D{{Key: "$match", Value: match}},
+			bson.D{{Key: "$limit", Value: 1}},
+		}}}}})
+	})
+
+	t.Run("should combine filters of find", func(t *testing.T) {
+		calls := []bson.D{
+			{{Key: "find", Value: bson.A{bson.D{{Key: "a", Value: 1}}}}},
+			{{Key: "limit", Value: bson.A{5}}},
+		}
+
+		result, err := applyShellAdhocFilters(calls, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, result[0], bson.D{{Key: "find", Value: bson.A{
+			bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "a", Value: 1}}, match}}},
+		}}})
+		assertEq(t, result[1], calls[1])
+	})
+
+	t.Run("should add filter to distinct without filter", func(t *testing.T) {
+		calls := []bson.D{{{Key: "distinct", Value: bson.A{"status"}}}}
+
+		result, err := applyShellAdhocFilters(calls, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, result[0], bson.D{{Key: "distinct", Value: bson.A{
+			"status",
+			bson.D{{Key: "$and", Value: bson.A{bson.D{}, match}}},
+		}}})
+		assertEq(t, calls[0], bson.D{{Key: "distinct", Value: bson.A{"status"}}})
+	})
+}
+
+func TestDistinctFrame(t *testing.T) {
+	frame, err := distinctFrame("A", "status", []any{"paid", "open"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEq(t, frame.Rows(), 2)
+	assertEq(t, frame.Fields[0].Name, "status")
+}
@@ -0,0 +1,1492 @@
+package plugin
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	sqlKeywords = map[string]bool{
+		"SELECT": true, "FROM": true, "WHERE": true, "GROUP": true, "BY": true, "ORDER": true,
+		"ASC": true, "DESC": true, "LIMIT": true, "OFFSET": true, "AS": true, "AND": true,
+		"OR": true, "NOT": true, "IN": true, "IS": true, "NULL": true, "LIKE": true,
+		"BETWEEN": true, "TRUE": true, "FALSE": true,
+	}
+
+	// Aggregate functions and their $group accumulator
+	sqlAggregates = map[string]string{
+		"COUNT": "$sum",
+		"SUM":   "$sum",
+		"AVG":   "$avg",
+		"MIN":   "$min",
+		"MAX":   "$max",
+	}
+
+	// Scalar functions with a single argument and their aggregation operator
+	sqlFunctions = map[string]string{
+		"ABS":   "$abs",
+		"LOWER": "$toLower",
+		"UPPER": "$toUpper",
+	}
+
+	sqlComparisons = map[string]string{
+		"=":  "$eq",
+		"!=": "$ne",
+		"<>": "$ne",
+		"<":  "$lt",
+		"<=": "$lte",
+		">":  "$gt",
+		">=": "$gte",
+	}
+
+	// Comparison operators with the operands swapped, for 1 < a
+	sqlFlippedComparisons = map[string]string{
+		"$eq":  "$eq",
+		"$ne":  "$ne",
+		"$lt":  "$gt",
+		"$lte": "$gte",
+		"$gt":  "$lt",
+		"$gte": "$lte",
+	}
+
+	sqlArithmetic = map[string]string{
+		"+": "$add",
+		"-": "$subtract",
+		"*": "$multiply",
+		"/": "$divide",
+		"%": "$mod",
+	}
+
+	sqlIntervalPattern = regexp.MustCompile(`^(\d+)(ms|s|m|h|d|w)$`)
+)
+
+const (
+	// Time bucket function, e.g. time_bucket('5m', ts)
+	sqlTimeBucket = "TIME_BUCKET"
+	// Macro expanding to a time range condition on a field, e.g. $__timeFilter(ts)
+	sqlTimeFilter = "$__timeFilter"
+)
+
+type sqlTokenKind int
+
+const (
+	sqlTokenEOF sqlTokenKind = iota
+	sqlTokenIdent
+	sqlTokenQuotedIdent
+	sqlTokenString
+	sqlTokenNumber
+	sqlTokenMacro
+	sqlTokenSymbol
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	pos  int
+}
+
+// sqlExpr is a node of a parsed SQL expression
+type sqlExpr interface {
+	position() int
+}
+
+type sqlColumn struct {
+	pos  int
+	path string
+}
+
+type sqlLiteral struct {
+	pos   int
+	value any
+}
+
+type sqlBinary struct {
+	pos         int
+	op          string
+	left, right sqlExpr
+}
+
+type sqlUnary struct {
+	pos  int
+	op   string
+	expr sqlExpr
+}
+
+type sqlFunc struct {
+	pos  int
+	name string
+	args []sqlExpr
+	// COUNT(*)
+	star bool
+}
+
+type sqlIn struct {
+	pos  int
+	expr sqlExpr
+	list []sqlExpr
+	not  bool
+}
+
+type sqlIsNull struct {
+	pos  int
+	expr sqlExpr
+	not  bool
+}
+
+type sqlLike struct {
+	pos     int
+	expr    sqlExpr
+	pattern string
+	not     bool
+}
+
+func (e *sqlColumn) position() int  { return e.pos }
+func (e *sqlLiteral) position() int { return e.pos }
+func (e *sqlBinary) position() int  { return e.pos }
+func (e *sqlUnary) position() int   { return e.pos }
+func (e *sqlFunc) position() int    { return e.pos }
+func (e *sqlIn) position() int      { return e.pos }
+func (e *sqlIsNull) position() int  { return e.pos }
+func (e *sqlLike) position() int    { return e.pos }
+
+type sqlSelectItem struct {
+	expr  sqlExpr
+	alias string
+	star  bool
+}
+
+type sqlOrderItem struct {
+	expr sqlExpr
+	desc bool
+}
+
+type sqlSelect struct {
+	items      []sqlSelectItem
+	collection string
+	where      sqlExpr
+	groupBy    []sqlExpr
+	orderBy    []sqlOrderItem
+	limit      *int64
+	offset     *int64
+}
+
+type sqlParser struct {
+	text   string
+	tokens []sqlToken
+	i      int
+}
+
+func (p *sqlParser) errorf(pos int, format string, args ...any) error {
+	return newPipelineError(p.text, pos, fmt.Sprintf(format, args...))
+}
+
+func tokenizeSQL(text string) ([]sqlToken, error) {
+	tokens := make([]sqlToken, 0)
+	pos := 0
+
+	isIdent := func(c byte) bool {
+		return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+
+	for pos < len(text) {
+		c := text[pos]
+		start := pos
+
+		switch {
+		case unicode.IsSpace(rune(c)):
+			pos++
+
+		case strings.HasPrefix(text[pos:], "--"):
+			for pos < len(text) && text[pos] != '\n' {
+				pos++
+			}
+
+		case strings.HasPrefix(text[pos:], "/*"):
+			end := strings.Index(text[pos+2:], "*/")
+			if end < 0 {
+				return nil, newPipelineError(text, pos, "unterminated comment")
+			}
+			pos += end + 4
+
+		case c == '\'':
+			var sb strings.Builder
+			pos++
+			for {
+				if pos >= len(text) {
+					return nil, newPipelineError(text, start, "unterminated string")
+				}
+				if text[pos] == '\'' {
+					// '' is an escaped quote
+					if pos+1 < len(text) && text[pos+1] == '\'' {
+						sb.WriteByte('\'')
+						pos += 2
+						continue
+					}
+					pos++
+					break
+				}
+				sb.WriteByte(text[pos])
+				pos++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenString, text: sb.String(), pos: start})
+
+		case c == '"' || c == '`':
+			end := strings.IndexByte(text[pos+1:], c)
+			if end < 0 {
+				return nil, newPipelineError(text, start, "unterminated identifier")
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenQuotedIdent, text: text[pos+1 : pos+1+end], pos: start})
+			pos += end + 2
+
+		case c >= '0' && c <= '9' || c == '.' && pos+1 < len(text) && text[pos+1] >= '0' && text[pos+1] <= '9':
+			for pos < len(text) && (text[pos] >= '0' && text[pos] <= '9' || text[pos] == '.') {
+				pos++
+			}
+			if pos < len(text) && (text[pos] == 'e' || text[pos] == 'E') {
+				pos++
+				if pos < len(text) && (text[pos] == '+' || text[pos] == '-') {
+					pos++
+				}
+				for pos < len(text) && text[pos] >= '0' && text[pos] <= '9' {
+					pos++
+				}
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenNumber, text: text[start:pos], pos: start})
+
+		case c == '$' && pos+1 < len(text) && isIdent(text[pos+1]):
+			pos++
+			for pos < len(text) && isIdent(text[pos]) {
+				pos++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenMacro, text: text[start:pos], pos: start})
+
+		case isIdent(c):
+			// Dotted paths are a single identifier
+			for pos < len(text) && (isIdent(text[pos]) || text[pos] == '.' && pos+1 < len(text) && isIdent(text[pos+1])) {
+				pos++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenIdent, text: text[start:pos], pos: start})
+
+		default:
+			symbol := string(c)
+			for _, s := range []string{"<=", ">=", "<>", "!="} {
+				if strings.HasPrefix(text[pos:], s) {
+					symbol = s
+				}
+			}
+			if !strings.Contains("=<>+-*/%(),;", string(c)) && symbol != "!=" {
+				return nil, newPipelineError(text, pos, fmt.Sprintf("unexpected %q", c))
+			}
+			pos += len(symbol)
+			tokens = append(tokens, sqlToken{kind: sqlTokenSymbol, text: symbol, pos: start})
+		}
+	}
+
+	return append(tokens, sqlToken{kind: sqlTokenEOF, pos: len(text)}), nil
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.i]
+}
+
+func (p *sqlParser) next() sqlToken {
+	t := p.tokens[p.i]
+	if t.kind != sqlTokenEOF {
+		p.i++
+	}
+	return t
+}
+
+// isKeyword tells if the next token is the keyword, keywords are case insensitive
+func (p *sqlParser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == sqlTokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+func (p *sqlParser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return p.unexpected(keyword)
+	}
+	return nil
+}
+
+func (p *sqlParser) isSymbol(symbol string) bool {
+	t := p.peek()
+	return t.kind == sqlTokenSymbol && t.text == symbol
+}
+
+func (p *sqlParser) acceptSymbol(symbol string) bool {
+	if p.isSymbol(symbol) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.unexpected(symbol)
+	}
+	return nil
+}
+
+func (p *sqlParser) unexpected(expected string) error {
+	t := p.peek()
+	if t.kind == sqlTokenEOF {
+		return p.errorf(t.pos, "expected %s, got end of query", expected)
+	}
+	return p.errorf(t.pos, "expected %s, got %s", expected, t.text)
+}
+
+// identifier reads a column, collection or alias name
+func (p *sqlParser) identifier(what string) (string, error) {
+	t := p.peek()
+	if t.kind == sqlTokenQuotedIdent || t.kind == sqlTokenIdent && !sqlKeywords[strings.ToUpper(t.text)] {
+		p.i++
+		return t.text, nil
+	}
+	return "", p.unexpected(what)
+}
+
+func (p *sqlParser) integer() (*int64, error) {
+	t := p.peek()
+	if t.kind != sqlTokenNumber {
+		return nil, p.unexpected("a number")
+	}
+	n, err := strconv.ParseInt(t.text, 10, 64)
+	if err != nil || n < 0 {
+		return nil, p.errorf(t.pos, "expected a positive integer, got %s", t.text)
+	}
+	p.i++
+	return &n, nil
+}
+
+// parseSQL parses a SELECT statement
+func parseSQL(text string) (*sqlSelect, error) {
+	tokens, err := tokenizeSQL(text)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &sqlParser{text: text, tokens: tokens}
+	s := &sqlSelect{}
+
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+
+	for {
+		item := sqlSelectItem{}
+		if p.acceptSymbol("*") {
+			item.star = true
+		} else {
+			if item.expr, err = p.expr(); err != nil {
+				return nil, err
+			}
+
+			if p.acceptKeyword("AS") || p.peek().kind == sqlTokenQuotedIdent || p.peek().kind == sqlTokenIdent && !sqlKeywords[strings.ToUpper(p.peek().text)] {
+				if item.alias, err = p.identifier("an alias"); err != nil {
+					return nil, err
+				}
+			}
+		}
+		s.items = append(s.items, item)
+
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if s.collection, err = p.identifier("a collection"); err != nil {
+		return nil, err
+	}
+
+	if p.acceptKeyword("WHERE") {
+		if s.where, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			s.groupBy = append(s.groupBy, e)
+
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			item := sqlOrderItem{}
+			if item.expr, err = p.expr(); err != nil {
+				return nil, err
+			}
+			if p.acceptKeyword("DESC") {
+				item.desc = true
+			} else {
+				p.acceptKeyword("ASC")
+			}
+			s.orderBy = append(s.orderBy, item)
+
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("LIMIT") {
+		if s.limit, err = p.integer(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.acceptKeyword("OFFSET") {
+		if s.offset, err = p.integer(); err != nil {
+			return nil, err
+		}
+	}
+
+	for p.acceptSymbol(";") {
+	}
+
+	if p.peek().kind != sqlTokenEOF {
+		return nil, p.unexpected("end of query")
+	}
+
+	return s, nil
+}
+
+func (p *sqlParser) expr() (sqlExpr, error) {
+	return p.or()
+}
+
+func (p *sqlParser) or() (sqlExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("OR") {
+		pos := p.next().pos
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlBinary{pos: pos, op: "OR", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *sqlParser) and() (sqlExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("AND") {
+		pos := p.next().pos
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlBinary{pos: pos, op: "AND", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *sqlParser) not() (sqlExpr, error) {
+	if p.isKeyword("NOT") {
+		pos := p.next().pos
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlUnary{pos: pos, op: "NOT", expr: e}, nil
+	}
+
+	return p.comparison()
+}
+
+func (p *sqlParser) comparison() (sqlExpr, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind == sqlTokenSymbol && sqlComparisons[t.text] != "" {
+		p.i++
+		right, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlBinary{pos: t.pos, op: t.text, left: left, right: right}, nil
+	}
+
+	if p.acceptKeyword("IS") {
+		not := p.acceptKeyword("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return &sqlIsNull{pos: t.pos, expr: left, not: not}, nil
+	}
+
+	not := p.acceptKeyword("NOT")
+
+	switch {
+	case p.acceptKeyword("IN"):
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		in := &sqlIn{pos: t.pos, expr: left, not: not}
+		for {
+			e, err := p.additive()
+			if err != nil {
+				return nil, err
+			}
+			in.list = append(in.list, e)
+
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return in, nil
+
+	case p.acceptKeyword("LIKE"):
+		pattern := p.next()
+		if pattern.kind != sqlTokenString {
+			p.i--
+			return nil, p.unexpected("a pattern string")
+		}
+		return &sqlLike{pos: t.pos, expr: left, pattern: pattern.text, not: not}, nil
+
+	case p.acceptKeyword("BETWEEN"):
+		low, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+
+		var between sqlExpr = &sqlBinary{pos: t.pos, op: "AND",
+			left:  &sqlBinary{pos: t.pos, op: ">=", left: left, right: low},
+			right: &sqlBinary{pos: t.pos, op: "<=", left: left, right: high},
+		}
+		if not {
+			between = &sqlUnary{pos: t.pos, op: "NOT", expr: between}
+		}
+		return between, nil
+	}
+
+	if not {
+		return nil, p.unexpected("IN, LIKE or BETWEEN")
+	}
+
+	return left, nil
+}
+
+func (p *sqlParser) additive() (sqlExpr, error) {
+	left, err := p.multiplicative()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isSymbol("+") || p.isSymbol("-") {
+		t := p.next()
+		right, err := p.multiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlBinary{pos: t.pos, op: t.text, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *sqlParser) multiplicative() (sqlExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isSymbol("*") || p.isSymbol("/") || p.isSymbol("%") {
+		t := p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlBinary{pos: t.pos, op: t.text, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *sqlParser) unary() (sqlExpr, error) {
+	if p.isSymbol("-") {
+		pos := p.next().pos
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		if lit, ok := e.(*sqlLiteral); ok {
+			switch v := lit.value.(type) {
+			case int32:
+				return &sqlLiteral{pos: pos, value: -v}, nil
+			case int64:
+				return &sqlLiteral{pos: pos, value: -v}, nil
+			case float64:
+				return &sqlLiteral{pos: pos, value: -v}, nil
+			}
+		}
+		return &sqlUnary{pos: pos, op: "-", expr: e}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *sqlParser) primary() (sqlExpr, error) {
+	t := p.peek()
+
+	switch t.kind {
+	case sqlTokenNumber:
+		p.i++
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			if n >= -1<<31 && n < 1<<31 {
+				return &sqlLiteral{pos: t.pos, value: int32(n)}, nil
+			}
+			return &sqlLiteral{pos: t.pos, value: n}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t.pos, "invalid number %s", t.text)
+		}
+		return &sqlLiteral{pos: t.pos, value: f}, nil
+
+	case sqlTokenString:
+		p.i++
+		return &sqlLiteral{pos: t.pos, value: t.text}, nil
+
+	case sqlTokenMacro:
+		p.i++
+		if t.text == sqlTimeFilter {
+			return p.timeFilter(t)
+		}
+		if t.text != macroTimeFrom && t.text != macroTimeTo {
+			return nil, p.errorf(t.pos, "unknown macro %s", t.text)
+		}
+		return &sqlLiteral{pos: t.pos, value: t.text}, nil
+
+	case sqlTokenQuotedIdent:
+		p.i++
+		return &sqlColumn{pos: t.pos, path: t.text}, nil
+
+	case sqlTokenSymbol:
+		if t.text == "(" {
+			p.i++
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+			return e, nil
+		}
+
+	case sqlTokenIdent:
+		switch upper := strings.ToUpper(t.text); {
+		case upper == "TRUE" || upper == "FALSE":
+			p.i++
+			return &sqlLiteral{pos: t.pos, value: upper == "TRUE"}, nil
+
+		case upper == "NULL":
+			p.i++
+			return &sqlLiteral{pos: t.pos, value: nil}, nil
+
+		case sqlKeywords[upper]:
+
+		default:
+			p.i++
+			if !p.isSymbol("(") {
+				return &sqlColumn{pos: t.pos, path: t.text}, nil
+			}
+			return p.function(t)
+		}
+	}
+
+	return nil, p.unexpected("an expression")
+}
+
+func (p *sqlParser) function(name sqlToken) (sqlExpr, error) {
+	p.i++
+
+	f := &sqlFunc{pos: name.pos, name: strings.ToUpper(name.text)}
+	if f.name == "COUNT" && p.acceptSymbol("*") {
+		f.star = true
+	} else if !p.isSymbol(")") {
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			f.args = append(f.args, e)
+
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	_, aggregate := sqlAggregates[f.name]
+	_, scalar := sqlFunctions[f.name]
+	switch {
+	case aggregate || scalar:
+		if len(f.args) != 1 && !f.star {
+			return nil, p.errorf(f.pos, "%s takes one argument", f.name)
+		}
+	case f.name == sqlTimeBucket:
+		if len(f.args) != 2 {
+			return nil, p.errorf(f.pos, "%s takes an interval and a time column", strings.ToLower(f.name))
+		}
+	default:
+		return nil, p.errorf(f.pos, "unknown function %s", name.text)
+	}
+
+	return f, nil
+}
+
+// timeFilter expands $__timeFilter(field) to field >= $__timeFrom AND field <= $__timeTo
+func (p *sqlParser) timeFilter(t sqlToken) (sqlExpr, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	return &sqlBinary{pos: t.pos, op: "AND",
+		left:  &sqlBinary{pos: t.pos, op: ">=", left: e, right: &sqlLiteral{pos: t.pos, value: macroTimeFrom}},
+		right: &sqlBinary{pos: t.pos, op: "<=", left: e, right: &sqlLiteral{pos: t.pos, value: macroTimeTo}},
+	}, nil
+}
+
+// sqlTranslator turns a parsed statement into an aggregation pipeline
+type sqlTranslator struct {
+	text string
+	// Group keys by name and their expression
+	groupKeys  bson.D
+	grouped    bool
+	accumulate bson.D
+}
+
+func (t *sqlTranslator) errorf(e sqlExpr, format string, args ...any) error {
+	return newPipelineError(t.text, e.position(), fmt.Sprintf(format, args...))
+}
+
+// translateSQL translates a SELECT statement to a collection and a pipeline
+func translateSQL(text string) (string, []bson.D, error) {
+	s, err := parseSQL(text)
+	if err != nil {
+		return "", nil, err
+	}
+
+	t := &sqlTranslator{text: text}
+	pipeline := make([]bson.D, 0)
+
+	if s.where != nil {
+		match, err := t.match(s.where)
+		if err != nil {
+			return "", nil, err
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: match}})
+	}
+
+	star := false
+	names := make([]string, len(s.items))
+	for i, item := range s.items {
+		if item.star {
+			star = true
+			continue
+		}
+
+		names[i] = item.alias
+		if names[i] == "" {
+			names[i] = sqlDefaultName(item.expr, i)
+		}
+
+		if containsAggregate(item.expr) {
+			t.grouped = true
+		}
+	}
+
+	if star && len(s.items) > 1 {
+		return "", nil, newPipelineError(text, 0, "SELECT * can't be combined with other columns")
+	}
+
+	t.grouped = t.grouped || len(s.groupBy) > 0
+	if star && t.grouped {
+		return "", nil, newPipelineError(text, 0, "SELECT * can't be used with GROUP BY")
+	}
+
+	// Output column of a select item given by alias, position or expression
+	outputName := func(e sqlExpr) string {
+		if c, ok := e.(*sqlColumn); ok {
+			for _, name := range names {
+				if name == c.path {
+					return name
+				}
+			}
+		}
+
+		if l, ok := e.(*sqlLiteral); ok {
+			if n, ok := l.value.(int32); ok && n >= 1 && int(n) <= len(names) {
+				return names[n-1]
+			}
+		}
+
+		if v, ok := t.plain(e); ok {
+			for i, item := range s.items {
+				if iv, ok := t.plain(item.expr); ok && !item.star && reflect.DeepEqual(iv, v) {
+					return names[i]
+				}
+			}
+		}
+
+		return ""
+	}
+
+	var project bson.D
+	if t.grouped {
+		for i, g := range s.groupBy {
+			name := outputName(g)
+
+			// Group by alias or position
+			expr := g
+			for j, n := range names {
+				if name != "" && n == name {
+					expr = s.items[j].expr
+				}
+			}
+			if containsAggregate(expr) {
+				return "", nil, t.errorf(g, "GROUP BY can't contain aggregate functions")
+			}
+
+			if name == "" {
+				name = fmt.Sprintf("group%d", i)
+			}
+
+			v, err := t.expr(expr)
+			if err != nil {
+				return "", nil, err
+			}
+			t.groupKeys = append(t.groupKeys, bson.E{Key: name, Value: v})
+		}
+
+		project = bson.D{{Key: "_id", Value: 0}}
+		for i, item := range s.items {
+			v, err := t.groupedExpr(item.expr)
+			if err != nil {
+				return "", nil, err
+			}
+			project = append(project, bson.E{Key: names[i], Value: projectValue(v)})
+		}
+
+		var id any
+		if len(t.groupKeys) > 0 {
+			id = t.groupKeys
+		}
+
+		group := append(bson.D{{Key: "_id", Value: id}}, t.accumulate...)
+		pipeline = append(pipeline, bson.D{{Key: "$group", Value: group}})
+	}
+
+	// Sort on output columns after the projection, or on document fields before it
+	var sortBefore, sortAfter bson.D
+	for _, o := range s.orderBy {
+		direction := 1
+		if o.desc {
+			direction = -1
+		}
+
+		name := outputName(o.expr)
+		if name == "" && t.grouped {
+			// Aggregates, e.g. ORDER BY COUNT(*)
+			if v, err := t.groupedExpr(o.expr); err == nil {
+				for _, e := range project {
+					if reflect.DeepEqual(e.Value, projectValue(v)) {
+						name = e.Key
+					}
+				}
+			}
+		}
+
+		if name != "" {
+			sortAfter = append(sortAfter, bson.E{Key: name, Value: direction})
+			continue
+		}
+
+		c, ok := o.expr.(*sqlColumn)
+		if t.grouped || !ok {
+			return "", nil, t.errorf(o.expr, "ORDER BY should refer to a selected column")
+		}
+		sortBefore = append(sortBefore, bson.E{Key: c.path, Value: direction})
+	}
+
+	if sortBefore != nil && sortAfter != nil {
+		return "", nil, newPipelineError(text, s.orderBy[0].expr.position(), "ORDER BY can't mix selected columns and other fields")
+	}
+
+	if !t.grouped && !star {
+		hasID := false
+		for i, item := range s.items {
+			v, err := t.expr(item.expr)
+			if err != nil {
+				return "", nil, err
+			}
+			project = append(project, bson.E{Key: names[i], Value: projectValue(v)})
+			hasID = hasID || names[i] == "_id"
+		}
+		if !hasID {
+			project = append(bson.D{{Key: "_id", Value: 0}}, project...)
+		}
+	}
+
+	if sortBefore != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: sortBefore}})
+	}
+
+	// Limit before projecting when sorting doesn't need the projected columns
+	if project != nil && sortAfter == nil {
+		pipeline = appendLimit(pipeline, s)
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: project}})
+		return s.collection, pipeline, nil
+	}
+
+	if project != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: project}})
+	}
+	if sortAfter != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: sortAfter}})
+	}
+
+	return s.collection, appendLimit(pipeline, s), nil
+}
+
+func appendLimit(pipeline []bson.D, s *sqlSelect) []bson.D {
+	if s.offset != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: *s.offset}})
+	}
+	if s.limit != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: *s.limit}})
+	}
+	return pipeline
+}
+
+// projectValue wraps literals, $project would read numbers and booleans as inclusion flags
+func projectValue(v any) any {
+	if s, ok := v.(string); ok && strings.HasPrefix(s, "$") && s != macroTimeFrom && s != macroTimeTo {
+		return v
+	}
+	if _, ok := v.(bson.D); ok {
+		return v
+	}
+	return bson.D{{Key: "$literal", Value: v}}
+}
+
+func sqlDefaultName(e sqlExpr, i int) string {
+	switch e := e.(type) {
+	case *sqlColumn:
+		return e.path[strings.LastIndex(e.path, ".")+1:]
+	case *sqlFunc:
+		if e.name == sqlTimeBucket {
+			return "time"
+		}
+		name := strings.ToLower(e.name)
+		if len(e.args) == 1 {
+			if c, ok := e.args[0].(*sqlColumn); ok {
+				name += "_" + sqlDefaultName(c, i)
+			}
+		}
+		return name
+	}
+	return fmt.Sprintf("col%d", i+1)
+}
+
+func containsAggregate(e sqlExpr) bool {
+	switch e := e.(type) {
+	case *sqlFunc:
+		if _, ok := sqlAggregates[e.name]; ok {
+			return true
+		}
+		for _, a := range e.args {
+			if containsAggregate(a) {
+				return true
+			}
+		}
+	case *sqlBinary:
+		return containsAggregate(e.left) || containsAggregate(e.right)
+	case *sqlUnary:
+		return containsAggregate(e.expr)
+	case *sqlIn:
+		return containsAggregate(e.expr)
+	case *sqlIsNull:
+		return containsAggregate(e.expr)
+	case *sqlLike:
+		return containsAggregate(e.expr)
+	}
+	return false
+}
+
+// plain translates an expression without aggregates, to compare expressions
+func (t *sqlTranslator) plain(e sqlExpr) (any, bool) {
+	if e == nil || containsAggregate(e) {
+		return nil, false
+	}
+
+	v, err := t.expr(e)
+	return v, err == nil
+}
+
+// groupedExpr translates a select item of a grouped query, which may only use group keys and aggregates
+func (t *sqlTranslator) groupedExpr(e sqlExpr) (any, error) {
+	if plain, ok := t.plain(e); ok {
+		for _, key := range t.groupKeys {
+			if reflect.DeepEqual(plain, key.Value) {
+				return "$_id." + key.Key, nil
+			}
+		}
+	}
+
+	switch e := e.(type) {
+	case *sqlColumn:
+		return nil, t.errorf(e, "column %s should be in GROUP BY or in an aggregate function", e.path)
+
+	case *sqlFunc:
+		if op, ok := sqlAggregates[e.name]; ok {
+			return t.accumulator(e, op)
+		}
+	}
+
+	// Expressions combining group keys and aggregates
+	return t.translate(e, t.groupedExpr)
+}
+
+// accumulator adds an accumulator to the $group stage and returns a reference to it
+func (t *sqlTranslator) accumulator(f *sqlFunc, op string) (any, error) {
+	var value any = 1
+	if !f.star {
+		if containsAggregate(f.args[0]) {
+			return nil, t.errorf(f, "aggregate functions can't be nested")
+		}
+
+		arg, err := t.expr(f.args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		value = arg
+		if f.name == "COUNT" {
+			// Count values that are neither null nor missing
+			value = bson.D{{Key: "$cond", Value: bson.A{bson.D{{Key: "$gt", Value: bson.A{arg, nil}}}, 1, 0}}}
+		}
+	}
+
+	acc := bson.D{{Key: op, Value: value}}
+	for _, e := range t.accumulate {
+		if reflect.DeepEqual(e.Value, acc) {
+			return "$" + e.Key, nil
+		}
+	}
+
+	name := fmt.Sprintf("agg%d", len(t.accumulate))
+	t.accumulate = append(t.accumulate, bson.E{Key: name, Value: acc})
+
+	return "$" + name, nil
+}
+
+// expr translates an expression to an aggregation expression
+func (t *sqlTranslator) expr(e sqlExpr) (any, error) {
+	switch e := e.(type) {
+	case *sqlColumn:
+		return "$" + e.path, nil
+
+	case *sqlLiteral:
+		// Strings starting with $ would be field paths, macros are replaced before running
+		if s, ok := e.value.(string); ok && strings.HasPrefix(s, "$") && s != macroTimeFrom && s != macroTimeTo {
+			return bson.D{{Key: "$literal", Value: s}}, nil
+		}
+		return e.value, nil
+
+	case *sqlFunc:
+		if _, ok := sqlAggregates[e.name]; ok {
+			return nil, t.errorf(e, "aggregate function %s is not allowed here", e.name)
+		}
+	}
+
+	return t.translate(e, t.expr)
+}
+
+// translate translates operators and scalar functions, sub-expressions are translated with sub
+func (t *sqlTranslator) translate(e sqlExpr, sub func(sqlExpr) (any, error)) (any, error) {
+	switch e := e.(type) {
+	case *sqlColumn, *sqlLiteral:
+		return t.expr(e)
+
+	case *sqlBinary:
+		left, err := sub(e.left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := sub(e.right)
+		if err != nil {
+			return nil, err
+		}
+
+		var op string
+		switch {
+		case e.op == "AND":
+			op = "$and"
+		case e.op == "OR":
+			op = "$or"
+		case sqlComparisons[e.op] != "":
+			op = sqlComparisons[e.op]
+		default:
+			op = sqlArithmetic[e.op]
+		}
+		return bson.D{{Key: op, Value: bson.A{left, right}}}, nil
+
+	case *sqlUnary:
+		v, err := sub(e.expr)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "NOT" {
+			return bson.D{{Key: "$not", Value: bson.A{v}}}, nil
+		}
+		return bson.D{{Key: "$multiply", Value: bson.A{-1, v}}}, nil
+
+	case *sqlIn:
+		v, err := sub(e.expr)
+		if err != nil {
+			return nil, err
+		}
+		list := bson.A{}
+		for _, item := range e.list {
+			iv, err := sub(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, iv)
+		}
+		var in any = bson.D{{Key: "$in", Value: bson.A{v, list}}}
+		if e.not {
+			in = bson.D{{Key: "$not", Value: bson.A{in}}}
+		}
+		return in, nil
+
+	case *sqlIsNull:
+		v, err := sub(e.expr)
+		if err != nil {
+			return nil, err
+		}
+		// null and missing sort before any other value
+		op := "$lte"
+		if e.not {
+			op = "$gt"
+		}
+		return bson.D{{Key: op, Value: bson.A{v, nil}}}, nil
+
+	case *sqlLike:
+		v, err := sub(e.expr)
+		if err != nil {
+			return nil, err
+		}
+		var like any = bson.D{{Key: "$regexMatch", Value: bson.D{{Key: "input", Value: v}, {Key: "regex", Value: likePattern(e.pattern)}}}}
+		if e.not {
+			like = bson.D{{Key: "$not", Value: bson.A{like}}}
+		}
+		return like, nil
+
+	case *sqlFunc:
+		if e.name == sqlTimeBucket {
+			return t.timeBucket(e, sub)
+		}
+
+		op, ok := sqlFunctions[e.name]
+		if !ok {
+			return nil, t.errorf(e, "function %s is not allowed here", e.name)
+		}
+		v, err := sub(e.args[0])
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: op, Value: v}}, nil
+	}
+
+	return nil, t.errorf(e, "unsupported expression")
+}
+
+// timeBucket rounds a date down to a multiple of the interval
+func (t *sqlTranslator) timeBucket(f *sqlFunc, sub func(sqlExpr) (any, error)) (any, error) {
+	lit, ok := f.args[0].(*sqlLiteral)
+	if !ok {
+		return nil, t.errorf(f.args[0], "interval should be a string like '5m' or a number of milliseconds")
+	}
+
+	var ms int64
+	switch v := lit.value.(type) {
+	case int32:
+		ms = int64(v)
+	case int64:
+		ms = v
+	case string:
+		d, err := parseInterval(v)
+		if err != nil {
+			return nil, t.errorf(lit, "%v", err)
+		}
+		ms = d.Milliseconds()
+	}
+	if ms <= 0 {
+		return nil, t.errorf(lit, "interval should be a string like '5m' or a number of milliseconds")
+	}
+
+	v, err := sub(f.args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return timeBucketExpr(v, ms), nil
+}
+
+// timeBucketExpr rounds the date expression down to a multiple of ms milliseconds
+func timeBucketExpr(v any, ms int64) bson.D {
+	epoch := bson.D{{Key: "$toLong", Value: v}}
+	return bson.D{{Key: "$toDate", Value: bson.D{{Key: "$subtract", Value: bson.A{
+		epoch,
+		bson.D{{Key: "$mod", Value: bson.A{epoch, ms}}},
+	}}}}}
+}
+
+// parseInterval parses intervals like 500ms, 5m or 1d
+func parseInterval(s string) (time.Duration, error) {
+	m := sqlIntervalPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid interval %q", s)
+	}
+
+	n, _ := strconv.ParseInt(m[1], 10, 64)
+	unit := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+	}[m[2]]
+
+	return time.Duration(n) * unit, nil
+}
+
+// likePattern converts a LIKE pattern to an anchored regular expression
+func likePattern(pattern string) string {
+	var sb strings.Builder
+	sb.WriteByte('^')
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteByte('.')
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteByte('$')
+	return sb.String()
+}
+
+// match translates a WHERE condition to a $match filter. Simple conditions use the query
+// language so that indexes can be used, others fall back to $expr
+func (t *sqlTranslator) match(e sqlExpr) (bson.D, error) {
+	if m, ok := t.queryFilter(e); ok {
+		return m, nil
+	}
+
+	if b, ok := e.(*sqlBinary); ok && b.op == "AND" {
+		left, err := t.match(b.left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := t.match(b.right)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$and", Value: bson.A{left, right}}}, nil
+	}
+
+	if containsAggregate(e) {
+		return nil, t.errorf(e, "WHERE can't contain aggregate functions")
+	}
+
+	v, err := t.expr(e)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Key: "$expr", Value: v}}, nil
+}
+
+// queryFilter translates conditions comparing a column with literals to a query filter
+func (t *sqlTranslator) queryFilter(e sqlExpr) (bson.D, bool) {
+	switch e := e.(type) {
+	case *sqlBinary:
+		if e.op == "AND" || e.op == "OR" {
+			left, ok := t.queryFilter(e.left)
+			if !ok {
+				return nil, false
+			}
+			right, ok := t.queryFilter(e.right)
+			if !ok {
+				return nil, false
+			}
+			return bson.D{{Key: "$" + strings.ToLower(e.op), Value: bson.A{left, right}}}, true
+		}
+
+		op, ok := sqlComparisons[e.op]
+		if !ok {
+			return nil, false
+		}
+
+		column, cok := e.left.(*sqlColumn)
+		value, vok := e.right.(*sqlLiteral)
+		if !cok || !vok {
+			// literal op column
+			column, cok = e.right.(*sqlColumn)
+			value, vok = e.left.(*sqlLiteral)
+			if !cok || !vok {
+				return nil, false
+			}
+			op = sqlFlippedComparisons[op]
+		}
+		return bson.D{{Key: column.path, Value: bson.D{{Key: op, Value: value.value}}}}, true
+
+	case *sqlUnary:
+		if e.op != "NOT" {
+			return nil, false
+		}
+		inner, ok := t.queryFilter(e.expr)
+		if !ok {
+			return nil, false
+		}
+		return bson.D{{Key: "$nor", Value: bson.A{inner}}}, true
+
+	case *sqlIn:
+		column, ok := e.expr.(*sqlColumn)
+		if !ok {
+			return nil, false
+		}
+		values := bson.A{}
+		for _, item := range e.list {
+			lit, ok := item.(*sqlLiteral)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, lit.value)
+		}
+		op := "$in"
+		if e.not {
+			op = "$nin"
+		}
+		return bson.D{{Key: column.path, Value: bson.D{{Key: op, Value: values}}}}, true
+
+	case *sqlIsNull:
+		column, ok := e.expr.(*sqlColumn)
+		if !ok {
+			return nil, false
+		}
+		op := "$eq"
+		if e.not {
+			op = "$ne"
+		}
+		return bson.D{{Key: column.path, Value: bson.D{{Key: op, Value: nil}}}}, true
+
+	case *sqlLike:
+		column, ok := e.expr.(*sqlColumn)
+		if !ok {
+			return nil, false
+		}
+		var cond any = bson.D{{Key: "$regex", Value: likePattern(e.pattern)}}
+		if e.not {
+			cond = bson.D{{Key: "$not", Value: cond}}
+		}
+		return bson.D{{Key: column.path, Value: cond}}, true
+	}
+
+	return nil, false
+}
+
+// formatPipeline formats a pipeline as Extended JSON for the query inspector
+func formatPipeline(pipeline []bson.D) (string, error) {
+	stages := make([]string, len(pipeline))
+	for i, stage := range pipeline {
+		b, err := bson.MarshalExtJSON(stage, false, false)
+		if err != nil {
+			return "", err
+		}
+		stages[i] = "  " + string(b)
+	}
+
+	if len(stages) == 0 {
+		return "[]", nil
+	}
+
+	return "[\n" + strings.Join(stages, ",\n") + "\n]", nil
+}
@@ -0,0 +1,145 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTranslateSQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		pipeline []string
+	}{
+		{
+			name:     "select all",
+			sql:      "SELECT * FROM orders",
+			pipeline: []string{},
+		},
+		{
+			name: "filter, sort and limit",
+			sql:  "select * from orders where status = 'paid' and amount >= 10 order by ts desc limit 5 offset 10",
+			pipeline: []string{
+				`{"$match":{"$and":[{"status":{"$eq":"paid"}},{"amount":{"$gte":10}}]}}`,
+				`{"$sort":{"ts":-1}}`,
+				`{"$skip":10}`,
+				`{"$limit":5}`,
+			},
+		},
+		{
+			name: "columns and aliases",
+			sql:  `SELECT customer.name AS "customer", amount * 2 doubled, 1 FROM orders LIMIT 3`,
+			pipeline: []string{
+				`{"$limit":3}`,
+				`{"$project":{"_id":0,"customer":"$customer.name","doubled":{"$multiply":["$amount",2]},"col3":{"$literal":1}}}`,
+			},
+		},
+		{
+			name: "sort on aliases after projection",
+			sql:  "SELECT ts AS time, value FROM metrics ORDER BY time",
+			pipeline: []string{
+				`{"$project":{"_id":0,"time":"$ts","value":"$value"}}`,
+				`{"$sort":{"time":1}}`,
+			},
+		},
+		{
+			name: "expressions fall back to $expr",
+			sql:  "SELECT * FROM orders WHERE host IN ('a', 'b') AND price * qty > 100 AND name LIKE 'a%' AND note IS NOT NULL",
+			pipeline: []string{
+				`{"$match":{"$and":[{"$and":[{"$and":[{"host":{"$in":["a","b"]}},{"$expr":{"$gt":[{"$multiply":["$price","$qty"]},100]}}]},{"name":{"$regex":"^a.*$"}}]},{"note":{"$ne":null}}]}}`,
+			},
+		},
+		{
+			name: "time filter macro",
+			sql:  "SELECT * FROM metrics WHERE $__timeFilter(ts)",
+			pipeline: []string{
+				`{"$match":{"$and":[{"ts":{"$gte":"$__timeFrom"}},{"ts":{"$lte":"$__timeTo"}}]}}`,
+			},
+		},
+		{
+			name: "group by time bucket",
+			sql:  "SELECT time_bucket('5m', ts) AS time, host, AVG(cpu), COUNT(*) AS n FROM metrics GROUP BY 1, host ORDER BY time",
+			pipeline: []string{
+				`{"$group":{"_id":{"time":{"$toDate":{"$subtract":[{"$toLong":"$ts"},{"$mod":[{"$toLong":"$ts"},300000]}]}},"host":"$host"},"agg0":{"$avg":"$cpu"},"agg1":{"$sum":1}}}`,
+				`{"$project":{"_id":0,"time":"$_id.time","host":"$_id.host","avg_cpu":"$agg0","n":"$agg1"}}`,
+				`{"$sort":{"time":1}}`,
+			},
+		},
+		{
+			name: "aggregates without group by",
+			sql:  "SELECT COUNT(status) AS n, SUM(amount) / COUNT(*) AS mean FROM orders",
+			pipeline: []string{
+				`{"$group":{"_id":null,"agg0":{"$sum":{"$cond":[{"$gt":["$status",null]},1,0]}},"agg1":{"$sum":"$amount"},"agg2":{"$sum":1}}}`,
+				`{"$project":{"_id":0,"n":"$agg0","mean":{"$divide":["$agg1","$agg2"]}}}`,
+			},
+		},
+		{
+			name: "order by aggregate",
+			sql:  "SELECT host, COUNT(*) FROM logs GROUP BY host ORDER BY COUNT(*) DESC LIMIT 10",
+			pipeline: []string{
+				`{"$group":{"_id":{"host":"$host"},"agg0":{"$sum":1}}}`,
+				`{"$project":{"_id":0,"host":"$_id.host","count":"$agg0"}}`,
+				`{"$sort":{"count":-1}}`,
+				`{"$limit":10}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("should translate "+tt.name, func(t *testing.T) {
+			_, pipeline, err := translateSQL(tt.sql)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			text, err := formatPipeline(pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := "[]"
+			if len(tt.pipeline) > 0 {
+				expected = "[\n  " + strings.Join(tt.pipeline, ",\n  ") + "\n]"
+			}
+			assertEq(t, text, expected)
+		})
+	}
+
+	t.Run("should return the collection", func(t *testing.T) {
+		collection, _, err := translateSQL("SELECT * FROM `system.profile`;")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, collection, "system.profile")
+	})
+
+	errors := []struct {
+		name   string
+		sql    string
+		line   int
+		column int
+	}{
+		{"missing FROM", "SELECT a", 1, 9},
+		{"ungrouped column", "SELECT host, COUNT(*)\nFROM logs", 1, 8},
+		{"unknown function", "SELECT foo(a) FROM logs", 1, 8},
+		{"invalid interval", "SELECT time_bucket('5 minutes', ts) FROM m GROUP BY 1", 1, 20},
+		{"unterminated string", "SELECT * FROM logs WHERE a = 'b", 1, 30},
+		{"trailing content", "SELECT * FROM logs x", 1, 20},
+		{"order by computed field", "SELECT a FROM logs ORDER BY b + 1", 1, 31},
+	}
+
+	for _, tt := range errors {
+		t.Run("should locate "+tt.name, func(t *testing.T) {
+			_, _, err := translateSQL(tt.sql)
+
+			perr, ok := err.(*pipelineError)
+			if !ok {
+				t.Fatalf("expected pipeline error, got %v", err)
+			}
+
+			if perr.Line != tt.line || perr.Column != tt.column {
+				t.Errorf("expected error at %d:%d, got %d:%d (%s)", tt.line, tt.column, perr.Line, perr.Column, perr.Message)
+			}
+		})
+	}
+}
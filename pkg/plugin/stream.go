@@ -0,0 +1,492 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// Max number of documents pushed in one frame
+	tailBatchSize = 1000
+	// How long the server waits for new documents on a tailable cursor
+	tailMaxAwaitTime = time.Second
+	// Delay before reopening a dead tailable cursor
+	tailReopenDelay = time.Second
+
+	// Bounds of the interval between two runs of a polled aggregation
+	pollDefaultInterval = 10 * time.Second
+	pollMinInterval     = 5 * time.Second
+	pollMaxInterval     = time.Hour
+
+	// How long a stream registered by QueryData is kept without running
+	streamUnusedTTL = 10 * time.Minute
+)
+
+var errStreamNotFound = errors.New("stream not found")
+
+// streamRegistry keeps the requests of the streams from QueryData until RunStream is done with them
+type streamRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*streamEntry
+}
+
+type streamEntry struct {
+	request    *streamRequest
+	registered time.Time
+	// Number of RunStream calls using the entry
+	running int
+}
+
+// store registers a stream request and forgets the streams that were never run
+func (r *streamRegistry) store(path string, sr *streamRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.entries == nil {
+		r.entries = make(map[string]*streamEntry)
+	}
+
+	now := time.Now()
+	for p, e := range r.entries {
+		if e.running == 0 && now.Sub(e.registered) > streamUnusedTTL {
+			delete(r.entries, p)
+		}
+	}
+
+	if e, ok := r.entries[path]; ok {
+		e.registered = now
+		return
+	}
+
+	r.entries[path] = &streamEntry{request: sr, registered: now}
+}
+
+func (r *streamRegistry) load(path string) (*streamRequest, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[path]
+	if !ok {
+		return nil, false
+	}
+	return e.request, true
+}
+
+// start marks the stream as running, so that it isn't forgotten
+func (r *streamRegistry) start(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.entries[path]; ok {
+		e.running++
+	}
+}
+
+// stop marks a run of the stream as done. The stream is forgotten once no run uses it and it
+// has no subscribers left
+func (r *streamRegistry) stop(path string, unsubscribed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[path]
+	if !ok {
+		return
+	}
+
+	e.running--
+	if e.running <= 0 && unsubscribed {
+		delete(r.entries, path)
+	}
+}
+
+// streamQuery registers a streaming query and returns an empty frame pointing Grafana Live at its channel
+func (d *Datasource) streamQuery(query backend.DataQuery, qm *queryModel) backend.DataResponse {
+	var response backend.DataResponse
+
+	sr := &streamRequest{Query: *qm}
+
+	switch qm.StreamMode {
+	case streamModeTail:
+		// Tailing from now doesn't depend on the time range, so all viewers share one channel
+		if qm.TailTimeField != "" {
+			sr.From = query.TimeRange.From
+			sr.To = query.TimeRange.To
+		}
+
+	case streamModePoll:
+		if sr.Query.PollInterval == 0 {
+			sr.Query.PollInterval = int(pollDefaultInterval.Seconds())
+		}
+
+		interval := time.Duration(sr.Query.PollInterval) * time.Second
+		if interval < pollMinInterval || interval > pollMaxInterval {
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Poll interval must be between %s and %s", pollMinInterval, pollMaxInterval))
+		}
+
+		// The window slides with time but keeps the length of the dashboard time range
+		if sr.Query.PollWindow <= 0 {
+			sr.Query.PollWindow = int(query.TimeRange.Duration().Seconds())
+		}
+
+		if _, err := parseQueryText(qm.QueryText, qm.QueryLanguage, nil); err != nil {
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Invalid query: %v", err.Error()))
+		}
+
+	default:
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Unsupported stream mode %s", qm.StreamMode))
+	}
+
+	path, err := streamPath(sr)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to create stream: %v", err.Error()))
+	}
+
+	d.streams.store(path, sr)
+
+	channel := live.Channel{
+		Scope:     live.ScopeDatasource,
+		Namespace: d.uid,
+		Path:      path,
+	}
+
+	frame := data.NewFrame(query.RefID)
+	frame.SetMeta(&data.FrameMeta{Channel: channel.String()})
+
+	response.Frames = append(response.Frames, frame)
+
+	return response
+}
+
+// streamPath derives the channel path from the stream mode and the query content
+func streamPath(sr *streamRequest) (string, error) {
+	b, err := json.Marshal(sr)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return sr.Query.StreamMode + "/" + hex.EncodeToString(sum[:]), nil
+}
+
+// loadStreamRequest looks up a stream registered by QueryData, or falls back to the subscription
+// data. The data must describe the stream of the path, so that clients can't run arbitrary queries
+// on channels of other streams
+func (d *Datasource) loadStreamRequest(path string, raw json.RawMessage) (*streamRequest, error) {
+	if sr, ok := d.streams.load(path); ok {
+		return sr, nil
+	}
+
+	if len(raw) == 0 {
+		return nil, errStreamNotFound
+	}
+
+	var sr streamRequest
+	if err := json.Unmarshal(raw, &sr); err != nil {
+		return nil, err
+	}
+
+	expected, err := streamPath(&sr)
+	if err != nil {
+		return nil, err
+	}
+
+	if expected != path {
+		return nil, errStreamNotFound
+	}
+
+	d.streams.store(path, &sr)
+
+	return &sr, nil
+}
+
+// SubscribeStream is called when a client wants to connect to a stream
+func (d *Datasource) SubscribeStream(ctx context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	backend.Logger.Debug("Subscribing to stream", "path", req.Path)
+
+	if _, err := d.loadStreamRequest(req.Path, req.Data); err != nil {
+		backend.Logger.Warn("Failed to subscribe to stream", "path", req.Path, "error", err)
+
+		return &backend.SubscribeStreamResponse{
+			Status: backend.SubscribeStreamStatusNotFound,
+		}, nil
+	}
+
+	return &backend.SubscribeStreamResponse{
+		Status: backend.SubscribeStreamStatusOK,
+	}, nil
+}
+
+// PublishStream is called when a client sends a message to the stream. Streams are read-only
+func (d *Datasource) PublishStream(ctx context.Context, req *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{
+		Status: backend.PublishStreamStatusPermissionDenied,
+	}, nil
+}
+
+// RunStream is called once for each channel as long as it has subscribers
+func (d *Datasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	backend.Logger.Debug("Running stream", "path", req.Path)
+
+	sr, err := d.loadStreamRequest(req.Path, req.Data)
+	if err != nil {
+		return err
+	}
+
+	// The context is cancelled when the channel has no subscribers left
+	d.streams.start(req.Path)
+	defer func() {
+		d.streams.stop(req.Path, ctx.Err() != nil)
+	}()
+
+	switch sr.Query.StreamMode {
+	case streamModeTail:
+		return d.tail(ctx, sr, sender)
+	case streamModePoll:
+		return d.poll(ctx, sr, sender)
+	default:
+		return fmt.Errorf("unsupported stream mode %s", sr.Query.StreamMode)
+	}
+}
+
+// tail follows a capped collection with a tailable cursor and pushes new documents as they arrive
+func (d *Datasource) tail(ctx context.Context, sr *streamRequest, sender *backend.StreamSender) error {
+	coll := d.client.Database(d.database).Collection(sr.Query.Collection)
+
+	filters, err := tailFilters(sr.Query.QueryText, sr.Query.QueryLanguage)
+	if err != nil {
+		return err
+	}
+
+	// Start from the beginning of the time range, or from now
+	var start bson.D
+	if sr.Query.TailTimeField != "" {
+		start = bson.D{{Key: sr.Query.TailTimeField, Value: bson.D{{Key: "$gte", Value: sr.From}}}}
+	} else {
+		start = bson.D{{Key: "_id", Value: bson.D{{Key: "$gte", Value: primitive.NewObjectIDFromTimestamp(time.Now())}}}}
+	}
+
+	opts := options.Find().
+		SetCursorType(options.TailableAwait).
+		SetMaxAwaitTime(tailMaxAwaitTime)
+
+	for {
+		cursor, err := coll.Find(ctx, bson.D{{Key: "$and", Value: append(filters, start)}}, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			backend.Logger.Error("Failed to open tailable cursor", "collection", sr.Query.Collection, "error", err)
+			return err
+		}
+
+		lastID, err := sendTailed(ctx, sr.Query.Collection, cursor, sender)
+		cursor.Close(context.Background())
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			backend.Logger.Error("Failed to tail collection", "collection", sr.Query.Collection, "error", err)
+			return err
+		}
+
+		// The cursor died, e.g. nothing matched yet. Resume after the last document seen,
+		// capped collections keep insertion order so _id is increasing
+		if lastID.Type != 0 {
+			start = bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: lastID}}}}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(tailReopenDelay):
+		}
+	}
+}
+
+// tailFilters parses the query text of a tail query, either a find filter
+// or a pipeline consisting only of $match stages
+func tailFilters(queryText string, language string) (bson.A, error) {
+	if language == queryLanguageJavaScript && strings.TrimSpace(queryText) != "" {
+		var err error
+		if queryText, err = jsToExtJSON(queryText); err != nil {
+			return nil, err
+		}
+	}
+
+	text := strings.TrimSpace(queryText)
+	filters := bson.A{}
+
+	if text == "" {
+		return filters, nil
+	}
+
+	if !strings.HasPrefix(text, "[") {
+		var filter bson.D
+		if err := bson.UnmarshalExtJSON([]byte(text), false, &filter); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal JsonExt: %w", err)
+		}
+
+		return append(filters, filter), nil
+	}
+
+	var pipeline []bson.D
+	if err := bson.UnmarshalExtJSON([]byte(text), false, &pipeline); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JsonExt: %w", err)
+	}
+
+	for _, stage := range pipeline {
+		if len(stage) != 1 || stage[0].Key != "$match" {
+			return nil, errors.New("tail queries only support $match stages")
+		}
+
+		filters = append(filters, stage[0].Value)
+	}
+
+	return filters, nil
+}
+
+// sendTailed pushes documents from the cursor until it dies and returns the _id of the last document sent
+func sendTailed(ctx context.Context, name string, cursor *mongo.Cursor, sender *backend.StreamSender) (bson.RawValue, error) {
+	var lastID bson.RawValue
+
+	for {
+		builder := newTableFrameBuilder()
+
+		// With TailableAwait TryNext blocks on the server for at most tailMaxAwaitTime
+		for builder.rows() < tailBatchSize && cursor.TryNext(ctx) {
+			if err := builder.append(cursor.Current); err != nil {
+				return lastID, err
+			}
+
+			id := cursor.Current.Lookup("_id")
+			lastID = bson.RawValue{Type: id.Type, Value: append([]byte(nil), id.Value...)}
+		}
+
+		if builder.rows() > 0 {
+			if err := sender.SendFrame(builder.frame(name), data.IncludeAll); err != nil {
+				return lastID, err
+			}
+		}
+
+		if err := cursor.Err(); err != nil {
+			return lastID, err
+		}
+
+		if cursor.ID() == 0 {
+			return lastID, nil
+		}
+	}
+}
+
+// poll re-runs the aggregation over a sliding window and pushes the rows that are new or changed
+func (d *Datasource) poll(ctx context.Context, sr *streamRequest, sender *backend.StreamSender) error {
+	pipeline, err := parseQueryText(sr.Query.QueryText, sr.Query.QueryLanguage, d.serverVersion(ctx))
+	if err != nil {
+		return fmt.Errorf("invalid query: %w", err)
+	}
+
+	pipeline, err = applyAdhocFilters(pipeline, sr.Query.AdhocFilters)
+	if err != nil {
+		return err
+	}
+
+	interval := time.Duration(sr.Query.PollInterval) * time.Second
+	window := time.Duration(sr.Query.PollWindow) * time.Second
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var tracker rowTracker
+	for {
+		to := time.Now()
+		frame, err := d.aggregate(ctx, &sr.Query, applyMacros(pipeline, to.Add(-window), to), sr.Query.Collection)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			backend.Logger.Error("Failed to poll aggregation", "collection", sr.Query.Collection, "error", err)
+			return err
+		}
+
+		delta, err := tracker.delta(frame)
+		if err != nil {
+			return err
+		}
+
+		if delta.Rows() > 0 {
+			if err := sender.SendFrame(delta, data.IncludeAll); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// rowTracker remembers the rows of the previous poll to find new or changed rows.
+// Rows are identified by _id when present, otherwise by their content.
+type rowTracker struct {
+	rows map[string]string
+}
+
+func (t *rowTracker) delta(frame *data.Frame) (*data.Frame, error) {
+	rows := make(map[string]string, frame.Rows())
+	delta := frame.EmptyCopy()
+	idField, _ := frame.FieldByName("_id")
+
+	for i := 0; i < frame.Rows(); i++ {
+		row := frame.RowCopy(i)
+
+		// Hash the values by field name, documents don't always list their fields in the same order
+		values := make(map[string]any, len(row))
+		for j, field := range frame.Fields {
+			values[field.Name] = row[j]
+		}
+
+		b, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		hash := hex.EncodeToString(sum[:])
+
+		key := hash
+		if idField != nil {
+			if v, ok := idField.ConcreteAt(i); ok {
+				key = fmt.Sprint(v)
+			}
+		}
+
+		if prev, ok := t.rows[key]; !ok || prev != hash {
+			delta.AppendRow(row...)
+		}
+		rows[key] = hash
+	}
+
+	t.rows = rows
+
+	return delta, nil
+}
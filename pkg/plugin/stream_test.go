@@ -0,0 +1,378 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStreamQuery(t *testing.T) {
+	timeRange := backend.TimeRange{
+		From: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC),
+	}
+
+	t.Run("should return a frame with the live channel", func(t *testing.T) {
+		ds := Datasource{uid: "ds1"}
+		qm := queryModel{Collection: "events", StreamMode: streamModeTail}
+
+		res := ds.streamQuery(backend.DataQuery{RefID: "A", TimeRange: timeRange}, &qm)
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+
+		if len(res.Frames) != 1 || res.Frames[0].Meta == nil {
+			t.Fatal("expected one frame with meta")
+		}
+
+		channel, err := live.ParseChannel(res.Frames[0].Meta.Channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if channel.Scope != live.ScopeDatasource || channel.Namespace != "ds1" || !strings.HasPrefix(channel.Path, "tail/") {
+			t.Errorf("unexpected channel %s", res.Frames[0].Meta.Channel)
+		}
+
+		sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: channel.Path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub.Status != backend.SubscribeStreamStatusOK {
+			t.Errorf("expected subscription to be allowed, got %v", sub.Status)
+		}
+	})
+
+	t.Run("should share the channel when tailing from now", func(t *testing.T) {
+		ds := Datasource{uid: "ds1"}
+		qm := queryModel{Collection: "events", StreamMode: streamModeTail}
+
+		res1 := ds.streamQuery(backend.DataQuery{RefID: "A", TimeRange: timeRange}, &qm)
+		res2 := ds.streamQuery(backend.DataQuery{RefID: "B", TimeRange: backend.TimeRange{From: time.Now(), To: time.Now()}}, &qm)
+
+		if res1.Frames[0].Meta.Channel != res2.Frames[0].Meta.Channel {
+			t.Error("expected the same channel")
+		}
+	})
+
+	t.Run("should depend on time range when tailing from a time field", func(t *testing.T) {
+		ds := Datasource{uid: "ds1"}
+		qm := queryModel{Collection: "events", StreamMode: streamModeTail, TailTimeField: "ts"}
+
+		res1 := ds.streamQuery(backend.DataQuery{RefID: "A", TimeRange: timeRange}, &qm)
+		res2 := ds.streamQuery(backend.DataQuery{RefID: "A", TimeRange: backend.TimeRange{From: time.Now(), To: time.Now()}}, &qm)
+
+		if res1.Frames[0].Meta.Channel == res2.Frames[0].Meta.Channel {
+			t.Error("expected different channels")
+		}
+	})
+
+	t.Run("should default poll interval and window", func(t *testing.T) {
+		ds := Datasource{uid: "ds1"}
+		qm := queryModel{Collection: "events", QueryText: "[]", StreamMode: streamModePoll}
+
+		res := ds.streamQuery(backend.DataQuery{RefID: "A", TimeRange: timeRange}, &qm)
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+
+		channel, err := live.ParseChannel(res.Frames[0].Meta.Channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sr, err := ds.loadStreamRequest(channel.Path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sr.Query.PollInterval != 10 || sr.Query.PollWindow != 3600 {
+			t.Errorf("unexpected poll interval %d and window %d", sr.Query.PollInterval, sr.Query.PollWindow)
+		}
+	})
+
+	t.Run("should reject poll interval out of bounds", func(t *testing.T) {
+		ds := Datasource{uid: "ds1"}
+
+		for _, interval := range []int{1, 7200} {
+			qm := queryModel{Collection: "events", QueryText: "[]", StreamMode: streamModePoll, PollInterval: interval}
+
+			res := ds.streamQuery(backend.DataQuery{RefID: "A", TimeRange: timeRange}, &qm)
+			if res.Error == nil {
+				t.Errorf("expected error for interval %d", interval)
+			}
+		}
+	})
+
+	t.Run("should reject unknown stream mode", func(t *testing.T) {
+		ds := Datasource{uid: "ds1"}
+		qm := queryModel{Collection: "events", StreamMode: "foo"}
+
+		res := ds.streamQuery(backend.DataQuery{RefID: "A"}, &qm)
+		if res.Error == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestSubscribeStream(t *testing.T) {
+	t.Run("should reject unknown path", func(t *testing.T) {
+		ds := Datasource{uid: "ds1"}
+
+		sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: "tail/unknown"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub.Status != backend.SubscribeStreamStatusNotFound {
+			t.Errorf("expected not found, got %v", sub.Status)
+		}
+	})
+
+	t.Run("should accept stream request from subscription data", func(t *testing.T) {
+		ds := Datasource{uid: "ds1"}
+		sr := streamRequest{Query: queryModel{Collection: "events", StreamMode: streamModeTail}}
+		raw, err := json.Marshal(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path, err := streamPath(&sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: path, Data: raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub.Status != backend.SubscribeStreamStatusOK {
+			t.Errorf("expected subscription to be allowed, got %v", sub.Status)
+		}
+	})
+
+	t.Run("should reject subscription data of another path", func(t *testing.T) {
+		ds := Datasource{uid: "ds1"}
+		raw, err := json.Marshal(streamRequest{Query: queryModel{Collection: "events", StreamMode: streamModeTail}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: "tail/custom", Data: raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sub.Status != backend.SubscribeStreamStatusNotFound {
+			t.Errorf("expected not found, got %v", sub.Status)
+		}
+	})
+}
+
+func TestStreamRegistry(t *testing.T) {
+	sr := &streamRequest{Query: queryModel{Collection: "events", StreamMode: streamModeTail}}
+
+	t.Run("should forget a stream when its last run is unsubscribed", func(t *testing.T) {
+		var r streamRegistry
+		r.store("tail/a", sr)
+
+		r.start("tail/a")
+		r.start("tail/a")
+
+		r.stop("tail/a", true)
+		if _, ok := r.load("tail/a"); !ok {
+			t.Fatal("expected stream to be kept while another run uses it")
+		}
+
+		r.stop("tail/a", true)
+		if _, ok := r.load("tail/a"); ok {
+			t.Error("expected stream to be forgotten")
+		}
+	})
+
+	t.Run("should keep a stream after a failed run", func(t *testing.T) {
+		var r streamRegistry
+		r.store("tail/a", sr)
+
+		r.start("tail/a")
+		r.stop("tail/a", false)
+
+		if _, ok := r.load("tail/a"); !ok {
+			t.Error("expected stream to be kept")
+		}
+	})
+
+	t.Run("should forget streams that were never run", func(t *testing.T) {
+		var r streamRegistry
+		r.store("tail/old", sr)
+		r.store("tail/running", sr)
+		r.start("tail/running")
+
+		r.entries["tail/old"].registered = time.Now().Add(-2 * streamUnusedTTL)
+		r.entries["tail/running"].registered = time.Now().Add(-2 * streamUnusedTTL)
+
+		r.store("tail/new", sr)
+
+		if _, ok := r.load("tail/old"); ok {
+			t.Error("expected unused stream to be forgotten")
+		}
+		if _, ok := r.load("tail/running"); !ok {
+			t.Error("expected running stream to be kept")
+		}
+		if len(r.entries) != 2 {
+			t.Errorf("expected 2 streams, got %d", len(r.entries))
+		}
+	})
+}
+
+func TestTailFilters(t *testing.T) {
+	t.Run("should accept empty query", func(t *testing.T) {
+		for _, text := range []string{"", "[]"} {
+			filters, err := tailFilters(text, queryLanguageJSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(filters) != 0 {
+				t.Errorf("expected no filters for %q, got %v", text, filters)
+			}
+		}
+	})
+
+	t.Run("should accept filter document", func(t *testing.T) {
+		filters, err := tailFilters(`{"level": "error"}`, queryLanguageJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filters) != 1 {
+			t.Errorf("expected 1 filter, got %v", filters)
+		}
+	})
+
+	t.Run("should accept $match stages", func(t *testing.T) {
+		filters, err := tailFilters(`[{"$match": {"level": "error"}}, {"$match": {"host": "a"}}]`, queryLanguageJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filters) != 2 {
+			t.Errorf("expected 2 filters, got %v", filters)
+		}
+	})
+
+	t.Run("should accept javascript filter", func(t *testing.T) {
+		filters, err := tailFilters(`{level: 'error'}`, queryLanguageJavaScript)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, filters, bson.A{bson.D{{Key: "level", Value: "error"}}})
+	})
+
+	t.Run("should reject other stages", func(t *testing.T) {
+		_, err := tailFilters(`[{"$project": {"level": 1}}]`, queryLanguageJSON)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestRowTracker(t *testing.T) {
+	t.Run("should return new and changed rows by _id", func(t *testing.T) {
+		var tracker rowTracker
+
+		first := data.NewFrame("A",
+			data.NewField("_id", nil, []*string{pointer("a"), pointer("b")}),
+			data.NewField("v", nil, []*int32{pointer[int32](1), pointer[int32](2)}),
+		)
+
+		delta, err := tracker.delta(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delta.Rows() != 2 {
+			t.Errorf("expected all rows on first poll, got %d", delta.Rows())
+		}
+
+		second := data.NewFrame("A",
+			data.NewField("_id", nil, []*string{pointer("a"), pointer("b"), pointer("c")}),
+			data.NewField("v", nil, []*int32{pointer[int32](1), pointer[int32](5), pointer[int32](3)}),
+		)
+
+		delta, err = tracker.delta(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := data.NewFrame("A",
+			data.NewField("_id", nil, []*string{pointer("b"), pointer("c")}),
+			data.NewField("v", nil, []*int32{pointer[int32](5), pointer[int32](3)}),
+		)
+		if !cmp.Equal(delta, expected, dataFrameComparer) {
+			t.Error("unexpected delta frame")
+		}
+	})
+
+	t.Run("should compare rows by content without _id", func(t *testing.T) {
+		var tracker rowTracker
+
+		frame := data.NewFrame("A", data.NewField("v", nil, []*int32{pointer[int32](1), pointer[int32](2)}))
+		if _, err := tracker.delta(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		delta, err := tracker.delta(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delta.Rows() != 0 {
+			t.Errorf("expected no rows for unchanged result, got %d", delta.Rows())
+		}
+	})
+
+	t.Run("should return no rows when polling the same documents again", func(t *testing.T) {
+		poll := func(docs ...bson.D) *data.Frame {
+			builder := newTableFrameBuilder()
+			for _, doc := range docs {
+				raw, err := bson.Marshal(doc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := builder.append(raw); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return builder.frame("A")
+		}
+
+		var tracker rowTracker
+
+		first, err := tracker.delta(poll(
+			bson.D{{Key: "host", Value: "a"}, {Key: "cpu", Value: 1.5}, {Key: "mem", Value: int32(10)}, {Key: "disk", Value: int32(3)}},
+			bson.D{{Key: "host", Value: "b"}, {Key: "cpu", Value: 2.5}, {Key: "mem", Value: int32(20)}, {Key: "disk", Value: int32(4)}},
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Rows() != 2 {
+			t.Fatalf("expected 2 rows, got %d", first.Rows())
+		}
+
+		for range 10 {
+			// The same documents with their fields in another order
+			delta, err := tracker.delta(poll(
+				bson.D{{Key: "disk", Value: int32(3)}, {Key: "mem", Value: int32(10)}, {Key: "cpu", Value: 1.5}, {Key: "host", Value: "a"}},
+				bson.D{{Key: "disk", Value: int32(4)}, {Key: "mem", Value: int32(20)}, {Key: "cpu", Value: 2.5}, {Key: "host", Value: "b"}},
+			))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if delta.Rows() != 0 {
+				t.Fatalf("expected no rows, got %d", delta.Rows())
+			}
+		}
+	})
+}
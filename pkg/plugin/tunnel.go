@@ -0,0 +1,393 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/haohanyang/mongodb-datasource/pkg/models"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sshDefaultPort = 22
+	// Interval of the keepalive requests, a lost connection is detected within two intervals
+	sshKeepAliveInterval = 30 * time.Second
+	// Time a failed dial waits for the connection to be closed, a broken transport is noticed
+	// right away by the reader of the connection
+	sshLostTimeout = time.Second
+)
+
+var errTunnelClosed = errors.New("ssh tunnel is closed")
+
+// dialFunc opens a network connection, like net.Dialer.DialContext
+type dialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// sshTunnel dials the MongoDB servers through an SSH server. The SSH connection is opened on the
+// first dial and opened again by the next dial after it's lost, so the driver reconnects by itself
+type sshTunnel struct {
+	addr   string
+	config *ssh.ClientConfig
+	dial   dialFunc
+
+	mu         sync.Mutex
+	conn       *sshConnection
+	connecting *sshConnectAttempt
+	closed     bool
+}
+
+// sshConnectAttempt is a connection attempt shared by concurrent dials
+type sshConnectAttempt struct {
+	done chan struct{}
+	conn *sshConnection
+	err  error
+}
+
+// sshConnection is an SSH connection, done is closed once the connection is lost
+type sshConnection struct {
+	client *ssh.Client
+	done   chan struct{}
+}
+
+// lost reports whether the connection is lost, waiting shortly for it to be closed
+func (c *sshConnection) lost(ctx context.Context) bool {
+	timer := time.NewTimer(sshLostTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.done:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// newSSHTunnel returns the tunnel of the settings, or nil if the tunnel is disabled
+func newSSHTunnel(config *models.PluginSettings, dial dialFunc) (*sshTunnel, error) {
+	if !config.SshTunnelEnabled {
+		return nil, nil
+	}
+
+	if config.SshHost == "" {
+		return nil, errors.New("missing SSH host")
+	}
+
+	if config.SshUser == "" {
+		return nil, errors.New("missing SSH user")
+	}
+
+	auth, err := sshAuthMethods(config.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := sshHostKeyCallback(config)
+	if err != nil {
+		return nil, err
+	}
+
+	port := config.SshPort
+	if port == 0 {
+		port = sshDefaultPort
+	}
+
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	return &sshTunnel{
+		addr: net.JoinHostPort(config.SshHost, strconv.Itoa(port)),
+		config: &ssh.ClientConfig{
+			User:            config.SshUser,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         10 * time.Second,
+		},
+		dial: dial,
+	}, nil
+}
+
+// sshAuthMethods returns the private key and password authentication, the key is tried first
+func sshAuthMethods(secrets *models.SecretPluginSettings) ([]ssh.AuthMethod, error) {
+	if secrets == nil {
+		return nil, errors.New("missing SSH private key or password")
+	}
+
+	var methods []ssh.AuthMethod
+
+	if secrets.SshPrivateKey != "" {
+		var signer ssh.Signer
+		var err error
+		if secrets.SshPrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(secrets.SshPrivateKey), []byte(secrets.SshPrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(secrets.SshPrivateKey))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH private key: %w", err)
+		}
+
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if secrets.SshPassword != "" {
+		methods = append(methods, ssh.Password(secrets.SshPassword))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("missing SSH private key or password")
+	}
+
+	return methods, nil
+}
+
+// sshHostKeyCallback checks the server key against the pinned host key, or the known hosts file
+func sshHostKeyCallback(config *models.PluginSettings) (ssh.HostKeyCallback, error) {
+	if config.SshHostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.SshHostKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH host key: %w", err)
+		}
+		return ssh.FixedHostKey(key), nil
+	}
+
+	if config.SshKnownHostsPath != "" {
+		callback, err := knownhosts.New(config.SshKnownHostsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SSH known hosts: %w", err)
+		}
+		return callback, nil
+	}
+
+	return nil, errors.New("missing SSH host key or known hosts file")
+}
+
+// DialContext opens a connection to address from the SSH server
+func (t *sshTunnel) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	sc, err := t.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sc.client.DialContext(ctx, network, address)
+	if err == nil {
+		return conn, nil
+	}
+
+	// The SSH connection may have dropped since the last dial, then the dial is retried once on
+	// a new one. A cancelled dial or a channel rejected by the server leave the connection working
+	var openErr *ssh.OpenChannelError
+	if ctx.Err() != nil || errors.As(err, &openErr) || !sc.lost(ctx) || !t.drop(sc) {
+		return nil, fmt.Errorf("failed to dial %s through ssh tunnel: %w", address, err)
+	}
+
+	sc, err = t.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err = sc.client.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s through ssh tunnel: %w", address, err)
+	}
+
+	return conn, nil
+}
+
+// sshClient returns the SSH connection, connecting if there is none. Concurrent dials wait
+// for the same connection attempt, which runs without holding the lock
+func (t *sshTunnel) sshClient(ctx context.Context) (*sshConnection, error) {
+	t.mu.Lock()
+
+	if t.closed {
+		t.mu.Unlock()
+		return nil, errTunnelClosed
+	}
+
+	if t.conn != nil {
+		sc := t.conn
+		t.mu.Unlock()
+		return sc, nil
+	}
+
+	// The attempt is detached from the dial that started it, so that the other dials waiting
+	// for it don't fail if that one is cancelled
+	attempt := t.connecting
+	if attempt == nil {
+		attempt = &sshConnectAttempt{done: make(chan struct{})}
+		t.connecting = attempt
+		go t.connect(context.WithoutCancel(ctx), attempt)
+	}
+
+	t.mu.Unlock()
+
+	select {
+	case <-attempt.done:
+		return attempt.conn, attempt.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// connect opens the SSH connection of the attempt and installs it as the current one
+func (t *sshTunnel) connect(ctx context.Context, attempt *sshConnectAttempt) {
+	sc, err := t.open(ctx)
+
+	t.mu.Lock()
+	t.connecting = nil
+	if err == nil && t.closed {
+		sc.client.Close()
+		sc, err = nil, errTunnelClosed
+	}
+	if err == nil {
+		t.conn = sc
+	}
+	attempt.conn, attempt.err = sc, err
+	t.mu.Unlock()
+
+	close(attempt.done)
+
+	if err != nil {
+		return
+	}
+
+	backend.Logger.Debug("Opened ssh tunnel", "server", t.addr)
+
+	go t.keepAlive(sc)
+}
+
+// open dials the SSH server and runs the handshake, both bounded by the timeout of the config
+func (t *sshTunnel) open(ctx context.Context) (*sshConnection, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.config.Timeout)
+	defer cancel()
+
+	conn, err := t.dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh server %s: %w", t.addr, err)
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, t.addr, t.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to ssh server %s: %w", t.addr, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	sc := &sshConnection{
+		client: ssh.NewClient(c, chans, reqs),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		sc.client.Wait()
+		close(sc.done)
+	}()
+
+	return sc, nil
+}
+
+// keepAlive pings the SSH server until the connection is closed. A connection that doesn't
+// answer is closed, so that the next dial opens a new one
+func (t *sshTunnel) keepAlive(sc *sshConnection) {
+	client := sc.client
+
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sc.done:
+			if t.drop(sc) {
+				backend.Logger.Warn("Lost ssh tunnel connection, reconnecting on the next query", "server", t.addr)
+			}
+			return
+		case <-ticker.C:
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+
+			select {
+			case err := <-reply:
+				if err != nil {
+					client.Close()
+				}
+			case <-time.After(sshKeepAliveInterval):
+				client.Close()
+			case <-sc.done:
+			}
+		}
+	}
+}
+
+// drop forgets the SSH connection if it's still the current one. It returns true if the
+// connection was dropped now or before, meaning the next dial uses a new connection
+func (t *sshTunnel) drop(sc *sshConnection) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+
+	if t.conn == sc {
+		t.conn = nil
+		sc.client.Close()
+	}
+
+	return true
+}
+
+// Close closes the SSH connection, the tunnel can't be used afterwards
+func (t *sshTunnel) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+
+	if t.conn == nil {
+		return nil
+	}
+
+	err := t.conn.client.Close()
+	t.conn = nil
+	return err
+}
+
+// DialContext makes dialFunc a dialer of the driver
+func (f dialFunc) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// setDialer routes the connections of the driver through the SSH tunnel of the settings, and
+// through dial, which is nil to connect directly. With both, the SSH server is dialed by dial.
+// The returned tunnel is nil if it's disabled, otherwise it must be closed after the client
+func setDialer(config *models.PluginSettings, opts *options.ClientOptions, dial dialFunc) (*sshTunnel, error) {
+	tunnel, err := newSSHTunnel(config, dial)
+	if err != nil {
+		return nil, err
+	}
+
+	if tunnel != nil {
+		opts.SetDialer(tunnel)
+	} else if dial != nil {
+		opts.SetDialer(dial)
+	}
+
+	return tunnel, nil
+}
@@ -0,0 +1,522 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haohanyang/mongodb-datasource/pkg/models"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an SSH server forwarding direct-tcpip channels, like sshd
+type testSSHServer struct {
+	addr    string
+	hostKey ssh.PublicKey
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestSSHServer(t *testing.T, password string, clientKey ssh.PublicKey) *testSSHServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostSigner, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if conn.User() == "grafana" && password != "" && string(p) == password {
+				return nil, nil
+			}
+			return nil, errors.New("invalid password")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "grafana" && clientKey != nil && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("invalid key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testSSHServer{addr: listener.Addr().String(), hostKey: hostSigner.PublicKey()}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+
+			go s.serve(conn, config)
+		}
+	}()
+
+	return s
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		var payload struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		channel, channelReqs, err := newChannel.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelReqs)
+
+		go func() {
+			io.Copy(channel, target)
+			channel.Close()
+		}()
+		go func() {
+			io.Copy(target, channel)
+			target.Close()
+		}()
+	}
+}
+
+// dropConnections closes the connections of the clients and returns how many there were
+func (s *testSSHServer) dropConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.conns)
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	return n
+}
+
+func (s *testSSHServer) settings() *models.PluginSettings {
+	host, port, _ := net.SplitHostPort(s.addr)
+	p, _ := strconv.Atoi(port)
+
+	return &models.PluginSettings{
+		SshTunnelEnabled: true,
+		SshHost:          host,
+		SshPort:          p,
+		SshUser:          "grafana",
+		SshHostKey:       string(ssh.MarshalAuthorizedKey(s.hostKey)),
+		Secrets: &models.SecretPluginSettings{
+			SshPassword: "secret",
+		},
+	}
+}
+
+// startEchoServer returns the address of a server writing back what it reads
+func startEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func assertEcho(t *testing.T, tunnel *sshTunnel, addr string) {
+	t.Helper()
+
+	conn, err := tunnel.DialContext(t.Context(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "ping" {
+		t.Fatalf("expected ping, got %s", buf)
+	}
+}
+
+func TestSSHTunnel(t *testing.T) {
+	echo := startEchoServer(t)
+
+	t.Run("should dial through the tunnel with a password", func(t *testing.T) {
+		server := newTestSSHServer(t, "secret", nil)
+
+		tunnel, err := newSSHTunnel(server.settings(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+
+		assertEcho(t, tunnel, echo)
+		assertEcho(t, tunnel, echo)
+
+		if n := server.dropConnections(); n != 1 {
+			t.Errorf("expected 1 ssh connection, got %d", n)
+		}
+	})
+
+	t.Run("should dial through the tunnel with a private key", func(t *testing.T) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("passphrase"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := newTestSSHServer(t, "", signer.PublicKey())
+
+		config := server.settings()
+		config.Secrets = &models.SecretPluginSettings{
+			SshPrivateKey:           string(pem.EncodeToMemory(block)),
+			SshPrivateKeyPassphrase: "passphrase",
+		}
+
+		tunnel, err := newSSHTunnel(config, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+
+		assertEcho(t, tunnel, echo)
+	})
+
+	t.Run("should reconnect after the connection is lost", func(t *testing.T) {
+		server := newTestSSHServer(t, "secret", nil)
+
+		tunnel, err := newSSHTunnel(server.settings(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+
+		assertEcho(t, tunnel, echo)
+
+		if n := server.dropConnections(); n != 1 {
+			t.Fatalf("expected 1 ssh connection, got %d", n)
+		}
+
+		assertEcho(t, tunnel, echo)
+
+		if n := server.dropConnections(); n != 1 {
+			t.Errorf("expected a new ssh connection, got %d", n)
+		}
+	})
+
+	t.Run("should check known hosts", func(t *testing.T) {
+		server := newTestSSHServer(t, "secret", nil)
+
+		path := filepath.Join(t.TempDir(), "known_hosts")
+		line := knownhosts.Line([]string{knownhosts.Normalize(server.addr)}, server.hostKey)
+		if err := os.WriteFile(path, []byte(line+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		config := server.settings()
+		config.SshHostKey = ""
+		config.SshKnownHostsPath = path
+
+		tunnel, err := newSSHTunnel(config, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+
+		assertEcho(t, tunnel, echo)
+	})
+
+	t.Run("should reject an unknown host key", func(t *testing.T) {
+		server := newTestSSHServer(t, "secret", nil)
+		other := newTestSSHServer(t, "secret", nil)
+
+		config := server.settings()
+		config.SshHostKey = string(ssh.MarshalAuthorizedKey(other.hostKey))
+
+		tunnel, err := newSSHTunnel(config, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+
+		if _, err := tunnel.DialContext(t.Context(), "tcp", echo); err == nil {
+			t.Fatalf("expected host key error, got nil")
+		}
+	})
+
+	t.Run("should return error for a refused address", func(t *testing.T) {
+		server := newTestSSHServer(t, "secret", nil)
+
+		tunnel, err := newSSHTunnel(server.settings(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := listener.Addr().String()
+		listener.Close()
+
+		if _, err := tunnel.DialContext(t.Context(), "tcp", closed); err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+
+		// The ssh connection is kept
+		assertEcho(t, tunnel, echo)
+		if n := server.dropConnections(); n != 1 {
+			t.Errorf("expected 1 ssh connection, got %d", n)
+		}
+	})
+
+	t.Run("should keep the connection after a cancelled dial", func(t *testing.T) {
+		server := newTestSSHServer(t, "secret", nil)
+
+		tunnel, err := newSSHTunnel(server.settings(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+
+		assertEcho(t, tunnel, echo)
+		client := tunnel.conn.client
+
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		if _, err := tunnel.DialContext(ctx, "tcp", echo); err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+
+		assertEcho(t, tunnel, echo)
+		if tunnel.conn.client != client {
+			t.Errorf("expected the ssh client to be reused")
+		}
+		if n := server.dropConnections(); n != 1 {
+			t.Errorf("expected 1 ssh connection, got %d", n)
+		}
+	})
+
+	t.Run("should close while connecting", func(t *testing.T) {
+		server := newTestSSHServer(t, "secret", nil)
+
+		dialing := make(chan struct{})
+		release := make(chan struct{})
+		dial := func(ctx context.Context, network string, address string) (net.Conn, error) {
+			close(dialing)
+			<-release
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}
+
+		tunnel, err := newSSHTunnel(server.settings(), dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := tunnel.DialContext(t.Context(), "tcp", echo)
+			errs <- err
+		}()
+		<-dialing
+
+		// The lock isn't held while the ssh server is dialed
+		closed := make(chan struct{})
+		go func() {
+			tunnel.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatalf("expected close not to wait for the connection attempt")
+		}
+
+		close(release)
+		if err := <-errs; !errors.Is(err, errTunnelClosed) {
+			t.Fatalf("expected tunnel closed error, got %v", err)
+		}
+	})
+
+	t.Run("should not dial after close", func(t *testing.T) {
+		server := newTestSSHServer(t, "secret", nil)
+
+		tunnel, err := newSSHTunnel(server.settings(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEcho(t, tunnel, echo)
+
+		if err := tunnel.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tunnel.DialContext(t.Context(), "tcp", echo); !errors.Is(err, errTunnelClosed) {
+			t.Fatalf("expected tunnel closed error, got %v", err)
+		}
+	})
+}
+
+func TestNewSSHTunnel(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey := string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+
+	valid := func() *models.PluginSettings {
+		return &models.PluginSettings{
+			SshTunnelEnabled: true,
+			SshHost:          "bastion.example.com",
+			SshUser:          "grafana",
+			SshHostKey:       hostKey,
+			Secrets:          &models.SecretPluginSettings{SshPassword: "secret"},
+		}
+	}
+
+	t.Run("should return nil when disabled", func(t *testing.T) {
+		opts := options.Client()
+		tunnel, err := setDialer(&models.PluginSettings{}, opts, nil)
+		if err != nil || tunnel != nil {
+			t.Fatalf("expected no tunnel, got %v, %v", tunnel, err)
+		}
+
+		if opts.Dialer != nil {
+			t.Errorf("expected no dialer")
+		}
+	})
+
+	t.Run("should set the dialer", func(t *testing.T) {
+		opts := options.Client()
+		tunnel, err := setDialer(valid(), opts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tunnel.Close()
+
+		if opts.Dialer != tunnel {
+			t.Errorf("expected the tunnel as dialer, got %v", opts.Dialer)
+		}
+
+		expected := "bastion.example.com:22"
+		if tunnel.addr != expected {
+			t.Errorf("expected address %s, got %s", expected, tunnel.addr)
+		}
+	})
+
+	errorCases := []struct {
+		name   string
+		modify func(*models.PluginSettings)
+	}{
+		{"missing host", func(c *models.PluginSettings) { c.SshHost = "" }},
+		{"missing user", func(c *models.PluginSettings) { c.SshUser = "" }},
+		{"missing credentials", func(c *models.PluginSettings) { c.Secrets = &models.SecretPluginSettings{} }},
+		{"invalid private key", func(c *models.PluginSettings) { c.Secrets.SshPrivateKey = "not a key" }},
+		{"missing host key", func(c *models.PluginSettings) { c.SshHostKey = "" }},
+		{"invalid host key", func(c *models.PluginSettings) { c.SshHostKey = "ssh-ed25519 invalid" }},
+		{"missing known hosts file", func(c *models.PluginSettings) {
+			c.SshHostKey = ""
+			c.SshKnownHostsPath = filepath.Join(t.TempDir(), "missing")
+		}},
+	}
+
+	for _, tt := range errorCases {
+		t.Run(fmt.Sprintf("should return error for %s", tt.name), func(t *testing.T) {
+			config := valid()
+			tt.modify(config)
+
+			if _, err := newSSHTunnel(config, nil); err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+		})
+	}
+}
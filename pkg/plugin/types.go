@@ -1,6 +1,9 @@
 package plugin
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -8,8 +11,15 @@ import (
 // Datasource is a mongo datasource which can respond to data queries, reports
 // its health and has streaming skills.
 type Datasource struct {
+	uid             string
 	database        string
 	client          *mongo.Client
+	tunnel          *sshTunnel
+	cache           *queryCache
+	inflight        inflightGroup
+	streams         streamRegistry
+	schemas         *ttlCache[*collectionSchema]
+	version         serverVersionCache
 	resourceHandler backend.CallResourceHandler
 }
 
@@ -18,7 +28,25 @@ type queryModel struct {
 	Collection    string `json:"collection"`
 	QueryLanguage string `json:"queryLanguage"`
 
-	// Aggregate options
+	// Visual query builder, used with the builder query language
+	Builder *builderModel `json:"builder"`
+
+	// Grafana ad-hoc filters, applied as a $match stage
+	AdhocFilters []adhocFilter `json:"adhocFilters"`
+
+	// Skip the query result cache for this query
+	CacheBypass bool `json:"cacheBypass"`
+
+	// Live streaming
+	StreamMode    string `json:"streamMode"`
+	TailTimeField string `json:"tailTimeField"`
+	PollInterval  int    `json:"pollInterval"`
+	PollWindow    int    `json:"pollWindow"`
+
+	aggregateOptions
+}
+
+type aggregateOptions struct {
 	AggregateComment                  string `json:"aggregateComment"`
 	AggregateMaxTimeMS                int    `json:"aggregateMaxTimeMS"`
 	AggregateBatchSize                int32  `json:"aggregateBatchSize"`
@@ -30,9 +58,69 @@ type queryModel struct {
 type variableQueryRequest struct {
 	Collection string `json:"collection"`
 	Query      string `json:"queryText"`
+
+	// Empty to run the query text, or distinct to list the values of a field
+	Mode string `json:"mode"`
+	// Field and optional query filter of the distinct mode
+	Field  string `json:"field"`
+	Filter string `json:"filter"`
+
+	// Dashboard time range in epoch milliseconds and interval, used by the macros
+	From       int64 `json:"from"`
+	To         int64 `json:"to"`
+	IntervalMs int64 `json:"intervalMs"`
+
+	// Max number of values, defaults to variableDefaultLimit
+	Limit int `json:"limit"`
+
+	variableFormat
+}
+
+type variableQueryResult struct {
+	Values []variableQueryEntry `json:"values"`
+	// Whether values were left out because of the limit
+	Truncated bool `json:"truncated"`
+}
+
+// variableFormat tells how variable values are read from the query results
+type variableFormat struct {
+	// Field paths of the value and the text, default to value and text
+	ValueField string `json:"valueField"`
+	TextField  string `json:"textField"`
+	// Go time layout of date values, defaults to RFC 3339
+	DateFormat string `json:"dateFormat"`
+	// Empty to keep the order of the results
+	Sort string `json:"sort"`
 }
 
 type variableQueryEntry struct {
 	Value any    `json:"value"`
 	Text  string `json:"text"`
 }
+
+// collectionInfo is the response entry of the collection listing endpoint
+type collectionInfo struct {
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	ReadOnly   bool            `json:"readOnly"`
+	TimeSeries *timeSeriesInfo `json:"timeseries,omitempty"`
+	View       *viewInfo       `json:"view,omitempty"`
+}
+
+type timeSeriesInfo struct {
+	TimeField   string `json:"timeField"`
+	MetaField   string `json:"metaField,omitempty"`
+	Granularity string `json:"granularity,omitempty"`
+}
+
+type viewInfo struct {
+	ViewOn   string          `json:"viewOn"`
+	Pipeline json.RawMessage `json:"pipeline"`
+}
+
+// streamRequest is the query behind a live channel
+type streamRequest struct {
+	Query queryModel `json:"query"`
+	From  time.Time  `json:"from"`
+	To    time.Time  `json:"to"`
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -60,6 +61,24 @@ func PrintDataFrame(dataFrame *data.Frame) {
 	}
 }
 
+// rawValueToJson renders a BSON value as relaxed extended JSON. The value is wrapped
+// in a document since bson.MarshalExtJSON only accepts documents
+func rawValueToJson(value bson.RawValue) (json.RawMessage, error) {
+	b, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var wrapped struct {
+		V json.RawMessage `json:"v"`
+	}
+	if err := json.Unmarshal(b, &wrapped); err != nil {
+		return nil, err
+	}
+
+	return wrapped.V, nil
+}
+
 func pointer[K any](val K) *K {
 	return &val
 }
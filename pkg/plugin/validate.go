@@ -0,0 +1,373 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Aggregation stages and the server version that introduced them. Unknown stages are left to
+// the server, which may support stages newer than this list
+var pipelineStages = map[string][]int{
+	"$addFields":                   {3, 4},
+	"$bucket":                      {3, 4},
+	"$bucketAuto":                  {3, 4},
+	"$changeStream":                {3, 6},
+	"$changeStreamSplitLargeEvent": {7, 0},
+	"$collStats":                   {3, 4},
+	"$count":                       {3, 4},
+	"$currentOp":                   {3, 6},
+	"$densify":                     {5, 1},
+	"$documents":                   {5, 1},
+	"$facet":                       {3, 4},
+	"$fill":                        {5, 3},
+	"$geoNear":                     {2, 4},
+	"$graphLookup":                 {3, 4},
+	"$group":                       {2, 2},
+	"$indexStats":                  {3, 2},
+	"$limit":                       {2, 2},
+	"$listLocalSessions":           {3, 6},
+	"$listSampledQueries":          {7, 0},
+	"$listSearchIndexes":           {7, 0},
+	"$listSessions":                {3, 6},
+	"$lookup":                      {3, 2},
+	"$match":                       {2, 2},
+	"$merge":                       {4, 2},
+	"$out":                         {2, 6},
+	"$planCacheStats":              {4, 2},
+	"$project":                     {2, 2},
+	"$redact":                      {2, 6},
+	"$replaceRoot":                 {3, 4},
+	"$replaceWith":                 {4, 2},
+	"$sample":                      {3, 2},
+	"$search":                      {4, 2},
+	"$searchMeta":                  {4, 4},
+	"$set":                         {4, 2},
+	"$setWindowFields":             {5, 0},
+	"$shardedDataDistribution":     {6, 0},
+	"$skip":                        {2, 2},
+	"$sort":                        {2, 2},
+	"$sortByCount":                 {3, 4},
+	"$unionWith":                   {4, 4},
+	"$unset":                       {4, 2},
+	"$unwind":                      {2, 2},
+	"$vectorSearch":                {7, 0},
+	// Placeholder replaced by ad-hoc filters
+	adhocFiltersStage: nil,
+}
+
+// pipelineError is an error at a position of the query text
+type pipelineError struct {
+	Message string `json:"message"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	// Byte offset of the position
+	offset int
+}
+
+func (e *pipelineError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+func newPipelineError(text string, offset int, message string) *pipelineError {
+	if offset > len(text) {
+		offset = len(text)
+	}
+
+	line := strings.Count(text[:offset], "\n") + 1
+	column := utf8.RuneCountInString(text[strings.LastIndex(text[:offset], "\n")+1:offset]) + 1
+
+	return &pipelineError{
+		Message: message,
+		Line:    line,
+		Column:  column,
+		offset:  offset,
+	}
+}
+
+// validationRequest is the body of the validation endpoint
+type validationRequest struct {
+	QueryText string `json:"queryText"`
+	// Defaults to JSON
+	QueryLanguage string `json:"queryLanguage"`
+}
+
+type validationResult struct {
+	Valid         bool             `json:"valid"`
+	Errors        []*pipelineError `json:"errors"`
+	Warnings      []*pipelineError `json:"warnings"`
+	ServerVersion string           `json:"serverVersion,omitempty"`
+}
+
+// pipelineStage is a parsed stage and its offset in the query text
+type pipelineStage struct {
+	Stage  bson.D
+	Offset int
+}
+
+// parsePipelineStages parses the query text stage by stage, so that errors can be located
+func parsePipelineStages(text string) ([]pipelineStage, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, jsonError(text, dec, err)
+	}
+
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, newPipelineError(text, skipSpace(text, 0), "query should be an array of stages")
+	}
+
+	stages := make([]pipelineStage, 0)
+	for dec.More() {
+		offset := skipSpace(text, int(dec.InputOffset()))
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, jsonError(text, dec, err)
+		}
+
+		var stage bson.D
+		if err := bson.UnmarshalExtJSON(raw, false, &stage); err != nil {
+			return nil, newPipelineError(text, offset, fmt.Sprintf("invalid stage: %v", err))
+		}
+
+		stages = append(stages, pipelineStage{Stage: stage, Offset: offset})
+	}
+
+	// Closing bracket
+	if _, err := dec.Token(); err != nil {
+		return nil, jsonError(text, dec, err)
+	}
+
+	end := skipSpace(text, int(dec.InputOffset()))
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, newPipelineError(text, end, "unexpected content after the pipeline")
+	}
+
+	return stages, nil
+}
+
+// skipSpace returns the offset of the next value, skipping white space and separators
+func skipSpace(text string, offset int) int {
+	for offset < len(text) && strings.ContainsRune(" \t\r\n,", rune(text[offset])) {
+		offset++
+	}
+	return offset
+}
+
+func jsonError(text string, dec *json.Decoder, err error) *pipelineError {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) && int(syntaxErr.Offset) < len(text) {
+		// The offset is right after the offending character
+		return newPipelineError(text, int(syntaxErr.Offset)-1, syntaxErr.Error())
+	}
+
+	if syntaxErr != nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return newPipelineError(text, len(text), "unexpected end of query")
+	}
+
+	return newPipelineError(text, int(dec.InputOffset()), err.Error())
+}
+
+// validatePipelineStages checks that every stage is a single-field document with a stage name
+// that is supported by the server. Unknown stage names are returned as warnings. version may be
+// nil if the server version is unknown
+func validatePipelineStages(text string, stages []pipelineStage, version []int) ([]*pipelineError, []*pipelineError) {
+	errs := make([]*pipelineError, 0)
+	warnings := make([]*pipelineError, 0)
+
+	for _, s := range stages {
+		if len(s.Stage) != 1 {
+			errs = append(errs, newPipelineError(text, s.Offset, fmt.Sprintf("a stage should have exactly one field, got %d", len(s.Stage))))
+			continue
+		}
+
+		name := s.Stage[0].Key
+		minVersion, ok := pipelineStages[name]
+		if !ok {
+			warnings = append(warnings, newPipelineError(text, s.Offset, fmt.Sprintf("unknown stage %s", name)))
+			continue
+		}
+
+		if version != nil && minVersion != nil && compareVersions(version, minVersion) < 0 {
+			errs = append(errs, newPipelineError(text, s.Offset, fmt.Sprintf("stage %s requires MongoDB %s, the server runs %s", name, formatVersion(minVersion), formatVersion(version))))
+		}
+	}
+
+	return errs, warnings
+}
+
+// parsePipeline parses and validates the query text, returning the first error found
+func parsePipeline(text string, version []int) ([]bson.D, error) {
+	stages, err := parsePipelineStages(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return stagesPipeline(text, stages, version)
+}
+
+// stagesPipeline validates the stages located in the query text and returns the pipeline
+func stagesPipeline(text string, stages []pipelineStage, version []int) ([]bson.D, error) {
+	if errs, _ := validatePipelineStages(text, stages, version); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	pipeline := make([]bson.D, len(stages))
+	for i, s := range stages {
+		pipeline[i] = s.Stage
+	}
+
+	return pipeline, nil
+}
+
+func compareVersions(a []int, b []int) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] - b[i]
+		}
+	}
+	return len(a) - len(b)
+}
+
+func formatVersion(version []int) string {
+	parts := make([]string, len(version))
+	for i, v := range version {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, ".")
+}
+
+const (
+	// Timeout of the buildInfo command, which runs detached from the query that needs the version
+	serverVersionTimeout = 10 * time.Second
+	// After a failure, queries don't wait for the version until the interval has passed
+	serverVersionRetryInterval = 30 * time.Second
+)
+
+// serverVersionCache holds the version of the connected server, which is fetched once by the
+// first query that needs it. Failures are cached for a short time
+type serverVersionCache struct {
+	mu       sync.Mutex
+	version  []int
+	failedAt time.Time
+	// Closed when the running fetch is done, nil if there is none
+	fetching chan struct{}
+}
+
+// serverVersion returns the version of the connected server, or nil if it can't be determined
+func (d *Datasource) serverVersion(ctx context.Context) []int {
+	c := &d.version
+
+	c.mu.Lock()
+	if c.version != nil || time.Since(c.failedAt) < serverVersionRetryInterval {
+		defer c.mu.Unlock()
+		return c.version
+	}
+
+	done := c.fetching
+	if done == nil {
+		done = make(chan struct{})
+		c.fetching = done
+		go d.fetchServerVersion(context.WithoutCancel(ctx), done)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// fetchServerVersion runs buildInfo and stores the result, then closes done
+func (d *Datasource) fetchServerVersion(ctx context.Context, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(ctx, serverVersionTimeout)
+	defer cancel()
+
+	var result struct {
+		VersionArray []int `bson:"versionArray"`
+	}
+
+	err := d.client.Database("admin").RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&result)
+
+	c := &d.version
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		backend.Logger.Debug("Failed to get server version", "error", err)
+		c.failedAt = time.Now()
+	} else {
+		// versionArray is [major, minor, patch, build]
+		if len(result.VersionArray) > 3 {
+			result.VersionArray = result.VersionArray[:3]
+		}
+		c.version = result.VersionArray
+	}
+
+	c.fetching = nil
+	close(done)
+}
+
+func (d *Datasource) validateHandler(rw http.ResponseWriter, req *http.Request) {
+	var body validationRequest
+
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		http.Error(rw, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	version := d.serverVersion(req.Context())
+	result := validationResult{
+		Warnings:      make([]*pipelineError, 0),
+		ServerVersion: formatVersion(version),
+	}
+
+	text := body.QueryText
+
+	var stages []pipelineStage
+	switch body.QueryLanguage {
+	case queryLanguageMongosh:
+		// Stages of a shell query can't be located, only the call chain is checked
+		_, err = parseShellQuery(text)
+	case queryLanguageSQL:
+		_, _, err = translateSQL(text)
+	case queryLanguageJavaScript:
+		stages, err = parseJSPipelineStages(text)
+	default:
+		stages, err = parsePipelineStages(text)
+	}
+
+	if err != nil {
+		var perr *pipelineError
+		if !errors.As(err, &perr) {
+			perr = newPipelineError(text, 0, err.Error())
+		}
+		result.Errors = []*pipelineError{perr}
+	} else {
+		result.Errors, result.Warnings = validatePipelineStages(text, stages, version)
+	}
+
+	result.Valid = len(result.Errors) == 0
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(result)
+}
@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestParsePipeline(t *testing.T) {
+	t.Run("should parse valid pipeline", func(t *testing.T) {
+		pipeline, err := parsePipeline(`[
+  {"$match": {"a": 1}},
+  {"$limit": 10}
+]`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEq(t, pipeline, []bson.D{
+			{{Key: "$match", Value: bson.D{{Key: "a", Value: int32(1)}}}},
+			{{Key: "$limit", Value: int32(10)}},
+		})
+	})
+
+	t.Run("should accept empty pipeline", func(t *testing.T) {
+		pipeline, err := parsePipeline(" [ ] ", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pipeline) != 0 {
+			t.Errorf("expected empty pipeline, got %v", pipeline)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		text   string
+		line   int
+		column int
+	}{
+		{"syntax error", "[\n  {\"$match\": {\"a\": 1,}}\n]", 2, 22},
+		{"not an array", `{"$match": {}}`, 1, 1},
+		{"unexpected end", "[\n  {\"$match\": {}}", 2, 17},
+		{"invalid extended json", "[\n  {\"$match\": {}},\n  {\"$match\": {\"d\": {\"$date\": \"foo\"}}}\n]", 3, 3},
+		{"multiple fields", "[{\"$match\": {}, \"$limit\": 1}]", 1, 2},
+		{"trailing content", "[] []", 1, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run("should locate "+tt.name, func(t *testing.T) {
+			_, err := parsePipeline(tt.text, nil)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+
+			perr, ok := err.(*pipelineError)
+			if !ok {
+				t.Fatalf("expected pipelineError, got %T", err)
+			}
+
+			if perr.Line != tt.line || perr.Column != tt.column {
+				t.Errorf("expected error at %d:%d, got %d:%d (%s)", tt.line, tt.column, perr.Line, perr.Column, perr.Message)
+			}
+		})
+	}
+
+	t.Run("should check stage against server version", func(t *testing.T) {
+		text := `[{"$setWindowFields": {}}]`
+
+		if _, err := parsePipeline(text, []int{4, 4, 0}); err == nil {
+			t.Error("expected error for MongoDB 4.4")
+		}
+
+		if _, err := parsePipeline(text, []int{5, 0, 1}); err != nil {
+			t.Errorf("expected no error for MongoDB 5.0, got %v", err)
+		}
+	})
+
+	t.Run("should leave unknown stages to the server", func(t *testing.T) {
+		text := "[\n  {\"$match\": {}},\n\t{\"$foo\": 1}\n]"
+		if _, err := parsePipeline(text, []int{7, 0, 0}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		stages, err := parsePipelineStages(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs, warnings := validatePipelineStages(text, stages, []int{7, 0, 0})
+		if len(errs) != 0 {
+			t.Errorf("expected no errors, got %v", errs)
+		}
+		if len(warnings) != 1 || warnings[0].Line != 3 || warnings[0].Column != 2 {
+			t.Errorf("expected a warning at 3:2, got %v", warnings)
+		}
+	})
+
+	t.Run("should accept ad-hoc filters placeholder", func(t *testing.T) {
+		if _, err := parsePipeline(`[{"$__adhocFilters": {}}]`, []int{7, 0, 0}); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestServerVersion(t *testing.T) {
+	// Nothing listens on the port, so buildInfo fails after the server selection timeout
+	client, err := mongo.Connect(context.Background(), options.Client().
+		ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+
+	t.Run("should return without waiting for a cancelled context", func(t *testing.T) {
+		ds := &Datasource{client: client}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if version := ds.serverVersion(ctx); version != nil {
+			t.Fatalf("expected no version, got %v", version)
+		}
+	})
+
+	t.Run("should cache failures", func(t *testing.T) {
+		ds := &Datasource{client: client}
+
+		if version := ds.serverVersion(context.Background()); version != nil {
+			t.Fatalf("expected no version, got %v", version)
+		}
+
+		start := time.Now()
+		if version := ds.serverVersion(context.Background()); version != nil {
+			t.Fatalf("expected no version, got %v", version)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("expected the cached failure, took %v", elapsed)
+		}
+	})
+}
@@ -1,5 +1,6 @@
 import React, { ChangeEvent, useState } from 'react';
 import {
+  Alert,
   Button,
   InlineField,
   InlineFieldRow,
@@ -7,6 +8,7 @@ import {
   ControlledCollapse,
   InlineSwitch,
   Modal,
+  Select,
   useTheme2,
   SegmentAsync,
   ComboboxOption,
@@ -16,8 +18,9 @@ import { QueryEditorProps, LoadingState } from '@grafana/data';
 import { EJSON } from 'bson';
 import { parseFilter } from 'mongodb-query-parser';
 import { MongoDBDataSource } from '../datasource';
-import { MongoDataSourceOptions, MongoDBQuery, QueryLanguage } from '../types';
+import { MongoDataSourceOptions, MongoDBQuery, QueryLanguage, StreamMode } from '../types';
 import { QueryEditorRaw } from './QueryEditorRaw';
+import { QueryEditorBuilder } from './QueryEditorBuilder';
 import { QueryToolbox } from './QueryToolbox';
 import validator from 'validator';
 
@@ -26,6 +29,15 @@ type Props = QueryEditorProps<MongoDBDataSource, MongoDBQuery, MongoDataSourceOp
 const languageOptions: Array<ComboboxOption<string>> = [
   { label: 'JSON', value: QueryLanguage.JSON },
   { label: 'JavaScript', value: QueryLanguage.JAVASCRIPT },
+  { label: 'mongosh', value: QueryLanguage.MONGOSH },
+  { label: 'SQL', value: QueryLanguage.SQL },
+  { label: 'Builder', value: QueryLanguage.BUILDER },
+];
+
+const streamModeOptions = [
+  { label: 'None', value: StreamMode.NONE },
+  { label: 'Tail', value: StreamMode.TAIL },
+  { label: 'Poll', value: StreamMode.POLL },
 ];
 
 export function QueryEditor(props: Props) {
@@ -36,7 +48,9 @@ export function QueryEditor(props: Props) {
   const [queryTextError, setQueryTextError] = useState<string | undefined>(undefined);
   const [parsedQuery, setParsedQuery] = useState<string>('');
   const [isAggregateOptionExpanded, setIsAggregateOptionExpanded] = useState(false);
+  const [isStreamOptionExpanded, setIsStreamOptionExpanded] = useState(!!query.streamMode);
   const [isEditorExpanded, setIsEditorExpanded] = useState(false);
+  const [builderError, setBuilderError] = useState<string | undefined>(undefined);
 
   const renderCodeEditor = (showTools: boolean, width?: number, height?: number) => {
     return (
@@ -80,11 +94,32 @@ export function QueryEditor(props: Props) {
             <InlineField label="Language" transparent>
               <InlineSelect
                 options={languageOptions}
-                value={query.queryLanguage === QueryLanguage.JAVASCRIPT ? QueryLanguage.JAVASCRIPT : QueryLanguage.JSON}
+                value={
+                  languageOptions.some((op) => op.value === query.queryLanguage) ? query.queryLanguage : QueryLanguage.JSON
+                }
                 onChange={(op) => props.onChange({ ...query, queryLanguage: op.value })}
               />
             </InlineField>
             <FlexItem grow={1} />
+            {query.queryLanguage === QueryLanguage.BUILDER && (
+              <Button
+                icon="pen"
+                variant="secondary"
+                size="sm"
+                tooltip="Replaces the builder with the pipeline of the query"
+                onClick={() =>
+                  props.datasource
+                    .compileBuilderQuery(query.builder ?? {}, props.data?.request?.intervalMs)
+                    .then((queryText) => {
+                      setBuilderError(undefined);
+                      props.onChange({ ...query, queryLanguage: QueryLanguage.JSON, queryText });
+                    })
+                    .catch((e) => setBuilderError(e?.data?.message ?? e?.message ?? 'Failed to compile the query'))
+                }
+              >
+                Edit as JSON
+              </Button>
+            )}
             <Button
               icon="play"
               variant="primary"
@@ -96,48 +131,66 @@ export function QueryEditor(props: Props) {
             </Button>
           </EditorHeader>
         )}
-        <QueryEditorRaw
-          query={query.queryText ?? ''}
-          language={query.queryLanguage === QueryLanguage.JAVASCRIPT ? QueryLanguage.JAVASCRIPT : QueryLanguage.JSON}
-          onBlur={(queryText_: string) => {
-            let queryText = queryText_.trim();
-            props.onChange({ ...query, queryText });
-            if (query.queryLanguage === QueryLanguage.JSON) {
-              if (!validator.isJSON(queryText)) {
-                setQueryTextError('Query should be a valid JSON');
-              } else {
-                setQueryTextError(undefined);
-              }
-            } else {
-              try {
-                // Remove trailing semicolons
-                queryText = queryText.replace(/;+$/, '');
+        {query.queryLanguage === QueryLanguage.BUILDER ? (
+          <>
+            <QueryEditorBuilder
+              builder={query.builder ?? {}}
+              collection={query.collection}
+              datasource={props.datasource}
+              onChange={(builder) => props.onChange({ ...query, builder })}
+            />
+            {builderError && <Alert title={builderError} severity="error" />}
+          </>
+        ) : (
+          <QueryEditorRaw
+            query={query.queryText ?? ''}
+            language={
+              query.queryLanguage === QueryLanguage.SQL
+                ? 'sql'
+                : query.queryLanguage === QueryLanguage.JAVASCRIPT || query.queryLanguage === QueryLanguage.MONGOSH
+                  ? QueryLanguage.JAVASCRIPT
+                  : QueryLanguage.JSON
+            }
+            onBlur={(queryText_: string) => {
+              let queryText = queryText_.trim();
+              props.onChange({ ...query, queryText });
+              if (query.queryLanguage === QueryLanguage.JSON) {
+                if (!validator.isJSON(queryText)) {
+                  setQueryTextError('Query should be a valid JSON');
+                } else {
+                  setQueryTextError(undefined);
+                }
+              } else if (query.queryLanguage !== QueryLanguage.MONGOSH && query.queryLanguage !== QueryLanguage.SQL) {
+                try {
+                  // Remove trailing semicolons
+                  queryText = queryText.replace(/;+$/, '');
 
-                const parsed = EJSON.stringify(parseFilter(queryText));
-                setParsedQuery(parsed);
-                setQueryTextError(undefined);
-              } catch (e) {
-                setParsedQuery((e as Error).toString());
-                setQueryTextError(`Query should be a valid JavaScript: ${(e as Error).message}`);
+                  const parsed = EJSON.stringify(parseFilter(queryText));
+                  setParsedQuery(parsed);
+                  setQueryTextError(undefined);
+                } catch (e) {
+                  setParsedQuery((e as Error).toString());
+                  setQueryTextError(`Query should be a valid JavaScript: ${(e as Error).message}`);
+                }
               }
-            }
-          }}
-          width={width}
-          height={height}
-          fontSize={14}
-        >
-          {({ formatQuery }) => {
-            return (
-              <QueryToolbox
-                isExpanded={isEditorExpanded}
-                onExpand={setIsEditorExpanded}
-                onFormatCode={formatQuery}
-                showTools={showTools}
-                error={queryTextError}
-              />
-            );
-          }}
-        </QueryEditorRaw>
+            }}
+            width={width}
+            height={height}
+            fontSize={14}
+          >
+            {({ formatQuery }) => {
+              return (
+                <QueryToolbox
+                  isExpanded={isEditorExpanded}
+                  onExpand={setIsEditorExpanded}
+                  onFormatCode={formatQuery}
+                  showTools={showTools}
+                  error={queryTextError}
+                />
+              );
+            }}
+          </QueryEditorRaw>
+        )}
       </>
     );
   };
@@ -243,6 +296,18 @@ export function QueryEditor(props: Props) {
               }
             />
           </InlineField>
+          <InlineField
+            label="Bypass cache"
+            tooltip="If true, the query always runs on the server instead of using the query result cache of the datasource."
+          >
+            <InlineSwitch
+              id="query-editor-cache-bypass"
+              value={query.cacheBypass}
+              onChange={(evt: ChangeEvent<HTMLInputElement>) =>
+                props.onChange({ ...query, cacheBypass: evt.target.checked })
+              }
+            />
+          </InlineField>
           <InlineField
             label="Bypass document validation"
             tooltip="If true, writes executed as part of the operation will opt out of document-level validation on the server. This option is valid for MongoDB versions >= 3.2 and is ignored for previous server versions. The default value is false."
@@ -257,6 +322,85 @@ export function QueryEditor(props: Props) {
           </InlineField>
         </InlineFieldRow>
       </ControlledCollapse>
+      <ControlledCollapse
+        label="Streaming options"
+        isOpen={isStreamOptionExpanded}
+        onToggle={() => setIsStreamOptionExpanded(!isStreamOptionExpanded)}
+      >
+        <InlineFieldRow>
+          <InlineField
+            label="Stream mode"
+            tooltip="Tail pushes new documents of a capped collection as they are inserted. Poll reruns the query periodically over a sliding time window."
+          >
+            <Select
+              id="query-editor-stream-mode"
+              width={15}
+              options={streamModeOptions}
+              value={query.streamMode ?? StreamMode.NONE}
+              onChange={(e) => props.onChange({ ...query, streamMode: e.value || undefined })}
+            />
+          </InlineField>
+          {query.streamMode === StreamMode.TAIL && (
+            <InlineField
+              label="Tail time field"
+              tooltip="Date field of the documents. If set, tailing starts from the beginning of the dashboard time range instead of from now."
+            >
+              <Input
+                id="query-editor-tail-time-field"
+                width={25}
+                placeholder="Field"
+                defaultValue={query.tailTimeField}
+                onBlur={(evt) => props.onChange({ ...query, tailTimeField: evt.currentTarget.value.trim() || undefined })}
+              />
+            </InlineField>
+          )}
+          {query.streamMode === StreamMode.POLL && (
+            <>
+              <InlineField
+                label="Poll interval(s)"
+                tooltip="Seconds between two runs of the query, between 5 and 3600. The default value is 10."
+              >
+                <Input
+                  id="query-editor-poll-interval"
+                  width={12}
+                  placeholder="10"
+                  value={query.pollInterval}
+                  onChange={(evt: ChangeEvent<HTMLInputElement>) => {
+                    if (!evt.target.value) {
+                      props.onChange({ ...query, pollInterval: undefined });
+                    } else if (validator.isInt(evt.target.value, { gt: 0 })) {
+                      props.onChange({ ...query, pollInterval: parseInt(evt.target.value, 10) });
+                    }
+                  }}
+                />
+              </InlineField>
+              <InlineField
+                label="Poll window(s)"
+                tooltip="Length in seconds of the time window ending at each run. The default value is the length of the dashboard time range."
+              >
+                <Input
+                  id="query-editor-poll-window"
+                  width={12}
+                  value={query.pollWindow}
+                  onChange={(evt: ChangeEvent<HTMLInputElement>) => {
+                    if (!evt.target.value) {
+                      props.onChange({ ...query, pollWindow: undefined });
+                    } else if (validator.isInt(evt.target.value, { gt: 0 })) {
+                      props.onChange({ ...query, pollWindow: parseInt(evt.target.value, 10) });
+                    }
+                  }}
+                />
+              </InlineField>
+            </>
+          )}
+        </InlineFieldRow>
+        {query.streamMode === StreamMode.POLL && (
+          <Alert title="The time window only slides for queries using $__timeFrom and $__timeTo" severity="info">
+            Each run replaces $__timeFrom and $__timeTo with the bounds of the window. A pipeline without these macros
+            returns the same documents on every run.
+          </Alert>
+        )}
+      </ControlledCollapse>
       {process.env.NODE_ENV === 'development' && query.queryLanguage === QueryLanguage.JAVASCRIPT && (
         <code>{parsedQuery}</code>
       )}
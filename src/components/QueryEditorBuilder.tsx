@@ -0,0 +1,227 @@
+import React, { useEffect, useState } from 'react';
+import { Button, IconButton, InlineField, InlineFieldRow, InlineSwitch, Input, Select } from '@grafana/ui';
+import { SelectableValue } from '@grafana/data';
+import { MongoDBDataSource } from '../datasource';
+import { BuilderAggregationType, MongoDBBuilderQuery } from '../types';
+
+type BuilderFilter = NonNullable<MongoDBBuilderQuery['filters']>[number];
+type BuilderAggregation = NonNullable<MongoDBBuilderQuery['aggregations']>[number];
+
+interface QueryEditorBuilderProps {
+  builder: MongoDBBuilderQuery;
+  collection?: string;
+  datasource: MongoDBDataSource;
+  onChange: (builder: MongoDBBuilderQuery) => void;
+}
+
+const operatorOptions = ['=', '!=', '<', '<=', '>', '>=', 'in', 'nin', 'exists', 'regex'].map((op) => ({
+  label: op,
+  value: op,
+}));
+
+const aggregationOptions = [
+  { label: 'Count', value: BuilderAggregationType.COUNT },
+  { label: 'Sum', value: BuilderAggregationType.SUM },
+  { label: 'Average', value: BuilderAggregationType.AVG },
+  { label: 'Min', value: BuilderAggregationType.MIN },
+  { label: 'Max', value: BuilderAggregationType.MAX },
+  { label: 'Percentile', value: BuilderAggregationType.PERCENTILE },
+];
+
+// Values of in and nin are typed as comma separated lists
+const listOperators = ['in', 'nin'];
+
+export function QueryEditorBuilder({ builder, collection, datasource, onChange }: QueryEditorBuilderProps) {
+  const [fields, setFields] = useState<Array<SelectableValue<string>>>([]);
+
+  // Field paths sampled from the collection, custom paths can still be typed
+  useEffect(() => {
+    if (!collection) {
+      setFields([]);
+      return;
+    }
+    datasource
+      .getCollectionSchema(collection)
+      .then((schema) => setFields(schema.fields.map((f) => ({ label: f.path, value: f.path }))))
+      .catch(() => setFields([]));
+  }, [datasource, collection]);
+
+  const filters = builder.filters ?? [];
+  const aggregations = builder.aggregations ?? [];
+
+  const setFilter = (i: number, filter: BuilderFilter) =>
+    onChange({ ...builder, filters: filters.map((f, j) => (j === i ? filter : f)) });
+
+  const setAggregation = (i: number, aggregation: BuilderAggregation) =>
+    onChange({ ...builder, aggregations: aggregations.map((a, j) => (j === i ? aggregation : a)) });
+
+  const fieldSelect = (value: string | undefined, onSelect: (field: string) => void, width = 25) => (
+    <Select
+      width={width}
+      options={fields}
+      value={value ? { label: value, value } : null}
+      onChange={(e) => onSelect(e?.value ?? '')}
+      allowCustomValue
+      isClearable
+      placeholder="Field"
+    />
+  );
+
+  return (
+    <div>
+      <InlineFieldRow>
+        <InlineField label="Time field" tooltip="Limits the documents to the dashboard time range">
+          {fieldSelect(builder.timeField, (timeField) => onChange({ ...builder, timeField }))}
+        </InlineField>
+        <InlineField
+          label="Bucket interval"
+          tooltip="Groups the documents by time, like 5m or 1h. auto follows the panel interval, empty doesn't bucket"
+        >
+          <Input
+            width={12}
+            placeholder="auto"
+            defaultValue={builder.bucketInterval}
+            onBlur={(e) => onChange({ ...builder, bucketInterval: e.currentTarget.value.trim() || undefined })}
+          />
+        </InlineField>
+        <InlineField label="Limit" tooltip="Max number of documents or groups">
+          <Input
+            type="number"
+            width={12}
+            defaultValue={builder.limit}
+            onBlur={(e) => onChange({ ...builder, limit: parseInt(e.currentTarget.value, 10) || undefined })}
+          />
+        </InlineField>
+      </InlineFieldRow>
+
+      {filters.map((filter, i) => (
+        <InlineFieldRow key={`filter-${i}`}>
+          <InlineField label={i === 0 ? 'Where' : 'And'} labelWidth={12}>
+            {fieldSelect(filter.field, (field) => setFilter(i, { ...filter, field }))}
+          </InlineField>
+          <InlineField>
+            <Select
+              width={12}
+              options={operatorOptions}
+              value={filter.operator}
+              onChange={(e) => {
+                const operator = e.value ?? '=';
+                const value = operator === 'exists' ? true : listOperators.includes(operator) ? [] : '';
+                setFilter(i, { ...filter, operator, value });
+              }}
+            />
+          </InlineField>
+          <InlineField>
+            {filter.operator === 'exists' ? (
+              <InlineSwitch
+                value={filter.value !== false}
+                onChange={(e) => setFilter(i, { ...filter, value: e.currentTarget.checked })}
+              />
+            ) : (
+              <Input
+                width={30}
+                placeholder={listOperators.includes(filter.operator) ? 'a, b, c' : 'Value'}
+                value={Array.isArray(filter.value) ? filter.value.join(', ') : String(filter.value ?? '')}
+                onChange={(e) => {
+                  const text = e.currentTarget.value;
+                  setFilter(i, {
+                    ...filter,
+                    value: listOperators.includes(filter.operator) ? text.split(',').map((v) => v.trim()) : text,
+                  });
+                }}
+              />
+            )}
+          </InlineField>
+          <IconButton
+            name="trash-alt"
+            tooltip="Remove filter"
+            onClick={() => onChange({ ...builder, filters: filters.filter((_, j) => j !== i) })}
+          />
+        </InlineFieldRow>
+      ))}
+
+      {aggregations.map((aggregation, i) => (
+        <InlineFieldRow key={`aggregation-${i}`}>
+          <InlineField label={i === 0 ? 'Aggregate' : 'And'} labelWidth={12}>
+            <Select
+              width={15}
+              options={aggregationOptions}
+              value={aggregation.type}
+              onChange={(e) => {
+                const type = e.value ?? BuilderAggregationType.COUNT;
+                const percentile = type === BuilderAggregationType.PERCENTILE ? aggregation.percentile ?? 95 : undefined;
+                setAggregation(i, { ...aggregation, type, percentile });
+              }}
+            />
+          </InlineField>
+          {aggregation.type !== BuilderAggregationType.COUNT && (
+            <InlineField>{fieldSelect(aggregation.field, (field) => setAggregation(i, { ...aggregation, field }))}</InlineField>
+          )}
+          {aggregation.type === BuilderAggregationType.PERCENTILE && (
+            <InlineField label="p" tooltip="Percentile between 0 and 100">
+              <Input
+                type="number"
+                width={8}
+                value={aggregation.percentile ?? ''}
+                onChange={(e) => {
+                  const percentile = parseFloat(e.currentTarget.value);
+                  setAggregation(i, { ...aggregation, percentile: isNaN(percentile) ? undefined : percentile });
+                }}
+              />
+            </InlineField>
+          )}
+          <InlineField label="As">
+            <Input
+              width={15}
+              placeholder="Output field"
+              value={aggregation.alias ?? ''}
+              onChange={(e) => setAggregation(i, { ...aggregation, alias: e.currentTarget.value || undefined })}
+            />
+          </InlineField>
+          <IconButton
+            name="trash-alt"
+            tooltip="Remove aggregation"
+            onClick={() => onChange({ ...builder, aggregations: aggregations.filter((_, j) => j !== i) })}
+          />
+        </InlineFieldRow>
+      ))}
+
+      <InlineFieldRow>
+        <InlineField label="Group by" tooltip="Fields whose values group the aggregations">
+          <Select
+            width={50}
+            isMulti
+            options={fields}
+            value={(builder.groupBy ?? []).map((field) => ({ label: field, value: field }))}
+            onChange={(values: Array<SelectableValue<string>>) =>
+              onChange({ ...builder, groupBy: values.map((v) => v.value!).filter((v) => v) })
+            }
+            allowCustomValue
+            placeholder="Fields"
+          />
+        </InlineField>
+      </InlineFieldRow>
+
+      <InlineFieldRow>
+        <Button
+          icon="plus"
+          variant="secondary"
+          size="sm"
+          onClick={() => onChange({ ...builder, filters: [...filters, { field: '', operator: '=', value: '' }] })}
+        >
+          Filter
+        </Button>
+        <Button
+          icon="plus"
+          variant="secondary"
+          size="sm"
+          onClick={() =>
+            onChange({ ...builder, aggregations: [...aggregations, { type: BuilderAggregationType.COUNT }] })
+          }
+        >
+          Aggregation
+        </Button>
+      </InlineFieldRow>
+    </div>
+  );
+}
@@ -1,7 +1,7 @@
 import React from 'react';
-import { InlineField, Alert, InlineFieldRow, SegmentAsync } from '@grafana/ui';
+import { InlineField, Alert, InlineFieldRow, SegmentAsync, Input, Select } from '@grafana/ui';
 import { QueryEditorProps } from '@grafana/data';
-import { MongoDataSourceOptions, MongoDBQuery, MongoDBVariableQuery } from '../types';
+import { MongoDataSourceOptions, MongoDBQuery, MongoDBVariableQuery, VariableQueryMode, VariableSort } from '../types';
 import { QueryEditorRaw } from './QueryEditorRaw';
 import { MongoDBDataSource } from 'datasource';
 
@@ -12,6 +12,17 @@ export type VariableQueryEditorProps = QueryEditorProps<
   MongoDBVariableQuery
 >;
 
+const modeOptions = [
+  { label: 'Query', value: VariableQueryMode.PIPELINE },
+  { label: 'Distinct field values', value: VariableQueryMode.DISTINCT },
+];
+
+const sortOptions = [
+  { label: 'Query order', value: VariableSort.NONE },
+  { label: 'Ascending', value: VariableSort.ASC },
+  { label: 'Descending', value: VariableSort.DESC },
+];
+
 export const VariableQueryEditor = ({ onChange, query, onRunQuery, datasource }: VariableQueryEditorProps) => {
   return (
     <div>
@@ -50,6 +61,87 @@ export const VariableQueryEditor = ({ onChange, query, onRunQuery, datasource }:
             allowCustomValue
           />
         </InlineField>
+        <InlineField label="Mode">
+          <Select
+            width={25}
+            options={modeOptions}
+            value={query.mode ?? VariableQueryMode.PIPELINE}
+            onChange={(e) => onChange({ ...query, mode: e.value })}
+          />
+        </InlineField>
+        <InlineField label="Limit" tooltip="Max number of values, defaults to 1000">
+          <Input
+            type="number"
+            placeholder="1000"
+            width={12}
+            defaultValue={query.limit}
+            onBlur={(e) => onChange({ ...query, limit: parseInt(e.currentTarget.value, 10) || undefined })}
+          />
+        </InlineField>
+      </InlineFieldRow>
+      {query.mode === VariableQueryMode.DISTINCT ? (
+        <>
+          <InlineFieldRow>
+            <InlineField label="Field" tooltip="Path of the field whose distinct values are listed">
+              <Input
+                placeholder="host"
+                width={30}
+                defaultValue={query.field}
+                onBlur={(e) => onChange({ ...query, field: e.currentTarget.value })}
+              />
+            </InlineField>
+          </InlineFieldRow>
+          <QueryEditorRaw
+            query={query.filter ?? ''}
+            language="json"
+            onBlur={(filter) => onChange({ ...query, filter })}
+            height={150}
+            fontSize={14}
+          />
+        </>
+      ) : (
+        <VariablePipelineEditor query={query} onChange={onChange} />
+      )}
+    </div>
+  );
+};
+
+const VariablePipelineEditor = ({ query, onChange }: Pick<VariableQueryEditorProps, 'query' | 'onChange'>) => {
+  return (
+    <div>
+      <InlineFieldRow>
+        <InlineField label="Value field" tooltip="Path of the value field, e.g. host.id">
+          <Input
+            placeholder="value"
+            width={20}
+            defaultValue={query.valueField}
+            onBlur={(e) => onChange({ ...query, valueField: e.currentTarget.value })}
+          />
+        </InlineField>
+        <InlineField label="Text field" tooltip="Path of the display text field">
+          <Input
+            placeholder="text"
+            width={20}
+            defaultValue={query.textField}
+            onBlur={(e) => onChange({ ...query, textField: e.currentTarget.value })}
+          />
+        </InlineField>
+        <InlineField label="Date format" tooltip="Go time layout of date values">
+          <Input
+            placeholder="2006-01-02T15:04:05Z07:00"
+            width={30}
+            defaultValue={query.dateFormat}
+            onBlur={(e) => onChange({ ...query, dateFormat: e.currentTarget.value })}
+          />
+        </InlineField>
+        <InlineField label="Sort">
+          <Select
+            width={20}
+            options={sortOptions}
+            value={query.sort ?? VariableSort.NONE}
+            onChange={(e) => onChange({ ...query, sort: e.value })}
+          />
+        </InlineField>
       </InlineFieldRow>
       <QueryEditorRaw
         query={query.queryText ?? ''}
@@ -61,12 +153,17 @@ export const VariableQueryEditor = ({ onChange, query, onRunQuery, datasource }:
       <Alert title="Query info" severity="info" style={{ marginTop: 10 }}>
         <p>
           Write the query in JSON format. The query result is expected to contain <code>value</code> field which has
-          elements of type <code>string</code> or <code>number</code>.
+          elements of type <code>string</code>, <code>number</code>, <code>bool</code>, <code>ObjectId</code>,{' '}
+          <code>date</code> or <code>Decimal128</code>. Arrays expand into one value per element.
         </p>
         <p>
           The optional
           <code>text</code> field will be used as the display text of variables if exists.
         </p>
+        <p>
+          The macros <code>$__timeFrom</code>, <code>$__timeTo</code> and <code>$__interval_ms</code> are replaced with
+          the dashboard time range and interval.
+        </p>
       </Alert>
     </div>
   );
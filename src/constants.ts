@@ -5,6 +5,20 @@ export const MongoDBAuthMethod = {
   NONE: '',
   USERNAME_PASSWORD: 'username-password',
   X509: 'x509',
+  AWS: 'aws',
+  LDAP: 'ldap',
+  KERBEROS: 'kerberos',
+};
+
+export const ScramMechanism = {
+  AUTO: '',
+  SHA1: 'SCRAM-SHA-1',
+  SHA256: 'SCRAM-SHA-256',
+};
+
+export const ConnectionMode = {
+  FIELDS: '',
+  URI: 'uri',
 };
 
 export const ConnectionStringScheme = {
@@ -18,10 +32,24 @@ export const TlsOption = {
   DISABLED: 'disabled',
 };
 
+export const connectionModeOptions: SelectableValue[] = [
+  { label: 'Fields', value: ConnectionMode.FIELDS },
+  { label: 'Connection string', value: ConnectionMode.URI },
+];
+
 export const authOptions: SelectableValue[] = [
   { label: 'None', value: MongoDBAuthMethod.NONE },
   { label: 'Username/Password', value: MongoDBAuthMethod.USERNAME_PASSWORD },
   { label: 'X.509', value: MongoDBAuthMethod.X509 },
+  { label: 'AWS IAM', value: MongoDBAuthMethod.AWS },
+  { label: 'LDAP', value: MongoDBAuthMethod.LDAP },
+  { label: 'Kerberos', value: MongoDBAuthMethod.KERBEROS },
+];
+
+export const scramMechanismOptions: SelectableValue[] = [
+  { label: 'Auto', value: ScramMechanism.AUTO },
+  { label: 'SCRAM-SHA-1', value: ScramMechanism.SHA1 },
+  { label: 'SCRAM-SHA-256', value: ScramMechanism.SHA256 },
 ];
 
 export const connectionStringSchemeOptions: SelectableValue[] = [
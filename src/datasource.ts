@@ -1,4 +1,7 @@
 import {
+  AdHocVariableFilter,
+  DataSourceGetTagKeysOptions,
+  DataSourceGetTagValuesOptions,
   DataSourceInstanceSettings,
   CoreApp,
   ScopedVars,
@@ -8,8 +11,6 @@ import {
   MetricFindValue,
 } from '@grafana/data';
 import { DataSourceWithBackend, getTemplateSrv, TemplateSrv } from '@grafana/runtime';
-import { EJSON } from 'bson';
-import { parseFilter } from 'mongodb-query-parser';
 import { type Observable } from 'rxjs';
 import { unixTsToMongoID } from './utils';
 import {
@@ -18,7 +19,14 @@ import {
   DEFAULT_QUERY,
   QueryLanguage,
   MongoDBVariableQuery,
-  MongoDBVariableResultEntry,
+  MongoDBVariableQueryResult,
+  MongoDBCollectionInfo,
+  MongoDBCollectionSchema,
+  MongoDBIndexInfo,
+  MongoDBValidationResult,
+  MongoDBPreviewRequest,
+  MongoDBPreviewResult,
+  MongoDBBuilderQuery,
 } from './types';
 import { MongoDBVariableSupport } from './variables';
 
@@ -35,7 +43,7 @@ export class MongoDBDataSource extends DataSourceWithBackend<MongoDBQuery, Mongo
     return DEFAULT_QUERY;
   }
 
-  applyTemplateVariables(query: MongoDBQuery, scopedVars: ScopedVars) {
+  applyTemplateVariables(query: MongoDBQuery, scopedVars: ScopedVars, filters?: AdHocVariableFilter[]) {
     const variables = { ...scopedVars };
 
     let from: number | undefined = undefined;
@@ -63,26 +71,29 @@ export class MongoDBDataSource extends DataSourceWithBackend<MongoDBQuery, Mongo
       variables['__dateBucketCount'] = { value: Math.ceil((to - from) / interval_ms) };
     }
 
-    let text = this.templateSrv.replace(queryText, variables);
-
-    if (query.queryLanguage === QueryLanguage.JAVASCRIPT) {
-      // Convert JS to JSON
-      // TODO: handle errors
-      text = EJSON.stringify(parseFilter(text));
-    }
+    // JavaScript queries are converted to Extended JSON by the backend
+    const text = this.templateSrv.replace(queryText, variables);
     const collection = query.collection ? this.templateSrv.replace(query.collection, variables) : query.collection;
 
     return {
       ...query,
       queryText: text,
       collection,
+      adhocFilters: filters?.map(({ key, operator, value }) => ({ key, operator, value })),
     };
   }
 
   annotations = {};
 
   filterQuery(query: MongoDBQuery): boolean {
-    return !!query.queryText && !!query.collection;
+    if (query.queryLanguage === QueryLanguage.BUILDER) {
+      return !!query.collection && !!query.builder;
+    }
+
+    return (
+      !!query.queryText &&
+      (!!query.collection || query.queryLanguage === QueryLanguage.MONGOSH || query.queryLanguage === QueryLanguage.SQL)
+    );
   }
 
   query(request: DataQueryRequest<MongoDBQuery>): Observable<DataQueryResponse> {
@@ -100,13 +111,73 @@ export class MongoDBDataSource extends DataSourceWithBackend<MongoDBQuery, Mongo
     query: MongoDBVariableQuery,
     options?: LegacyMetricFindQueryOptions,
   ): Promise<MetricFindValue[]> {
-    const results = await this.postResource<MongoDBVariableResultEntry[]>('variable-query', query);
-    return results;
+    const result = await this.postResource<MongoDBVariableQueryResult>('variable-query', query);
+    if (result.truncated) {
+      console.warn(`Variable query returned more than ${result.values.length} values, the rest were left out`);
+    }
+    return result.values;
   }
 
-  getCollectionNames(): Promise<string[]> {
-    return this.getResource('collections').catch((err) => {
+  getCollections(): Promise<MongoDBCollectionInfo[]> {
+    return this.getResource<MongoDBCollectionInfo[]>('collections');
+  }
+
+  getCollectionSchema(collection: string, size?: number): Promise<MongoDBCollectionSchema> {
+    return this.getResource<MongoDBCollectionSchema>(
+      `collections/${encodeURIComponent(collection)}/schema`,
+      size ? { size } : undefined,
+    );
+  }
+
+  getCollectionIndexes(collection: string): Promise<MongoDBIndexInfo[]> {
+    return this.getResource<MongoDBIndexInfo[]>(`collections/${encodeURIComponent(collection)}/indexes`);
+  }
+
+  async getTagKeys(options?: DataSourceGetTagKeysOptions<MongoDBQuery>): Promise<MetricFindValue[]> {
+    const collection = options?.queries?.find((q) => q.collection)?.collection;
+    if (!collection) {
+      return [];
+    }
+    return this.getResource<MetricFindValue[]>('tag-keys', { collection });
+  }
+
+  async getTagValues(options: DataSourceGetTagValuesOptions<MongoDBQuery>): Promise<MetricFindValue[]> {
+    const query = options.queries?.find((q) => q.collection);
+    if (!query?.collection) {
       return [];
+    }
+    // The time field of the builder or the stream limits the values to the time range. Without
+    // one, the backend uses the time field of time series collections
+    const timeField = query.builder?.timeField || query.tailTimeField;
+    return this.getResource<MetricFindValue[]>('tag-values', {
+      collection: query.collection,
+      key: options.key,
+      ...(timeField ? { timeField } : {}),
+      from: options.timeRange?.from.valueOf(),
+      to: options.timeRange?.to.valueOf(),
     });
   }
+
+  validateQuery(queryText: string, queryLanguage?: string): Promise<MongoDBValidationResult> {
+    return this.postResource<MongoDBValidationResult>('validate', { queryText, queryLanguage });
+  }
+
+  previewQuery(request: MongoDBPreviewRequest): Promise<MongoDBPreviewResult> {
+    return this.postResource<MongoDBPreviewResult>('preview', request);
+  }
+
+  // Compiles a builder query to the pipeline text of a raw JSON query
+  compileBuilderQuery(builder: MongoDBBuilderQuery, intervalMs?: number): Promise<string> {
+    return this.postResource<{ queryText: string }>('builder/compile', { builder, intervalMs }).then(
+      (result) => result.queryText
+    );
+  }
+
+  getCollectionNames(): Promise<string[]> {
+    return this.getCollections()
+      .then((collections) => collections.map((c) => c.name))
+      .catch((err) => {
+        return [];
+      });
+  }
 }
@@ -1,4 +1,4 @@
-import { DataSourceJsonData, DateTime, MetricFindValue } from '@grafana/data';
+import { DataFrameJSON, DataSourceJsonData, DateTime, MetricFindValue } from '@grafana/data';
 import { DataQuery } from '@grafana/schema';
 
 export interface MongoDBQuery extends DataQuery {
@@ -12,6 +12,17 @@ export interface MongoDBQuery extends DataQuery {
   aggregateAllowDiskUse?: boolean;
   aggregateMaxAwaitTime?: number;
   aggregateBypassDocumentValidation?: boolean;
+  // Skip the query result cache
+  cacheBypass?: boolean;
+  // Grafana ad-hoc filters, applied by the backend
+  adhocFilters?: Array<{ key: string; operator: string; value: string }>;
+  // Live streaming
+  streamMode?: string;
+  tailTimeField?: string;
+  pollInterval?: number;
+  pollWindow?: number;
+  // Visual query builder, compiled to a pipeline by the backend
+  builder?: MongoDBBuilderQuery;
 
   localFrom?: DateTime;
   localTo?: DateTime;
@@ -20,13 +31,91 @@ export interface MongoDBQuery extends DataQuery {
 export interface MongoDBVariableQuery extends DataQuery {
   queryText?: string;
   collection?: string;
+  // Field paths of the value and the text, default to value and text
+  valueField?: string;
+  textField?: string;
+  // Go time layout of date values, defaults to RFC 3339
+  dateFormat?: string;
+  sort?: string;
+  // Distinct mode: the values of a field among the documents matching an optional filter
+  mode?: string;
+  field?: string;
+  filter?: string;
+  // Max number of values
+  limit?: number;
+  // Dashboard time range in epoch milliseconds and interval, used by the macros
+  from?: number;
+  to?: number;
+  intervalMs?: number;
 }
 
+export interface MongoDBVariableQueryResult {
+  values: MongoDBVariableResultEntry[];
+  truncated: boolean;
+}
+
+export const VariableQueryMode = {
+  PIPELINE: '',
+  DISTINCT: 'distinct',
+};
+
+export const VariableSort = {
+  NONE: '',
+  ASC: 'asc',
+  DESC: 'desc',
+};
+
 export interface MongoDBVariableResultEntry extends MetricFindValue {}
 
+export interface MongoDBCollectionInfo {
+  name: string;
+  type: 'collection' | 'view' | 'timeseries';
+  readOnly: boolean;
+  timeseries?: {
+    timeField: string;
+    metaField?: string;
+    granularity?: string;
+  };
+  view?: {
+    viewOn: string;
+    pipeline: unknown[];
+  };
+}
+
 export const QueryLanguage = {
   JSON: 'json',
   JAVASCRIPT: 'javascript',
+  // mongosh call chains, the collection is part of the query
+  MONGOSH: 'mongosh',
+  // SELECT statements, the collection is given by FROM
+  SQL: 'sql',
+  // Structured queries from the visual builder
+  BUILDER: 'builder',
+};
+
+export const BuilderAggregationType = {
+  COUNT: 'count',
+  SUM: 'sum',
+  AVG: 'avg',
+  MIN: 'min',
+  MAX: 'max',
+  PERCENTILE: 'percentile',
+};
+
+export interface MongoDBBuilderQuery {
+  timeField?: string;
+  filters?: Array<{ field: string; operator: string; value: unknown }>;
+  groupBy?: string[];
+  aggregations?: Array<{ type: string; field?: string; percentile?: number; alias?: string }>;
+  // Interval like 5m, 'auto' for the panel interval, or empty for no time buckets
+  bucketInterval?: string;
+  limit?: number;
+}
+
+export const StreamMode = {
+  NONE: '',
+  TAIL: 'tail',
+  POLL: 'poll',
 };
 
 export const DEFAULT_QUERY: Partial<MongoDBQuery> = {
@@ -40,15 +129,88 @@ export interface JsQueryResult {
   error: string | null;
 }
 
+export interface MongoDBSchemaField {
+  path: string;
+  count: number;
+  types: Record<string, number>;
+  arrayElementTypes?: Record<string, number>;
+  examples?: unknown[];
+  fieldType?: string;
+  grafanaType?: string;
+  conflict?: boolean;
+}
+
+export interface MongoDBCollectionSchema {
+  collection: string;
+  sampleSize: number;
+  fields: MongoDBSchemaField[];
+}
+
+export interface MongoDBIndexInfo {
+  name: string;
+  keys: Record<string, unknown>;
+  unique: boolean;
+  sparse: boolean;
+  partialFilter?: Record<string, unknown>;
+  expireAfterSeconds?: number;
+  usage?: {
+    ops: number;
+    since: string;
+  };
+}
+
+export interface MongoDBValidationResult {
+  valid: boolean;
+  errors: Array<{ message: string; line: number; column: number }>;
+  // Unknown stages, which are left to the server
+  warnings: Array<{ message: string; line: number; column: number }>;
+  serverVersion?: string;
+}
+
+export interface MongoDBPreviewRequest {
+  collection: string;
+  queryText: string;
+  queryLanguage?: string;
+  stage: number;
+  sampleSize?: number;
+  adhocFilters?: Array<{ key: string; operator: string; value: string }>;
+  from?: number;
+  to?: number;
+}
+
+export interface MongoDBPreviewResult {
+  frames: DataFrameJSON[];
+  // A capped count means the stage outputs at least count documents
+  counts: Array<{ stage: number; name: string; count: number; capped: boolean }>;
+}
+
+export interface MongoDBHost {
+  host: string;
+  port?: number;
+}
+
 export interface MongoDataSourceOptions extends DataSourceJsonData {
   // Connection settings
+  connectionMode?: string;
   connectionStringScheme?: string;
   host?: string;
+  // Seed list, used instead of host when set
+  hosts?: MongoDBHost[];
+  replicaSet?: string;
+  directConnection?: boolean;
+  loadBalanced?: boolean;
   database?: string;
   connectionOptions?: string;
   // Authentication
   username?: string;
   authDb?: string;
+  // SCRAM mechanism of username/password auth, negotiated when empty
+  authMechanism?: string;
+  authMechanismProperties?: Record<string, string>;
+  kerberosServiceName?: string;
+  kerberosServiceRealm?: string;
+  kerberosCanonicalizeHost?: boolean;
+  kerberosKeytabPath?: string;
   // TLS/SSL
   tlsOption?: string;
   caCertPath?: string;
@@ -56,9 +218,38 @@ export interface MongoDataSourceOptions extends DataSourceJsonData {
   tlsInsecure?: boolean;
   tlsAllowInvalidHostnames?: boolean;
   tlsAllowInvalidCertificates?: boolean;
+  // SSH tunnel
+  sshTunnelEnabled?: boolean;
+  sshHost?: string;
+  sshPort?: number;
+  sshUser?: string;
+  // Server public key in authorized_keys format, checked instead of the known hosts file
+  sshHostKey?: string;
+  sshKnownHostsPath?: string;
+  // Grafana secure socks proxy, used by Private Data Source Connect
+  enableSecureSocksProxy?: boolean;
+  // Query result cache
+  queryCacheEnabled?: boolean;
+  queryCacheTTL?: number;
+  queryCacheAlignment?: number;
+  queryCacheMaxSizeMB?: number;
 }
 
 export interface MongoDataSourceSecureJsonData {
   password?: string;
   clientKeyPassword?: string;
+  // Full connection string, used with the uri connection mode
+  connectionString?: string;
+  // MONGODB-AWS credentials, read from the environment when empty
+  awsAccessKeyId?: string;
+  awsSecretAccessKey?: string;
+  awsSessionToken?: string;
+  // PEM certificates, used instead of the certificate paths
+  caCert?: string;
+  clientCert?: string;
+  clientKey?: string;
+  // SSH tunnel credentials
+  sshPrivateKey?: string;
+  sshPrivateKeyPassphrase?: string;
+  sshPassword?: string;
 }
@@ -19,14 +19,17 @@ export class MongoDBVariableSupport extends CustomVariableSupport<MongoDBDataSou
 
   query(request: DataQueryRequest<MongoDBVariableQuery>): Observable<DataQueryResponse> {
     const [target] = request.targets;
-    const interpolated = getTemplateSrv().replace(target.queryText);
+    const templateSrv = getTemplateSrv();
 
     return from(
       this.datasource
         .metricFindQuery({
-          refId: target.refId,
-          queryText: interpolated,
-          collection: target.collection,
+          ...target,
+          queryText: templateSrv.replace(target.queryText),
+          filter: templateSrv.replace(target.filter),
+          from: request.range.from.valueOf(),
+          to: request.range.to.valueOf(),
+          intervalMs: request.intervalMs,
         })
         .then((metricFindValues) => {
           const frame: DataFrame = {